@@ -32,6 +32,13 @@ Examples of a buffering middleware:
   // before returning the response
   buffer.New(handler, buffer.Retry(`IsNetworkError() && Attempts() <= 2`))
 
+  // Same as above, but waits 100ms, 200ms and so on up to 2s with the random jitter between the attempts,
+  // the retries are dropped once they exceed 20% of the requests over the last 10 seconds
+  buffer.New(handler,
+    buffer.Retry(`IsNetworkError() && Attempts() <= 5`),
+    buffer.RetryBackoff(100 * time.Millisecond, 2 * time.Second, buffer.FullJitter),
+    buffer.RetryBudget(0.2, 10))
+
 */
 package buffer
 
@@ -40,12 +47,16 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
 
 	"bufio"
+	stdcontext "context"
 	"net"
 	"reflect"
 
 	"github.com/mailgun/multibuf"
+	"github.com/mailgun/timetools"
 	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/oxy/utils"
 )
@@ -70,7 +81,17 @@ type Buffer struct {
 	maxResponseBodyBytes int64
 	memResponseBodyBytes int64
 
-	retryPredicate hpredicate
+	retryPredicate   hpredicate
+	attemptTimeout   time.Duration
+	maxRetryAttempts int
+	maxRetryAfter    time.Duration
+
+	backoff          *backoff
+	budgetRatio      float64
+	budgetMinRetries int
+	budget           *retryBudget
+
+	clock      timetools.TimeProvider
 
 	next       http.Handler
 	errHandler utils.ErrorHandler
@@ -86,6 +107,8 @@ func New(next http.Handler, setters ...optSetter) (*Buffer, error) {
 
 		maxResponseBodyBytes: DefaultMaxBodyBytes,
 		memResponseBodyBytes: DefaultMemBodyBytes,
+
+		maxRetryAttempts: DefaultMaxRetryAttempts,
 	}
 	for _, s := range setters {
 		if err := s(strm); err != nil {
@@ -95,6 +118,16 @@ func New(next http.Handler, setters ...optSetter) (*Buffer, error) {
 	if strm.errHandler == nil {
 		strm.errHandler = errHandler
 	}
+	if strm.clock == nil {
+		strm.clock = &timetools.RealTime{}
+	}
+	if strm.budgetRatio > 0 || strm.budgetMinRetries > 0 {
+		budget, err := newRetryBudget(strm.budgetRatio, strm.budgetMinRetries, strm.clock)
+		if err != nil {
+			return nil, err
+		}
+		strm.budget = budget
+	}
 
 	return strm, nil
 }
@@ -106,12 +139,28 @@ type optSetter func(s *Buffer) error
 //
 // Attempts() - limits the amount of retry attempts
 // ResponseCode() - returns http response code
+// ResponseHeader("X") - returns the value of the response header X
+// RequestMethod() - returns the request method, e.g. GET
+// RequestPath() - returns the request path
+// RequestHeader("X") - returns the value of the request header X
+// ElapsedMS() - returns the milliseconds passed since the first attempt
+// IsIdempotent() - tests if the request method is idempotent, e.g. GET or PUT
 // IsNetworkError() - tests if response code is related to networking error
+// IsTimeout() - tests if the attempt has timed out
+// IsConnectionRefused() - tests if the server has refused the connection
+//
+// The errors are recorded by utils.DefaultHandler, so IsTimeout and IsConnectionRefused require the forwarder
+// below the buffer to use it or to record the errors with utils.Attempts.SetError.
+// The values can be tested against a list with `in`, e.g. `ResponseCode() in [502, 503, 504]`.
+// The predicates can be negated with !, e.g. `!IsIdempotent()`.
 //
 // Example of the predicate:
 //
 // `Attempts() <= 2 && ResponseCode() == 502`
+// `IsIdempotent() && (IsTimeout() || IsConnectionRefused()) && ElapsedMS() < 1000`
 //
+// The attempts are tracked in the request context, so roundrobin load balancers below the buffer
+// send the retries to the servers that have not been tried yet.
 func Retry(predicate string) optSetter {
 	return func(s *Buffer) error {
 		p, err := parseExpression(predicate)
@@ -123,6 +172,82 @@ func Retry(predicate string) optSetter {
 	}
 }
 
+// RetryAttemptTimeout limits the time of every attempt to proxy the request,
+// the attempt that takes longer is cancelled and fails with 504 Gateway Timeout
+func RetryAttemptTimeout(d time.Duration) optSetter {
+	return func(s *Buffer) error {
+		if d < 0 {
+			return fmt.Errorf("attempt timeout should be >= 0, got %v", d)
+		}
+		s.attemptTimeout = d
+		return nil
+	}
+}
+
+// MaxRetryAttempts sets the max number of the retries of the request, regardless of the retry predicate
+func MaxRetryAttempts(n int) optSetter {
+	return func(s *Buffer) error {
+		if n < 0 {
+			return fmt.Errorf("max retry attempts should be >= 0, got %v", n)
+		}
+		s.maxRetryAttempts = n
+		return nil
+	}
+}
+
+// RetryBackoff waits between the attempts, the wait starts with base and doubles with every retry up to max.
+// The jitter randomizes the wait, the retries are not delayed by default.
+// The request is not retried anymore once its context is cancelled while waiting.
+func RetryBackoff(base, max time.Duration, jitter Jitter) optSetter {
+	return func(s *Buffer) error {
+		if base <= 0 || max < base {
+			return fmt.Errorf("backoff base should be > 0 and max should be >= base, got %v and %v", base, max)
+		}
+		if jitter < NoJitter || jitter > DecorrelatedJitter {
+			return fmt.Errorf("unsupported jitter: %v", jitter)
+		}
+		s.backoff = &backoff{base: base, max: max, jitter: jitter}
+		return nil
+	}
+}
+
+// RetryAfter honors the Retry-After header of the upstream responses, the request is retried not sooner than
+// the upstream has asked for. The request is not retried if the upstream has asked to wait for longer than max.
+func RetryAfter(max time.Duration) optSetter {
+	return func(s *Buffer) error {
+		if max <= 0 {
+			return fmt.Errorf("max retry after should be > 0, got %v", max)
+		}
+		s.maxRetryAfter = max
+		return nil
+	}
+}
+
+// RetryBudget limits the retries to the ratio of the requests over the last 10 seconds, e.g. 0.2 allows
+// the retries of 20% of the requests. minRetries are allowed regardless of the ratio, so the requests
+// are still retried when the traffic is low.
+func RetryBudget(ratio float64, minRetries int) optSetter {
+	return func(s *Buffer) error {
+		if ratio < 0 || minRetries < 0 {
+			return fmt.Errorf("retry ratio and min retries should be >= 0, got %v and %v", ratio, minRetries)
+		}
+		if ratio == 0 && minRetries == 0 {
+			return fmt.Errorf("retry budget should allow some retries")
+		}
+		s.budgetRatio = ratio
+		s.budgetMinRetries = minRetries
+		return nil
+	}
+}
+
+// Clock sets the clock the retry budget window and the waits before the retries are measured with
+func Clock(clock timetools.TimeProvider) optSetter {
+	return func(s *Buffer) error {
+		s.clock = clock
+		return nil
+	}
+}
+
 // ErrorHandler sets error handler of the server
 func ErrorHandler(h utils.ErrorHandler) optSetter {
 	return func(s *Buffer) error {
@@ -231,6 +356,20 @@ func (s *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	outreq := s.copyRequest(req, body, totalSize)
 
+	var attempts *utils.Attempts
+	var bo *backoff
+	if s.retryPredicate != nil {
+		attempts = utils.NewAttempts()
+		if s.budget != nil {
+			s.budget.request()
+		}
+		if s.backoff != nil {
+			b := *s.backoff
+			bo = &b
+		}
+	}
+
+	start := s.clock.UtcNow()
 	attempt := 1
 	for {
 		// We create a special writer that will limit the response size, buffer it to disk if necessary
@@ -249,7 +388,7 @@ func (s *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 		defer b.Close()
 
-		s.next.ServeHTTP(b, outreq)
+		s.serveAttempt(b, outreq, attempts)
 		if b.hijacked {
 			log.Infof("vulcand/oxy/buffer: connection was hijacked downstream. Not taking any action in buffer.")
 			return
@@ -267,8 +406,9 @@ func (s *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			reader = rdr
 		}
 
-		if (s.retryPredicate == nil || attempt > DefaultMaxRetryAttempts) ||
-			!s.retryPredicate(&context{r: req, attempt: attempt, responseCode: b.code}) {
+		if (s.retryPredicate == nil || attempt > s.maxRetryAttempts) ||
+			!s.retryPredicate(s.newContext(req, attempt, b, attempts, start)) ||
+			!s.allowRetry(req, b.Header()) || !s.wait(req, bo, attempt, b.Header()) || !s.withdrawRetry(req) {
 			utils.CopyHeaders(w.Header(), b.Header())
 			w.WriteHeader(b.code)
 			if reader != nil {
@@ -291,6 +431,99 @@ func (s *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// newContext returns the context the retry predicate is evaluated with after the attempt
+func (s *Buffer) newContext(req *http.Request, attempt int, b *bufferWriter, attempts *utils.Attempts, start time.Time) *context {
+	return &context{
+		r:              req,
+		attempt:        attempt,
+		responseCode:   b.code,
+		responseHeader: b.Header(),
+		err:            attempts.Err(),
+		elapsed:        s.clock.UtcNow().Sub(start),
+	}
+}
+
+// allowRetry returns true if the upstream has not asked to wait for too long and the retry budget is not exhausted,
+// so the request does not wait for the retry in vain
+func (s *Buffer) allowRetry(req *http.Request, header http.Header) bool {
+	if d := s.retryAfter(header); d > s.maxRetryAfter {
+		log.Infof("vulcand/oxy/buffer: upstream asked to retry Request(%v %v) in %v, not retrying", req.Method, req.URL, d)
+		return false
+	}
+	if s.budget == nil || s.budget.allows() {
+		return true
+	}
+	log.Warnf("vulcand/oxy/buffer: retry budget exhausted, not retrying Request(%v %v)", req.Method, req.URL)
+	return false
+}
+
+// withdrawRetry returns true if the retry fits the retry budget, it is called after the wait,
+// so the request cancelled while waiting does not use the budget
+func (s *Buffer) withdrawRetry(req *http.Request) bool {
+	if s.budget == nil || s.budget.withdraw() {
+		return true
+	}
+	log.Warnf("vulcand/oxy/buffer: retry budget exhausted, not retrying Request(%v %v)", req.Method, req.URL)
+	return false
+}
+
+// wait waits for the backoff or the time the upstream has asked for, whichever is longer, before the next attempt
+// and returns false if the request has been cancelled meanwhile
+func (s *Buffer) wait(req *http.Request, bo *backoff, attempt int, header http.Header) bool {
+	d := s.retryAfter(header)
+	if bo != nil {
+		if b := bo.next(attempt); b > d {
+			d = b
+		}
+	}
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-s.clock.After(d):
+		return true
+	case <-req.Context().Done():
+		log.Infof("vulcand/oxy/buffer: Request(%v %v) cancelled while waiting to retry", req.Method, req.URL)
+		return false
+	}
+}
+
+// retryAfter returns the time the upstream has asked to wait for with the Retry-After header,
+// 0 if the header is missing or is not honored
+func (s *Buffer) retryAfter(header http.Header) time.Duration {
+	v := header.Get("Retry-After")
+	if s.maxRetryAfter == 0 || v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(s.clock.UtcNow()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// serveAttempt sends the request to the next handler, the response is buffered once it returns
+// so the attempt context can be cancelled
+func (s *Buffer) serveAttempt(w http.ResponseWriter, req *http.Request, attempts *utils.Attempts) {
+	if attempts != nil {
+		attempts.Next()
+		req = utils.WithAttempts(req, attempts)
+	}
+	if s.attemptTimeout > 0 {
+		ctx, cancel := stdcontext.WithTimeout(req.Context(), s.attemptTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	s.next.ServeHTTP(w, req)
+}
+
 func (s *Buffer) copyRequest(req *http.Request, body io.ReadCloser, bodySize int64) *http.Request {
 	o := *req
 	o.URL = utils.CopyURL(req.URL)
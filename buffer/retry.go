@@ -0,0 +1,131 @@
+package buffer
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/memmetrics"
+)
+
+// Jitter randomizes the backoff between the retries, so the clients retrying at the same time
+// do not hit the servers all at once
+type Jitter int
+
+const (
+	// NoJitter waits for the exact exponential backoff
+	NoJitter Jitter = iota
+	// FullJitter waits for the random time between zero and the exponential backoff
+	FullJitter
+	// DecorrelatedJitter waits for the random time between the base backoff and three times the previous wait
+	DecorrelatedJitter
+)
+
+// backoff calculates the waits between the retries of the request
+type backoff struct {
+	base   time.Duration
+	max    time.Duration
+	jitter Jitter
+	prev   time.Duration
+}
+
+// next returns the wait before the given retry, the first retry is 1
+func (b *backoff) next(retry int) time.Duration {
+	var d time.Duration
+	switch b.jitter {
+	case DecorrelatedJitter:
+		prev := b.prev
+		if prev < b.base {
+			prev = b.base
+		}
+		d = b.base + randDuration(3*prev-b.base)
+	default:
+		d = b.base
+		for i := 1; i < retry && d < b.max; i++ {
+			d *= 2
+		}
+	}
+	if d > b.max {
+		d = b.max
+	}
+	if b.jitter == FullJitter {
+		d = randDuration(d)
+	}
+	b.prev = d
+	return d
+}
+
+func randDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// retryBudget limits the ratio of the retries to the requests over the rolling window,
+// so the retries do not multiply the load on the servers during the outages
+type retryBudget struct {
+	mtx        *sync.Mutex
+	ratio      float64
+	minRetries int
+	requests   *memmetrics.RollingCounter
+	retries    *memmetrics.RollingCounter
+}
+
+func newRetryBudget(ratio float64, minRetries int, clock timetools.TimeProvider) (*retryBudget, error) {
+	if ratio < 0 || minRetries < 0 {
+		return nil, fmt.Errorf("retry ratio and min retries should be >= 0, got %v and %v", ratio, minRetries)
+	}
+	requests, err := memmetrics.NewCounter(budgetBuckets, budgetResolution, memmetrics.CounterClock(clock))
+	if err != nil {
+		return nil, err
+	}
+	retries, err := memmetrics.NewCounter(budgetBuckets, budgetResolution, memmetrics.CounterClock(clock))
+	if err != nil {
+		return nil, err
+	}
+	return &retryBudget{
+		mtx:        &sync.Mutex{},
+		ratio:      ratio,
+		minRetries: minRetries,
+		requests:   requests,
+		retries:    retries,
+	}, nil
+}
+
+// request records the incoming request
+func (b *retryBudget) request() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.requests.Inc(1)
+}
+
+// allows returns true if one more retry fits the budget without recording it
+func (b *retryBudget) allows() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.allowsLocked()
+}
+
+// withdraw records the retry and returns true if it fits the budget
+func (b *retryBudget) withdraw() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if !b.allowsLocked() {
+		return false
+	}
+	b.retries.Inc(1)
+	return true
+}
+
+func (b *retryBudget) allowsLocked() bool {
+	retries := b.retries.Count() + 1
+	return retries <= int64(b.minRetries) || float64(retries) <= b.ratio*float64(b.requests.Count())
+}
+
+const (
+	budgetBuckets    = 10
+	budgetResolution = time.Second
+)
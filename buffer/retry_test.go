@@ -1,9 +1,13 @@
 package buffer
 
 import (
+	stdcontext "context"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
+	"time"
 
+	"github.com/mailgun/timetools"
 	"github.com/vulcand/oxy/forward"
 	"github.com/vulcand/oxy/roundrobin"
 	"github.com/vulcand/oxy/testutils"
@@ -75,6 +79,352 @@ func (s *RTSuite) TestRetryExceedAttempts(c *C) {
 	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
 }
 
+func (s *RTSuite) TestRetryOnDifferentServer(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	lb, rt := new(c, `IsNetworkError() && Attempts() <= 2`)
+
+	proxy := httptest.NewServer(rt)
+	defer proxy.Close()
+
+	lb.UpsertServer(testutils.ParseURI("http://localhost:64321"))
+	lb.UpsertServer(testutils.ParseURI("http://localhost:64322"))
+	lb.UpsertServer(testutils.ParseURI(srv.URL))
+
+	// every request reaches the live server in at most 3 attempts, as the retries skip the servers already tried
+	for i := 0; i < 6; i++ {
+		re, body, err := testutils.Get(proxy.URL)
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Equals, "hello")
+	}
+}
+
+func (s *RTSuite) TestRetryAttemptTimeout(c *C) {
+	var requests int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			time.Sleep(time.Second)
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := roundrobin.New(fwd)
+	c.Assert(err, IsNil)
+	lb.UpsertServer(testutils.ParseURI(srv.URL))
+
+	rt, err := New(lb, Retry(`ResponseCode() == 504 && Attempts() <= 2`), RetryAttemptTimeout(100*time.Millisecond))
+	c.Assert(err, IsNil)
+
+	proxy := httptest.NewServer(rt)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hello")
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(2))
+
+	_, err = New(lb, RetryAttemptTimeout(-1))
+	c.Assert(err, NotNil)
+}
+
+func (s *RTSuite) TestMaxRetryAttempts(c *C) {
+	var requests int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	rt, err := New(handler, Retry(`IsNetworkError()`), MaxRetryAttempts(2))
+	c.Assert(err, IsNil)
+
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Assert(w.Code, Equals, http.StatusBadGateway)
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(3))
+
+	_, err = New(handler, MaxRetryAttempts(-1))
+	c.Assert(err, NotNil)
+}
+
+func (s *RTSuite) TestRetryBackoff(c *C) {
+	var requests int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	rt, err := New(handler, Retry(`IsNetworkError()`), RetryBackoff(20*time.Millisecond, time.Second, NoJitter), Clock(clock))
+	c.Assert(err, IsNil)
+
+	start := clock.UtcNow()
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(3))
+	// waits for 20ms and 40ms before the retries
+	c.Assert(clock.UtcNow().Sub(start), Equals, 60*time.Millisecond)
+
+	for _, o := range []optSetter{RetryBackoff(0, time.Second, NoJitter), RetryBackoff(time.Second, time.Millisecond, NoJitter), RetryBackoff(time.Second, time.Second, Jitter(10))} {
+		_, err = New(handler, o)
+		c.Assert(err, NotNil)
+	}
+}
+
+func (s *RTSuite) TestRetryBackoffCancel(c *C) {
+	var requests int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	rt, err := New(handler, Retry(`IsNetworkError()`), RetryBackoff(time.Minute, time.Minute, NoJitter))
+	c.Assert(err, IsNil)
+
+	ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// the last response is returned once the request is cancelled while waiting
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	c.Assert(w.Code, Equals, http.StatusBadGateway)
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(1))
+}
+
+func (s *RTSuite) TestBackoff(c *C) {
+	b := &backoff{base: 10 * time.Millisecond, max: 50 * time.Millisecond}
+	c.Assert(b.next(1), Equals, 10*time.Millisecond)
+	c.Assert(b.next(2), Equals, 20*time.Millisecond)
+	c.Assert(b.next(3), Equals, 40*time.Millisecond)
+	c.Assert(b.next(4), Equals, 50*time.Millisecond)
+	c.Assert(b.next(100), Equals, 50*time.Millisecond)
+
+	b = &backoff{base: 10 * time.Millisecond, max: 50 * time.Millisecond, jitter: FullJitter}
+	for i := 1; i < 10; i++ {
+		d := b.next(i)
+		c.Assert(d >= 0 && d < 50*time.Millisecond, Equals, true)
+	}
+
+	b = &backoff{base: 10 * time.Millisecond, max: 50 * time.Millisecond, jitter: DecorrelatedJitter}
+	for i := 1; i < 10; i++ {
+		prev := b.prev
+		if prev < b.base {
+			prev = b.base
+		}
+		d := b.next(i)
+		c.Assert(d >= 10*time.Millisecond && d <= 50*time.Millisecond && d <= 3*prev, Equals, true)
+	}
+}
+
+func (s *RTSuite) TestRetryBudget(c *C) {
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+
+	var requests int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	rt, err := New(handler, Retry(`IsNetworkError() && Attempts() <= 1`), RetryBudget(0.2, 1), Clock(clock))
+	c.Assert(err, IsNil)
+
+	serve := func() {
+		rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	// the min retries are allowed regardless of the ratio
+	serve()
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(2))
+
+	// 2 retries of 10 requests fit the budget, the rest are not retried
+	for i := 0; i < 9; i++ {
+		serve()
+	}
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(12))
+
+	// the budget is restored once the window has passed
+	clock.Sleep(10 * time.Second)
+	serve()
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(14))
+
+	// the request cancelled while waiting to retry does not use the budget,
+	// the clock is not advanced so the wait never ends
+	rt, err = New(handler, Retry(`IsNetworkError() && Attempts() <= 1`), RetryBudget(0.2, 1), RetryBackoff(time.Minute, time.Minute, NoJitter),
+		Clock(timetools.SleepProvider(clock.UtcNow())))
+	c.Assert(err, IsNil)
+	ctx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	cancel()
+	atomic.StoreInt32(&requests, 0)
+	rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(1))
+	c.Assert(rt.budget.retries.Count(), Equals, int64(0))
+
+	_, err = New(handler, RetryBudget(-1, 0))
+	c.Assert(err, NotNil)
+	_, err = New(handler, RetryBudget(0, 0))
+	c.Assert(err, NotNil)
+}
+
+func (s *RTSuite) TestRetryPredicates(c *C) {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1?q=1", nil)
+	req.Header.Set("X-Retry", "yes")
+	ctx := &context{
+		r:              req,
+		attempt:        1,
+		responseCode:   503,
+		responseHeader: http.Header{"X-Upstream": []string{"busy"}},
+		elapsed:        1500 * time.Millisecond,
+	}
+
+	testCases := []struct {
+		expr     string
+		expected bool
+	}{
+		{`RequestPath() == "/api/v1"`, true},
+		{`RequestHeader("X-Retry") == "yes"`, true},
+		{`RequestHeader("X-Other") == "yes"`, false},
+		{`ResponseHeader("X-Upstream") == "busy"`, true},
+		{`ElapsedMS() > 1000 && ElapsedMS() < 2000`, true},
+		{`IsIdempotent()`, false},
+		{`ResponseCode() in [502, 503, 504]`, true},
+		{`ResponseCode() in [502, 504]`, false},
+		{`RequestMethod() in ["GET", "POST"] && Attempts() in [1]`, true},
+		{`ResponseHeader("X-Upstream") in ["busy"] && ResponseCode() in []`, false},
+		{`In(ResponseCode(), 503)`, true},
+		{`RequestPath() == "/api in [v1]"`, false},
+		{`ResponseHeader("X-Upstream") != "a in [b]" && ResponseCode() in [503]`, true},
+		{`ResponseHeader("in [") in ["", "busy"]`, true},
+		{"ResponseCode()\n\tin [503]", true},
+		{`IsTimeout() || IsConnectionRefused()`, false},
+	}
+	for _, tc := range testCases {
+		p, err := parseExpression(tc.expr)
+		c.Assert(err, IsNil, Commentf(tc.expr))
+		c.Assert(p(ctx), Equals, tc.expected, Commentf(tc.expr))
+	}
+
+	ctx.r = httptest.NewRequest(http.MethodPut, "/", nil)
+	p, err := parseExpression(`IsIdempotent()`)
+	c.Assert(err, IsNil)
+	c.Assert(p(ctx), Equals, true)
+
+	c.Assert(IsValidExpression(`ResponseCode() in [502, "503"]`), Equals, false)
+	c.Assert(IsValidExpression(`RequestHeader() == "yes"`), Equals, false)
+}
+
+func (s *RTSuite) TestRewriteIn(c *C) {
+	testCases := []struct {
+		in       string
+		expected string
+	}{
+		{`ResponseCode() in [502, 504]`, `In(ResponseCode(), 502, 504)`},
+		{`ResponseCode() in []`, `In(ResponseCode())`},
+		{`RequestHeader("X-A") in ["a"] && Attempts() in [1]`, `In(RequestHeader("X-A"), "a") && In(Attempts(), 1)`},
+		{`RequestPath() == "/a in [b]"`, `RequestPath() == "/a in [b]"`},
+		{`RequestPath() == "Attempts() in [1]"`, `RequestPath() == "Attempts() in [1]"`},
+		{`RequestHeader("x in [1]") in ["a in [b]"]`, `In(RequestHeader("x in [1]"), "a in [b]")`},
+		{`IsNetworkError()`, `IsNetworkError()`},
+	}
+	for _, tc := range testCases {
+		c.Assert(rewriteIn(tc.in), Equals, tc.expected, Commentf(tc.in))
+	}
+}
+
+func (s *RTSuite) TestRetryOnConnectionRefused(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	lb, rt := new(c, `IsConnectionRefused() && !IsTimeout() && Attempts() <= 2`)
+
+	proxy := httptest.NewServer(rt)
+	defer proxy.Close()
+
+	lb.UpsertServer(testutils.ParseURI("http://localhost:64321"))
+	lb.UpsertServer(testutils.ParseURI(srv.URL))
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hello")
+}
+
+func (s *RTSuite) TestRetryOnTimeout(c *C) {
+	var requests int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			time.Sleep(time.Second)
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+	lb, err := roundrobin.New(fwd)
+	c.Assert(err, IsNil)
+	lb.UpsertServer(testutils.ParseURI(srv.URL))
+
+	rt, err := New(lb, Retry(`IsTimeout() && !IsConnectionRefused() && Attempts() <= 2`), RetryAttemptTimeout(100*time.Millisecond))
+	c.Assert(err, IsNil)
+
+	proxy := httptest.NewServer(rt)
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(2))
+}
+
+func (s *RTSuite) TestRetryAfter(c *C) {
+	var requests int32
+	retryAfter := "1"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	rt, err := New(handler, Retry(`ResponseCode() == 503`), RetryAfter(2*time.Second), Clock(clock))
+	c.Assert(err, IsNil)
+
+	start := clock.UtcNow()
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(clock.UtcNow().Sub(start), Equals, time.Second)
+
+	// the upstream asks to wait for too long
+	atomic.StoreInt32(&requests, 0)
+	retryAfter = clock.UtcNow().Add(time.Hour).Format(http.TimeFormat)
+	w = httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Assert(w.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(w.Header().Get("Retry-After"), Equals, retryAfter)
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(1))
+
+	_, err = New(handler, RetryAfter(0))
+	c.Assert(err, NotNil)
+}
+
 func new(c *C, p string) (*roundrobin.RoundRobin, *Buffer) {
 	// forwarder will proxy the request to whatever destination
 	fwd, err := forward.New()
@@ -1,8 +1,17 @@
 package buffer
 
 import (
+	"bytes"
+	stdcontext "context"
+	"errors"
 	"fmt"
+	"go/scanner"
+	"go/token"
+	"net"
 	"net/http"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/vulcand/predicate"
 )
@@ -13,18 +22,23 @@ func IsValidExpression(expr string) bool {
 }
 
 type context struct {
-	r            *http.Request
-	attempt      int
-	responseCode int
+	r              *http.Request
+	attempt        int
+	responseCode   int
+	responseHeader http.Header
+	err            error
+	elapsed        time.Duration
 }
 
 type hpredicate func(*context) bool
 
 // Parses expression in the go language into Failover predicates
 func parseExpression(in string) (hpredicate, error) {
+	in = rewriteIn(in)
 	p, err := predicate.NewParser(predicate.Def{
 		Operators: predicate.Operators{
 			AND: and,
+			NOT: not,
 			OR:  or,
 			EQ:  eq,
 			NEQ: neq,
@@ -34,10 +48,18 @@ func parseExpression(in string) (hpredicate, error) {
 			GE:  ge,
 		},
 		Functions: map[string]interface{}{
-			"RequestMethod":  requestMethod,
-			"IsNetworkError": isNetworkError,
-			"Attempts":       attempts,
-			"ResponseCode":   responseCode,
+			"RequestMethod":       requestMethod,
+			"RequestPath":         requestPath,
+			"RequestHeader":       requestHeader,
+			"ResponseHeader":      responseHeader,
+			"IsIdempotent":        isIdempotent,
+			"IsNetworkError":      isNetworkError,
+			"IsTimeout":           isTimeout,
+			"IsConnectionRefused": isConnectionRefused,
+			"Attempts":            attempts,
+			"ResponseCode":        responseCode,
+			"ElapsedMS":           elapsedMS,
+			"In":                  inList,
 		},
 	})
 	if err != nil {
@@ -54,6 +76,86 @@ func parseExpression(in string) (hpredicate, error) {
 	return pr, nil
 }
 
+// rewriteIn rewrites the `in` operators that are not the part of go syntax into calls to In,
+// e.g. `ResponseCode() in [502, 504]` becomes `In(ResponseCode(), 502, 504)`. The expression is tokenised,
+// so the string literals, e.g. `RequestPath() == "/a in [b]"`, are never rewritten.
+func rewriteIn(in string) string {
+	src := []byte(in)
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+
+	var toks []inToken
+	var sc scanner.Scanner
+	sc.Init(file, src, nil, 0)
+	for {
+		pos, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		// skip the semicolons inserted at the line ends
+		if tok == token.SEMICOLON && lit == "\n" {
+			continue
+		}
+		toks = append(toks, inToken{offset: file.Offset(pos), tok: tok, lit: lit})
+	}
+
+	var out bytes.Buffer
+	last := 0
+	for i := 0; i < len(toks); i++ {
+		if toks[i].tok != token.IDENT || toks[i].lit != "in" || i+1 >= len(toks) || toks[i+1].tok != token.LBRACK {
+			continue
+		}
+		start := mapperStart(toks, i)
+		end := -1
+		for j := i + 2; j < len(toks); j++ {
+			if toks[j].tok == token.RBRACK {
+				end = j
+				break
+			}
+		}
+		if start == -1 || end == -1 || toks[start].offset < last {
+			continue
+		}
+		mapper := in[toks[start].offset : toks[i-1].offset+1]
+		values := strings.TrimSpace(in[toks[i+1].offset+1 : toks[end].offset])
+
+		out.WriteString(in[last:toks[start].offset])
+		if values == "" {
+			fmt.Fprintf(&out, "In(%v)", mapper)
+		} else {
+			fmt.Fprintf(&out, "In(%v, %v)", mapper, values)
+		}
+		last = toks[end].offset + 1
+		i = end
+	}
+	out.WriteString(in[last:])
+	return out.String()
+}
+
+type inToken struct {
+	offset int
+	tok    token.Token
+	lit    string
+}
+
+// mapperStart returns the index of the first token of the `Mapper()` or `Mapper("arg")` call
+// preceding the `in` token at i, or -1 if there is none
+func mapperStart(toks []inToken, i int) int {
+	is := func(j int, tok token.Token) bool {
+		return j >= 0 && toks[j].tok == tok
+	}
+	if !is(i-1, token.RPAREN) {
+		return -1
+	}
+	if is(i-2, token.LPAREN) && is(i-3, token.IDENT) {
+		return i - 3
+	}
+	if is(i-2, token.STRING) && is(i-3, token.LPAREN) && is(i-4, token.IDENT) {
+		return i - 4
+	}
+	return -1
+}
+
 type toString func(c *context) string
 type toInt func(c *context) int
 
@@ -64,6 +166,34 @@ func requestMethod() toString {
 	}
 }
 
+// RequestPath returns mapper of the request to its path
+func requestPath() toString {
+	return func(c *context) string {
+		return c.r.URL.Path
+	}
+}
+
+// RequestHeader returns mapper of the request to the value of its header
+func requestHeader(name string) toString {
+	return func(c *context) string {
+		return c.r.Header.Get(name)
+	}
+}
+
+// ResponseHeader returns mapper of the request to the value of the header of the last response
+func responseHeader(name string) toString {
+	return func(c *context) string {
+		return c.responseHeader.Get(name)
+	}
+}
+
+// ElapsedMS returns mapper of the request to the milliseconds passed since the first attempt
+func elapsedMS() toInt {
+	return func(c *context) int {
+		return int(c.elapsed / time.Millisecond)
+	}
+}
+
 // Attempts returns mapper of the request to the number of proxy attempts
 func attempts() toInt {
 	return func(c *context) int {
@@ -85,6 +215,51 @@ func isNetworkError() hpredicate {
 	}
 }
 
+// IsIdempotent returns a predicate that returns true if the request method is idempotent as defined by RFC 7231
+func isIdempotent() hpredicate {
+	return func(c *context) bool {
+		switch c.r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+			return true
+		}
+		return false
+	}
+}
+
+// IsTimeout returns a predicate that returns true if last attempt has timed out
+func isTimeout() hpredicate {
+	return func(c *context) bool {
+		if c.err == nil {
+			return false
+		}
+		var ne net.Error
+		if errors.As(c.err, &ne) && ne.Timeout() {
+			return true
+		}
+		return errors.Is(c.err, stdcontext.DeadlineExceeded)
+	}
+}
+
+// IsConnectionRefused returns a predicate that returns true if the server has refused the connection on last attempt
+func isConnectionRefused() hpredicate {
+	return func(c *context) bool {
+		return c.err != nil && errors.Is(c.err, syscall.ECONNREFUSED)
+	}
+}
+
+// inList returns predicate that tests that the value of the mapper is one of the constants
+func inList(m interface{}, values ...interface{}) (hpredicate, error) {
+	ps := make([]hpredicate, len(values))
+	for i, v := range values {
+		p, err := eq(m, v)
+		if err != nil {
+			return nil, err
+		}
+		ps[i] = p
+	}
+	return or(ps...), nil
+}
+
 // and returns predicate by joining the passed predicates with logical 'and'
 func and(fns ...hpredicate) hpredicate {
 	return func(c *context) bool {
@@ -0,0 +1,340 @@
+// package bulkhead isolates the partitions of the traffic, e.g. routes, tenants or upstreams, from each other
+// by limiting the concurrent requests per partition. The requests over the limit wait in the bounded queue
+// and are rejected once the queue is full or they have waited for too long.
+package bulkhead
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/cbreaker"
+	"github.com/vulcand/oxy/memmetrics"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Bulkhead limits the concurrent requests per partition
+type Bulkhead struct {
+	mutex         *sync.Mutex
+	extract       utils.SourceExtractor
+	maxConcurrent int
+	limits        map[string]int
+	maxQueue      int
+	queueTimeout  time.Duration
+	partitions    map[string]*partition
+	next          http.Handler
+
+	// metrics are guarded by the mutex
+	waitTime *memmetrics.RollingHDRHistogram
+	rejected int64
+	timedOut int64
+
+	breaker    *cbreaker.CircuitBreaker
+	errHandler utils.ErrorHandler
+	clock      timetools.TimeProvider
+}
+
+// partition has the requests in progress and the queue of the waiting ones
+type partition struct {
+	active int
+	queue  *list.List
+}
+
+// waiter is the request waiting in the queue, the channel is closed once it is let through
+type waiter chan struct{}
+
+// New returns the bulkhead letting through maxConcurrent requests per partition extracted from the request
+func New(next http.Handler, extract utils.SourceExtractor, maxConcurrent int, options ...BulkheadOption) (*Bulkhead, error) {
+	if extract == nil {
+		return nil, fmt.Errorf("Extract function can not be nil")
+	}
+	if maxConcurrent <= 0 {
+		return nil, fmt.Errorf("max concurrent requests should be > 0, got %v", maxConcurrent)
+	}
+	b := &Bulkhead{
+		mutex:         &sync.Mutex{},
+		extract:       extract,
+		maxConcurrent: maxConcurrent,
+		limits:        make(map[string]int),
+		maxQueue:      defaultQueueSize,
+		queueTimeout:  defaultQueueTimeout,
+		partitions:    make(map[string]*partition),
+		next:          next,
+	}
+	for _, o := range options {
+		if err := o(b); err != nil {
+			return nil, err
+		}
+	}
+	if b.errHandler == nil {
+		b.errHandler = defaultErrHandler
+	}
+	if b.clock == nil {
+		b.clock = &timetools.RealTime{}
+	}
+	h, err := memmetrics.NewRollingHDRHistogram(histMin, histMax, histSignificantFigures, histPeriod, histBuckets, memmetrics.RollingClock(b.clock))
+	if err != nil {
+		return nil, err
+	}
+	b.waitTime = h
+	return b, nil
+}
+
+func (b *Bulkhead) Wrap(h http.Handler) {
+	b.next = h
+}
+
+func (b *Bulkhead) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if log.GetLevel() >= log.DebugLevel {
+		logEntry := log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/bulkhead: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/bulkhead: competed ServeHttp on request")
+	}
+
+	name, _, err := b.extract.Extract(req)
+	if err != nil {
+		log.Errorf("vulcand/oxy/bulkhead: failed to extract partition of the request: %v", err)
+		b.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	if err := b.acquire(req, name); err != nil {
+		log.Infof("vulcand/oxy/bulkhead: rejecting request of partition %v: %v", name, err)
+		// the breaker wrapping the bulkhead records the rejection itself
+		if b.breaker != nil && !b.breaker.Serves(req) {
+			b.breaker.RecordRejected(http.StatusServiceUnavailable)
+		}
+		b.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	defer b.release(name)
+
+	b.next.ServeHTTP(w, req)
+}
+
+// acquire waits until the request of the partition can go through
+func (b *Bulkhead) acquire(req *http.Request, name string) error {
+	b.mutex.Lock()
+	p, ok := b.partitions[name]
+	if !ok {
+		p = &partition{queue: list.New()}
+		b.partitions[name] = p
+	}
+	if p.active < b.limit(name) {
+		p.active++
+		b.mutex.Unlock()
+		return nil
+	}
+	if p.queue.Len() >= b.maxQueue {
+		b.rejected++
+		b.mutex.Unlock()
+		return &RejectedError{Partition: name, Reason: "queue is full"}
+	}
+	start := b.clock.UtcNow()
+	wt := make(waiter)
+	el := p.queue.PushBack(wt)
+	b.mutex.Unlock()
+
+	var reason string
+	select {
+	case <-wt:
+		b.recordWait(start)
+		return nil
+	case <-b.clock.After(b.queueTimeout):
+		reason = "queue timeout"
+	case <-req.Context().Done():
+		reason = "request canceled"
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	select {
+	case <-wt:
+		// the request has been let through while the timeout expired
+		b.recordWaitLocked(start)
+		return nil
+	default:
+	}
+	p.queue.Remove(el)
+	b.timedOut++
+	b.cleanup(name, p)
+	return &RejectedError{Partition: name, Reason: reason}
+}
+
+// release lets the next queued request of the partition through or frees the slot
+func (b *Bulkhead) release(name string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	p := b.partitions[name]
+	if front := p.queue.Front(); front != nil {
+		// the slot is handed over to the waiting request
+		p.queue.Remove(front)
+		close(front.Value.(waiter))
+		return
+	}
+	p.active--
+	b.cleanup(name, p)
+}
+
+// cleanup deletes the idle partition, otherwise the partitions would grow forever
+func (b *Bulkhead) cleanup(name string, p *partition) {
+	if p.active == 0 && p.queue.Len() == 0 {
+		delete(b.partitions, name)
+	}
+}
+
+func (b *Bulkhead) limit(name string) int {
+	if l, ok := b.limits[name]; ok {
+		return l
+	}
+	return b.maxConcurrent
+}
+
+func (b *Bulkhead) recordWait(start time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.recordWaitLocked(start)
+}
+
+func (b *Bulkhead) recordWaitLocked(start time.Time) {
+	if err := b.waitTime.RecordLatencies(b.clock.UtcNow().Sub(start), 1); err != nil {
+		log.Errorf("vulcand/oxy/bulkhead: failed to record wait time: %v", err)
+	}
+}
+
+// PartitionStats has the numbers of the requests in progress and waiting in the queue of the partition
+type PartitionStats struct {
+	Active int
+	Queued int
+}
+
+// Partitions returns the stats of the partitions with the requests in progress
+func (b *Bulkhead) Partitions() map[string]PartitionStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	out := make(map[string]PartitionStats, len(b.partitions))
+	for name, p := range b.partitions {
+		out[name] = PartitionStats{Active: p.active, Queued: p.queue.Len()}
+	}
+	return out
+}
+
+// QueueDepth returns the number of the requests waiting in the queues of all partitions
+func (b *Bulkhead) QueueDepth() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	depth := 0
+	for _, p := range b.partitions {
+		depth += p.queue.Len()
+	}
+	return depth
+}
+
+// WaitTime returns the histogram of the time the requests have waited in the queue for
+func (b *Bulkhead) WaitTime() (*memmetrics.HDRHistogram, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.waitTime.Merged()
+}
+
+// Rejected returns the numbers of the requests rejected because the queue was full
+// and because they have waited for too long or have been canceled
+func (b *Bulkhead) Rejected() (full int64, timedOut int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.rejected, b.timedOut
+}
+
+// RejectedError is returned for the request that has not been let through
+type RejectedError struct {
+	Partition string
+	Reason    string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("partition %v is over capacity: %v", e.Partition, e.Reason)
+}
+
+type BulkheadErrHandler struct {
+}
+
+func (e *BulkheadErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	if _, ok := err.(*RejectedError); ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	utils.DefaultHandler.ServeHTTP(w, req, err)
+}
+
+type BulkheadOption func(b *Bulkhead) error
+
+// PartitionLimit overrides the max concurrent requests of the partition
+func PartitionLimit(name string, maxConcurrent int) BulkheadOption {
+	return func(b *Bulkhead) error {
+		if maxConcurrent <= 0 {
+			return fmt.Errorf("max concurrent requests of %v should be > 0, got %v", name, maxConcurrent)
+		}
+		b.limits[name] = maxConcurrent
+		return nil
+	}
+}
+
+// Queue sets the max number of the requests waiting in the queue of every partition and the time they wait for,
+// by default up to 100 requests wait for 1 second, the size of 0 rejects the requests over the limit right away
+func Queue(size int, timeout time.Duration) BulkheadOption {
+	return func(b *Bulkhead) error {
+		if size < 0 || timeout <= 0 {
+			return fmt.Errorf("queue size should be >= 0 and timeout should be > 0, got %v and %v", size, timeout)
+		}
+		b.maxQueue = size
+		b.queueTimeout = timeout
+		return nil
+	}
+}
+
+// CircuitBreaker records the rejected requests to the circuit breaker as 503 responses, so the condition
+// like ErrorRatio(500, 600) > 0.5 counts them as failures. The rejections have no latency and do not affect
+// the latency quantiles. The breaker may sit behind the bulkhead or be used on its own with Allow and Record,
+// if it wraps the bulkhead, it records the rejections itself and the bulkhead does not record them again.
+func CircuitBreaker(cb *cbreaker.CircuitBreaker) BulkheadOption {
+	return func(b *Bulkhead) error {
+		b.breaker = cb
+		return nil
+	}
+}
+
+// ErrorHandler sets error handler of the server
+func ErrorHandler(h utils.ErrorHandler) BulkheadOption {
+	return func(b *Bulkhead) error {
+		b.errHandler = h
+		return nil
+	}
+}
+
+// Clock sets the clock the wait time and the queue timeout are measured with
+func Clock(clock timetools.TimeProvider) BulkheadOption {
+	return func(b *Bulkhead) error {
+		b.clock = clock
+		return nil
+	}
+}
+
+var defaultErrHandler = &BulkheadErrHandler{}
+
+const (
+	defaultQueueSize    = 100
+	defaultQueueTimeout = time.Second
+
+	histMin                = 1
+	histMax                = 3600000000       // 1 hour in microseconds
+	histSignificantFigures = 2                // significant figures (1% precision)
+	histBuckets            = 6                // number of sub-histograms in a rolling histogram
+	histPeriod             = 10 * time.Second // roll time
+)
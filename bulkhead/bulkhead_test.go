@@ -0,0 +1,299 @@
+package bulkhead
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/cbreaker"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestBulkhead(t *testing.T) { TestingT(t) }
+
+type BulkheadSuite struct {
+}
+
+var _ = Suite(&BulkheadSuite{})
+
+// blockingHandler blocks the requests with the wait header until the wait channel is closed
+func blockingHandler(proceed chan bool, wait chan bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("wait") != "" {
+			proceed <- true
+			<-wait
+		}
+		w.Write([]byte("hello"))
+	})
+}
+
+// waitQueued waits until the given number of the requests are queued
+func waitQueued(c *C, b *Bulkhead, depth int) {
+	for i := 0; i < 100; i++ {
+		if b.QueueDepth() == depth {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("timeout waiting for %v queued requests, got %v", depth, b.QueueDepth())
+}
+
+// timeoutClock is the real clock with the queue timeouts expiring when the test says so
+type timeoutClock struct {
+	timetools.RealTime
+	timeouts chan time.Time
+}
+
+func (t *timeoutClock) After(d time.Duration) <-chan time.Time {
+	return t.timeouts
+}
+
+// The request over the limit waits in the queue and proceeds once the slot is released
+func (s *BulkheadSuite) TestQueueAndRelease(c *C) {
+	wait := make(chan bool)
+	proceed := make(chan bool)
+
+	b, err := New(blockingHandler(proceed, wait), headerPartition, 1, Queue(1, time.Minute))
+	c.Assert(err, IsNil)
+
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+
+	go testutils.Get(srv.URL, testutils.Header("Partition", "a"), testutils.Header("wait", "yes"))
+	<-proceed
+
+	done := make(chan int)
+	go func() {
+		re, _, err := testutils.Get(srv.URL, testutils.Header("Partition", "a"))
+		c.Assert(err, IsNil)
+		done <- re.StatusCode
+	}()
+	waitQueued(c, b, 1)
+	c.Assert(b.Partitions()["a"], Equals, PartitionStats{Active: 1, Queued: 1})
+
+	// the queue is full
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Partition", "a"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+
+	close(wait)
+	c.Assert(<-done, Equals, http.StatusOK)
+
+	full, timedOut := b.Rejected()
+	c.Assert(full, Equals, int64(1))
+	c.Assert(timedOut, Equals, int64(0))
+
+	h, err := b.WaitTime()
+	c.Assert(err, IsNil)
+	c.Assert(h.LatencyAtQuantile(100) > 0, Equals, true)
+
+	// the idle partitions are deleted
+	for i := 0; i < 100 && len(b.Partitions()) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(len(b.Partitions()), Equals, 0)
+}
+
+// The request is rejected once it has waited in the queue for too long
+func (s *BulkheadSuite) TestQueueTimeout(c *C) {
+	wait := make(chan bool)
+	proceed := make(chan bool)
+
+	clock := &timeoutClock{timeouts: make(chan time.Time)}
+	b, err := New(blockingHandler(proceed, wait), headerPartition, 1, Queue(1, time.Minute), Clock(clock))
+	c.Assert(err, IsNil)
+
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+	defer close(wait)
+
+	go testutils.Get(srv.URL, testutils.Header("Partition", "a"), testutils.Header("wait", "yes"))
+	<-proceed
+
+	type result struct {
+		code int
+		body string
+	}
+	done := make(chan result)
+	go func() {
+		re, body, err := testutils.Get(srv.URL, testutils.Header("Partition", "a"))
+		if err != nil {
+			done <- result{}
+			return
+		}
+		done <- result{code: re.StatusCode, body: string(body)}
+	}()
+	clock.timeouts <- time.Now()
+
+	re := <-done
+	c.Assert(re.code, Equals, http.StatusServiceUnavailable)
+	c.Assert(re.body, Equals, "partition a is over capacity: queue timeout")
+	c.Assert(b.QueueDepth(), Equals, 0)
+
+	_, timedOut := b.Rejected()
+	c.Assert(timedOut, Equals, int64(1))
+}
+
+// The partitions do not affect each other and can have their own limits
+func (s *BulkheadSuite) TestPartitions(c *C) {
+	wait := make(chan bool)
+	proceed := make(chan bool)
+
+	b, err := New(blockingHandler(proceed, wait), headerPartition, 1, PartitionLimit("b", 2), Queue(0, time.Second))
+	c.Assert(err, IsNil)
+
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+	defer close(wait)
+
+	go testutils.Get(srv.URL, testutils.Header("Partition", "a"), testutils.Header("wait", "yes"))
+	<-proceed
+
+	// no queue, so the request is rejected right away
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Partition", "a"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+
+	go testutils.Get(srv.URL, testutils.Header("Partition", "b"), testutils.Header("wait", "yes"))
+	<-proceed
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Partition", "b"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+}
+
+// The rejected requests count as failures of the circuit breaker
+func (s *BulkheadSuite) TestCircuitBreaker(c *C) {
+	wait := make(chan bool)
+	proceed := make(chan bool)
+
+	cb, err := cbreaker.New(nil, "ConsecutiveFailures() >= 1")
+	c.Assert(err, IsNil)
+	b, err := New(blockingHandler(proceed, wait), headerPartition, 1, CircuitBreaker(cb), Queue(0, time.Second))
+	c.Assert(err, IsNil)
+
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+	defer close(wait)
+
+	go testutils.Get(srv.URL, testutils.Header("Partition", "a"), testutils.Header("wait", "yes"))
+	<-proceed
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Partition", "a"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(cb.State(), Equals, cbreaker.StateTripped)
+}
+
+// The rejections do not pull down the latency quantiles of the circuit breaker
+func (s *BulkheadSuite) TestCircuitBreakerLatency(c *C) {
+	wait := make(chan bool)
+	proceed := make(chan bool)
+
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	cb, err := cbreaker.New(nil, "LatencyAtQuantileMS(50.0) < 50", cbreaker.Clock(clock))
+	c.Assert(err, IsNil)
+	b, err := New(blockingHandler(proceed, wait), headerPartition, 1, CircuitBreaker(cb), Queue(0, time.Second))
+	c.Assert(err, IsNil)
+
+	// the upstream responses recorded by the load balancer
+	for i := 0; i < 3; i++ {
+		cb.Record(http.StatusOK, 100*time.Millisecond)
+	}
+
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+	defer close(wait)
+
+	go testutils.Get(srv.URL, testutils.Header("Partition", "a"), testutils.Header("wait", "yes"))
+	<-proceed
+
+	for i := 0; i < 5; i++ {
+		re, _, err := testutils.Get(srv.URL, testutils.Header("Partition", "a"))
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	}
+
+	clock.CurrentTime = clock.CurrentTime.Add(time.Second)
+	cb.Record(http.StatusOK, 100*time.Millisecond)
+	c.Assert(cb.State(), Equals, cbreaker.StateStandby)
+}
+
+// The circuit breaker wrapping the bulkhead records the rejection once
+func (s *BulkheadSuite) TestCircuitBreakerWrapping(c *C) {
+	wait := make(chan bool)
+	proceed := make(chan bool)
+
+	cb, err := cbreaker.New(nil, "ConsecutiveFailures() >= 2", cbreaker.CheckPeriod(time.Nanosecond))
+	c.Assert(err, IsNil)
+	b, err := New(blockingHandler(proceed, wait), headerPartition, 1, CircuitBreaker(cb), Queue(0, time.Second))
+	c.Assert(err, IsNil)
+	cb.Wrap(b)
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+	defer close(wait)
+
+	go testutils.Get(srv.URL, testutils.Header("Partition", "a"), testutils.Header("wait", "yes"))
+	<-proceed
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Partition", "a"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(cb.State(), Equals, cbreaker.StateStandby)
+}
+
+// The requests over the limit wait in the queue by default
+func (s *BulkheadSuite) TestDefaultQueue(c *C) {
+	b, err := New(nil, headerPartition, 1)
+	c.Assert(err, IsNil)
+	c.Assert(b.maxQueue, Equals, defaultQueueSize)
+	c.Assert(b.queueTimeout, Equals, defaultQueueTimeout)
+}
+
+func (s *BulkheadSuite) TestCustomHandlers(c *C) {
+	errHandler := utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(err.Error()))
+	})
+
+	b, err := New(nil, faultyExtract, 1, ErrorHandler(errHandler))
+	c.Assert(err, IsNil)
+
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusTooManyRequests)
+}
+
+func (s *BulkheadSuite) TestBadOptions(c *C) {
+	_, err := New(nil, nil, 1)
+	c.Assert(err, NotNil)
+	_, err = New(nil, headerPartition, 0)
+	c.Assert(err, NotNil)
+	_, err = New(nil, headerPartition, 1, PartitionLimit("a", 0))
+	c.Assert(err, NotNil)
+	_, err = New(nil, headerPartition, 1, Queue(-1, time.Second))
+	c.Assert(err, NotNil)
+	_, err = New(nil, headerPartition, 1, Queue(1, 0))
+	c.Assert(err, NotNil)
+}
+
+func headerPartitioner(req *http.Request) (string, int64, error) {
+	return req.Header.Get("Partition"), 1, nil
+}
+
+func faultyExtractor(req *http.Request) (string, int64, error) {
+	return "", -1, fmt.Errorf("oops")
+}
+
+var headerPartition = utils.ExtractorFunc(headerPartitioner)
+var faultyExtract = utils.ExtractorFunc(faultyExtractor)
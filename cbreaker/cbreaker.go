@@ -18,6 +18,9 @@
 // 1. Condition matches again, this will reset the state to "Tripped" and reset the timer.
 // 2. Condition does not match, circuit breaker enters "Standby" state
 //
+// The Recover option replaces the linear function with the other recovery strategy, e.g. HalfOpen probes,
+// and the FallbackBackoff option makes the "Tripped" state longer after every failed recovery.
+//
 // It is possible to define actions (e.g. webhooks) of transitions between states:
 //
 // * OnTripped action is called on transition (Standby -> Tripped)
@@ -26,9 +29,12 @@
 package cbreaker
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -42,19 +48,47 @@ import (
 type CircuitBreaker struct {
 	m       *sync.RWMutex
 	metrics *memmetrics.RTMetrics
+	// failures is the number of consecutive 5xx responses, updated atomically
+	failures int64
+
+	expression  string
+	condition   hpredicate
+	minRequests int64
 
-	condition hpredicate
+	// rolling windows of the metrics created by New, unless the shared metrics are set
+	counterBuckets    int
+	counterResolution time.Duration
+	histBuckets       int
+	histPeriod        time.Duration
+	windowSet         bool
 
 	fallbackDuration time.Duration
 	recoveryDuration time.Duration
 
+	name      string
 	onTripped SideEffect
 	onStandby SideEffect
+	// sideEffects limits the number of the side effects executed at the same time
+	sideEffects chan struct{}
+
+	// listener is notified about the transitions queued while the lock is held
+	listener    StateListener
+	transitions []Transition
+	forced      bool
 
-	state cbState
+	state State
 	until time.Time
+	// reason tells why the circuit breaker has tripped
+	reason string
 
-	rc *ratioController
+	recovery    Recovery
+	newRecovery RecoveryStrategy
+
+	// trips is the number of trips since the circuit breaker has been in the standby state,
+	// the fallback duration grows with it by the backoff factor up to the max fallback duration
+	trips               int
+	backoffFactor       float64
+	maxFallbackDuration time.Duration
 
 	checkPeriod time.Duration
 	lastCheck   time.Time
@@ -65,7 +99,18 @@ type CircuitBreaker struct {
 	clock timetools.TimeProvider
 }
 
-// New creates a new CircuitBreaker middleware
+// New creates a new CircuitBreaker middleware. The expression is the condition tripping the circuit breaker,
+// it combines the functions below with the comparisons, arithmetic and logical operators,
+// e.g. `RequestCount() > 20 && NetworkErrorRatio() > 0.5`:
+//
+//	LatencyAtQuantileMS(quantile)                 latency at the quantile in milliseconds
+//	LatencyMeanMS()                               mean latency in milliseconds
+//	NetworkErrorRatio()                           ratio of 502 and 504 responses to all responses
+//	ResponseCodeRatio(startA, endA, startB, endB) ratio of codes in [startA, endA) to codes in [startB, endB)
+//	ErrorRatio(start, end)                        ratio of codes in [start, end) to all responses
+//	RequestCount()                                number of requests
+//	RequestRate()                                 requests per second
+//	ConsecutiveFailures()                         number of 5xx responses in a row
 func New(next http.Handler, expression string, options ...CircuitBreakerOption) (*CircuitBreaker, error) {
 	cb := &CircuitBreaker{
 		m:    &sync.RWMutex{},
@@ -76,6 +121,13 @@ func New(next http.Handler, expression string, options ...CircuitBreakerOption)
 		fallbackDuration: defaultFallbackDuration,
 		recoveryDuration: defaultRecoveryDuration,
 		fallback:         defaultFallback,
+		newRecovery:      newRatioRecovery,
+		sideEffects:      make(chan struct{}, maxSideEffects),
+
+		counterBuckets:    defaultCounterBuckets,
+		counterResolution: defaultCounterResolution,
+		histBuckets:       defaultHistBuckets,
+		histPeriod:        defaultHistPeriod,
 	}
 
 	for _, s := range options {
@@ -88,9 +140,20 @@ func New(next http.Handler, expression string, options ...CircuitBreakerOption)
 	if err != nil {
 		return nil, err
 	}
+	cb.expression = expression
 	cb.condition = condition
 
-	mt, err := memmetrics.NewRTMetrics()
+	if cb.metrics != nil {
+		if cb.windowSet {
+			return nil, fmt.Errorf("metrics windows can not be set together with the shared metrics")
+		}
+		return cb, nil
+	}
+
+	mt, err := memmetrics.NewRTMetrics(
+		memmetrics.RTClock(cb.clock),
+		memmetrics.RTCounterWindow(cb.counterBuckets, cb.counterResolution),
+		memmetrics.RTHistogramWindow(cb.histBuckets, cb.histPeriod))
 	if err != nil {
 		return nil, err
 	}
@@ -105,8 +168,8 @@ func (c *CircuitBreaker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		logEntry.Debug("vulcand/oxy/circuitbreaker: begin ServeHttp on request")
 		defer logEntry.Debug("vulcand/oxy/circuitbreaker: competed ServeHttp on request")
 	}
-	if c.activateFallback(w, req) {
-		c.fallback.ServeHTTP(w, req)
+	if !c.Allow() {
+		c.fallback.ServeHTTP(w, c.withReason(req))
 		return
 	}
 	c.serve(w, req)
@@ -116,40 +179,75 @@ func (c *CircuitBreaker) Wrap(next http.Handler) {
 	c.next = next
 }
 
+// Allow tells whether the request can go to the next handler instead of the fallback, in the recovering state
+// it lets through the growing share of requests. Together with Record it lets the load balancers keep
+// a circuit breaker per server without sending the requests through the breaker handler.
+func (c *CircuitBreaker) Allow() bool {
+	return !c.activateFallback()
+}
+
+// Record records the response of the request allowed by Allow and trips the circuit breaker if the condition matches
+func (c *CircuitBreaker) Record(code int, latency time.Duration) {
+	c.metrics.Record(code, latency)
+	c.record(code)
+}
+
+// RecordRejected records the request rejected before it has reached the upstream, e.g. by the concurrency limiter,
+// it counts in the status codes and the consecutive failures, but not in the latency quantiles
+func (c *CircuitBreaker) RecordRejected(code int) {
+	c.metrics.RecordCode(code)
+	c.record(code)
+}
+
+// Serves tells whether the request is served through the handler of the circuit breaker,
+// that records the response itself
+func (c *CircuitBreaker) Serves(req *http.Request) bool {
+	cb, _ := req.Context().Value(servingKey{}).(*CircuitBreaker)
+	return cb == c
+}
+
+func (c *CircuitBreaker) record(code int) {
+	if code >= http.StatusInternalServerError {
+		atomic.AddInt64(&c.failures, 1)
+	} else {
+		atomic.StoreInt64(&c.failures, 0)
+	}
+	c.recordRecovery(code)
+
+	// Note that this call is less expensive than it looks -- checkCondition only performs the real check
+	// periodically. Because of that we can afford to call it here on every single response.
+	c.checkAndSet()
+}
+
 // updateState updates internal state and returns true if fallback should be used and false otherwise
-func (c *CircuitBreaker) activateFallback(w http.ResponseWriter, req *http.Request) bool {
+func (c *CircuitBreaker) activateFallback() bool {
 	// Quick check with read locks optimized for normal operation use-case
-	if c.isStandby() {
+	if c.isPassing() {
 		return false
 	}
 	// Circuit breaker is in tripped or recovering state
 	c.m.Lock()
-	defer c.m.Unlock()
+	defer c.unlock()
 
 	log.Infof("%v is in error state", c)
 
 	switch c.state {
-	case stateStandby:
+	case StateStandby, StateDisabled:
 		// someone else has set it to standby just now
 		return false
-	case stateTripped:
+	case StateTripped:
 		if c.clock.UtcNow().Before(c.until) {
 			return true
 		}
 		// We have been in active state enough, enter recovering state
 		c.setRecovering()
 		fallthrough
-	case stateRecovering:
-		// We have been in recovering state enough, enter standby and allow request
-		if c.clock.UtcNow().After(c.until) {
-			c.setState(stateStandby, c.clock.UtcNow())
-			return false
+	case StateRecovering:
+		// The recovery may have ended, enter standby or trip again
+		if !c.checkRecovery() {
+			return c.state == StateTripped
 		}
-		// ratio controller allows this request
-		if c.rc.allowRequest() {
-			return false
-		}
-		return true
+		return !c.recovery.Allow()
 	}
 	return false
 }
@@ -158,54 +256,180 @@ func (c *CircuitBreaker) serve(w http.ResponseWriter, req *http.Request) {
 	start := c.clock.UtcNow()
 	p := &utils.ProxyWriter{W: w}
 
-	c.next.ServeHTTP(p, req)
+	// let the fallback watch the responses served in the standby state, e.g. to cache them
+	var out http.ResponseWriter = p
+	var done func()
+	if o, ok := c.fallback.(observer); ok && c.State() == StateStandby {
+		out, done = o.observe(p, req)
+	}
 
-	latency := c.clock.UtcNow().Sub(start)
-	c.metrics.Record(p.Code, latency)
+	c.next.ServeHTTP(out, req.WithContext(context.WithValue(req.Context(), servingKey{}, c)))
 
-	// Note that this call is less expensive than it looks -- checkCondition only performs the real check
-	// periodically. Because of that we can afford to call it here on every single response.
-	c.checkAndSet()
+	if done != nil {
+		done()
+	}
+	c.Record(p.Code, c.clock.UtcNow().Sub(start))
 }
 
-func (c *CircuitBreaker) isStandby() bool {
+// observer is implemented by the fallbacks watching the responses served in the standby state
+type observer interface {
+	// observe returns the writer the response is written to and the function called after the response is written
+	observe(p *utils.ProxyWriter, req *http.Request) (http.ResponseWriter, func())
+}
+
+type reasonKey struct{}
+
+type servingKey struct{}
+
+// withReason returns the request carrying the reason the circuit breaker has tripped for, see TrippedReason
+func (c *CircuitBreaker) withReason(req *http.Request) *http.Request {
+	c.m.RLock()
+	reason := c.reason
+	c.m.RUnlock()
+	return req.WithContext(context.WithValue(req.Context(), reasonKey{}, reason))
+}
+
+// TrippedReason returns the reason the circuit breaker has tripped for, for the requests passed to the fallback
+func TrippedReason(req *http.Request) string {
+	reason, _ := req.Context().Value(reasonKey{}).(string)
+	return reason
+}
+
+// isPassing returns true if the circuit breaker passes all requests
+func (c *CircuitBreaker) isPassing() bool {
 	c.m.RLock()
 	defer c.m.RUnlock()
-	return c.state == stateStandby
+	return c.state == StateStandby || c.state == StateDisabled
+}
+
+// State returns the current state of the circuit breaker. The tripped circuit breaker
+// enters the recovering state on the first request after the fallback duration.
+func (c *CircuitBreaker) State() State {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.state
+}
+
+// ForceTrip trips the circuit breaker for the fallback duration regardless of the condition,
+// after that the circuit breaker recovers as usual and the failed recovery is followed by the backoff
+func (c *CircuitBreaker) ForceTrip() {
+	c.m.Lock()
+	defer c.unlock()
+	c.reason = "forced"
+	c.forceState(StateTripped, c.clock.UtcNow().Add(c.fallbackDuration))
+	c.trips++
+	c.resetMetrics()
+}
+
+// ForceReset puts the circuit breaker to the standby state and resets its metrics, it enables the disabled circuit breaker
+func (c *CircuitBreaker) ForceReset() {
+	c.m.Lock()
+	defer c.unlock()
+	c.forceState(StateStandby, c.clock.UtcNow())
+	c.resetMetrics()
+}
+
+// Disable makes the circuit breaker pass all requests and never trip until ForceReset is called
+func (c *CircuitBreaker) Disable() {
+	c.m.Lock()
+	defer c.unlock()
+	c.forceState(StateDisabled, time.Time{})
 }
 
 // String returns log-friendly representation of the circuit breaker state
 func (c *CircuitBreaker) String() string {
 	switch c.state {
-	case stateTripped, stateRecovering:
+	case StateTripped, StateRecovering:
 		return fmt.Sprintf("CircuitBreaker(state=%v, until=%v)", c.state, c.until)
 	default:
 		return fmt.Sprintf("CircuitBreaker(state=%v)", c.state)
 	}
 }
 
-// exec executes side effect
+// exec executes side effect for the current state, the side effects over the limit are dropped,
+// should be called with the lock held
 func (c *CircuitBreaker) exec(s SideEffect) {
 	if s == nil {
 		return
 	}
+	select {
+	case c.sideEffects <- struct{}{}:
+	default:
+		log.Errorf("%v too many side effects in progress, dropping %v", c, s)
+		return
+	}
+
+	e := Event{Name: c.name, State: c.state, Reason: c.reason, Time: c.clock.UtcNow()}
+	if _, ok := s.(EventSideEffect); ok {
+		e.Metrics = c.copyMetrics()
+	}
+	e.idle = func(wait func()) {
+		// the side effect waiting to retry does not hold the slot of the others
+		<-c.sideEffects
+		defer func() { c.sideEffects <- struct{}{} }()
+		wait()
+	}
 	go func() {
-		if err := s.Exec(); err != nil {
+		defer func() { <-c.sideEffects }()
+		var err error
+		if es, ok := s.(EventSideEffect); ok {
+			err = es.ExecEvent(e)
+		} else {
+			err = s.Exec()
+		}
+		if err != nil {
 			log.Errorf("%v side effect failure: %v", c, err)
 		}
 	}()
 }
 
-func (c *CircuitBreaker) setState(new cbState, until time.Time) {
+func (c *CircuitBreaker) setState(new State, until time.Time) {
 	log.Infof("%v setting state to %v, until %v", c, new, until)
+	old := c.state
 	c.state = new
 	c.until = until
+	if new == StateStandby {
+		c.trips = 0
+	}
+	// the side effects and the listener are notified about the changes only, e.g. not when ForceReset is called in standby
+	if old == new {
+		return
+	}
 	switch new {
-	case stateTripped:
+	case StateTripped:
 		c.exec(c.onTripped)
-	case stateStandby:
+	case StateStandby:
 		c.exec(c.onStandby)
 	}
+	if c.listener != nil {
+		c.transitions = append(c.transitions, Transition{From: old, To: new, Until: until, Metrics: c.copyMetrics(), Forced: c.forced})
+	}
+}
+
+// forceState sets the state on behalf of the operator, should be called with the lock held
+func (c *CircuitBreaker) forceState(new State, until time.Time) {
+	c.forced = true
+	c.setState(new, until)
+	c.forced = false
+}
+
+func (c *CircuitBreaker) copyMetrics() *memmetrics.RTMetrics {
+	m, err := c.metrics.Clone()
+	if err != nil {
+		log.Errorf("%v failed to copy metrics: %v", c, err)
+		return nil
+	}
+	return m
+}
+
+// unlock releases the lock and notifies the listener about the transitions made while the lock was held
+func (c *CircuitBreaker) unlock() {
+	transitions := c.transitions
+	c.transitions = nil
+	c.m.Unlock()
+	for _, t := range transitions {
+		c.listener(t)
+	}
 }
 
 func (c *CircuitBreaker) timeToCheck() bool {
@@ -221,7 +445,7 @@ func (c *CircuitBreaker) checkAndSet() {
 	}
 
 	c.m.Lock()
-	defer c.m.Unlock()
+	defer c.unlock()
 
 	// Other goroutine could have updated the lastCheck variable before we grabbed mutex
 	if !c.clock.UtcNow().After(c.lastCheck) {
@@ -229,22 +453,81 @@ func (c *CircuitBreaker) checkAndSet() {
 	}
 	c.lastCheck = c.clock.UtcNow().Add(c.checkPeriod)
 
-	if c.state == stateTripped {
+	if c.state == StateTripped || c.state == StateDisabled {
 		log.Infof("%v skip set tripped", c)
 		return
 	}
 
-	if !c.condition(c) {
+	if !c.conditionMatches() {
 		return
 	}
+	c.trip(c.conditionReason())
+}
+
+// conditionMatches tells whether the condition matches with enough requests in the metrics
+func (c *CircuitBreaker) conditionMatches() bool {
+	return c.metrics.TotalCount() >= c.minRequests && c.condition(c)
+}
+
+func (c *CircuitBreaker) conditionReason() string {
+	return fmt.Sprintf("condition %v matched", c.expression)
+}
+
+// trip sets the tripped state for the fallback duration grown by the backoff, should be called with the lock held
+func (c *CircuitBreaker) trip(reason string) {
+	c.reason = reason
+	d := c.fallbackDuration
+	if c.backoffFactor > 1 {
+		d = time.Duration(float64(d) * math.Pow(c.backoffFactor, float64(c.trips)))
+		if c.maxFallbackDuration > 0 && d > c.maxFallbackDuration {
+			d = c.maxFallbackDuration
+		}
+	}
+	c.trips++
+	c.setState(StateTripped, c.clock.UtcNow().Add(d))
+	c.resetMetrics()
+}
+
+// recordRecovery records the response of the request that went through in the recovering state
+func (c *CircuitBreaker) recordRecovery(code int) {
+	if c.isPassing() {
+		return
+	}
+	c.m.Lock()
+	defer c.unlock()
+	if c.state != StateRecovering {
+		return
+	}
+	c.recovery.Record(code)
+	c.checkRecovery()
+}
+
+// checkRecovery ends the recovery that has succeeded or failed, it returns true if the circuit breaker
+// is still recovering, should be called with the lock held
+func (c *CircuitBreaker) checkRecovery() bool {
+	switch c.recovery.Result() {
+	case StateTripped:
+		c.trip("recovery failed")
+		return false
+	case StateStandby:
+		if c.conditionMatches() {
+			c.trip(c.conditionReason())
+		} else {
+			c.setState(StateStandby, c.clock.UtcNow())
+		}
+		return false
+	}
+	return true
+}
 
-	c.setState(stateTripped, c.clock.UtcNow().Add(c.fallbackDuration))
+func (c *CircuitBreaker) resetMetrics() {
 	c.metrics.Reset()
+	atomic.StoreInt64(&c.failures, 0)
 }
 
 func (c *CircuitBreaker) setRecovering() {
-	c.setState(stateRecovering, c.clock.UtcNow().Add(c.recoveryDuration))
-	c.rc = newRatioController(c.clock, c.recoveryDuration)
+	c.setState(StateRecovering, c.clock.UtcNow().Add(c.recoveryDuration))
+	c.recovery = c.newRecovery(c.clock, c.recoveryDuration)
 }
 
 // CircuitBreakerOption represents an option you can pass to New.
@@ -260,6 +543,68 @@ func Clock(clock timetools.TimeProvider) CircuitBreakerOption {
 	}
 }
 
+// Recover sets the strategy letting the traffic back in the recovering state, by default the circuit breaker
+// lets through the share of requests growing linearly up to a half and enters the standby state after the recovery duration
+func Recover(s RecoveryStrategy) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		if s == nil {
+			return fmt.Errorf("recovery strategy can not be nil")
+		}
+		c.newRecovery = s
+		return nil
+	}
+}
+
+// FallbackBackoff multiplies the fallback duration by the factor on every trip that follows the failed recovery,
+// up to the max duration, the fallback duration is back to normal once the circuit breaker enters the standby state
+func FallbackBackoff(factor float64, max time.Duration) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		if factor < 1 {
+			return fmt.Errorf("backoff factor should be >= 1, got %v", factor)
+		}
+		if max < 0 {
+			return fmt.Errorf("max fallback duration should be >= 0, got %v", max)
+		}
+		c.backoffFactor = factor
+		c.maxFallbackDuration = max
+		return nil
+	}
+}
+
+// CounterWindow sets the rolling window of the counters used by the ratio and count functions,
+// the window has the buckets rotated every resolution period, by default it is 10 buckets of 1 second
+func CounterWindow(buckets int, resolution time.Duration) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		c.counterBuckets = buckets
+		c.counterResolution = resolution
+		c.windowSet = true
+		return nil
+	}
+}
+
+// LatencyWindow sets the rolling window of the latency histogram used by the latency functions,
+// the window has the buckets rotated every period, by default it is 6 buckets of 10 seconds
+func LatencyWindow(buckets int, period time.Duration) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		c.histBuckets = buckets
+		c.histPeriod = period
+		c.windowSet = true
+		return nil
+	}
+}
+
+// Metrics sets the metrics the CircuitBreaker records the responses to and checks the condition with,
+// e.g. to share them between the circuit breakers. Note that the metrics are reset when the circuit breaker trips.
+func Metrics(m *memmetrics.RTMetrics) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		if m == nil {
+			return fmt.Errorf("metrics can not be nil")
+		}
+		c.metrics = m
+		return nil
+	}
+}
+
 // FallbackDuration is how long the CircuitBreaker will remain in the Tripped
 // state before trying to recover.
 func FallbackDuration(d time.Duration) CircuitBreakerOption {
@@ -287,6 +632,14 @@ func CheckPeriod(d time.Duration) CircuitBreakerOption {
 	}
 }
 
+// Name sets the name of the circuit breaker passed to the side effects in the Event
+func Name(name string) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		c.name = name
+		return nil
+	}
+}
+
 // OnTripped sets a SideEffect to run when entering the Tripped state.
 // Only one SideEffect can be set for this hook.
 func OnTripped(s SideEffect) CircuitBreakerOption {
@@ -305,6 +658,27 @@ func OnStandby(s SideEffect) CircuitBreakerOption {
 	}
 }
 
+// OnStateChange sets the listener notified about every transition of the circuit breaker state.
+// The listener is called synchronously by the goroutine that has made the transition, after the lock is released.
+func OnStateChange(l StateListener) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		c.listener = l
+		return nil
+	}
+}
+
+// MinRequests sets the number of requests in the metrics window below which the condition is not checked,
+// so the few failed requests at the quiet time do not trip the circuit breaker
+func MinRequests(n int) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		if n < 0 {
+			return fmt.Errorf("min requests should be >= 0, got %v", n)
+		}
+		c.minRequests = int64(n)
+		return nil
+	}
+}
+
 // Fallback defines the http.Handler that the CircuitBreaker should route
 // requests to when it prevents a request from taking its normal path.
 func Fallback(h http.Handler) CircuitBreakerOption {
@@ -314,34 +688,62 @@ func Fallback(h http.Handler) CircuitBreakerOption {
 	}
 }
 
-// cbState is the state of the circuit breaker
-type cbState int
+// State is the state of the circuit breaker
+type State int
 
-func (s cbState) String() string {
+func (s State) String() string {
 	switch s {
-	case stateStandby:
+	case StateStandby:
 		return "standby"
-	case stateTripped:
+	case StateTripped:
 		return "tripped"
-	case stateRecovering:
+	case StateRecovering:
 		return "recovering"
+	case StateDisabled:
+		return "disabled"
 	}
 	return "undefined"
 }
 
 const (
-	// CircuitBreaker is passing all requests and watching stats
-	stateStandby = iota
-	// CircuitBreaker activates fallback scenario for all requests
-	stateTripped
-	// CircuitBreaker passes some requests to go through, rejecting others
-	stateRecovering
+	// StateStandby is the state of the CircuitBreaker passing all requests and watching stats
+	StateStandby State = iota
+	// StateTripped is the state of the CircuitBreaker activating fallback scenario for all requests
+	StateTripped
+	// StateRecovering is the state of the CircuitBreaker passing some requests to go through, rejecting others
+	StateRecovering
+	// StateDisabled is the state of the CircuitBreaker passing all requests and never tripping, set by Disable
+	StateDisabled
 )
 
+// Transition is the change of the circuit breaker state
+type Transition struct {
+	From State
+	To   State
+	// Until is the time the tripped and recovering states last until
+	Until time.Time
+	// Metrics is the copy of the metrics at the time of the transition, for the trip it has the metrics
+	// that matched the condition
+	Metrics *memmetrics.RTMetrics
+	// Forced is set for the transitions made by ForceTrip, ForceReset and Disable
+	Forced bool
+}
+
+// StateListener is notified about the transitions of the circuit breaker state
+type StateListener func(t Transition)
+
 const (
 	defaultFallbackDuration = 10 * time.Second
 	defaultRecoveryDuration = 10 * time.Second
 	defaultCheckPeriod      = 100 * time.Millisecond
+
+	// maxSideEffects is the max number of the side effects executed at the same time
+	maxSideEffects = 16
+
+	defaultCounterBuckets    = 10
+	defaultCounterResolution = time.Second
+	defaultHistBuckets       = 6
+	defaultHistPeriod        = 10 * time.Second
 )
 
 var defaultFallback = &fallback{}
@@ -92,21 +92,21 @@ func (s *CBSuite) TestFullCycle(c *C) {
 	s.advanceTime(defaultCheckPeriod + time.Millisecond)
 	re, _, err = testutils.Get(srv.URL)
 	c.Assert(err, IsNil)
-	c.Assert(cb.state, Equals, cbState(stateTripped))
+	c.Assert(cb.state, Equals, StateTripped)
 
 	// Some time has passed, but we are still in trpped state.
 	s.advanceTime(9 * time.Second)
 	re, _, err = testutils.Get(srv.URL)
 	c.Assert(err, IsNil)
 	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
-	c.Assert(cb.state, Equals, cbState(stateTripped))
+	c.Assert(cb.state, Equals, StateTripped)
 
 	// We should be in recovering state by now
 	s.advanceTime(time.Second*1 + time.Millisecond)
 	re, _, err = testutils.Get(srv.URL)
 	c.Assert(err, IsNil)
 	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
-	c.Assert(cb.state, Equals, cbState(stateRecovering))
+	c.Assert(cb.state, Equals, StateRecovering)
 
 	// 5 seconds after we should be allowing some requests to pass
 	s.advanceTime(5 * time.Second)
@@ -122,11 +122,298 @@ func (s *CBSuite) TestFullCycle(c *C) {
 	// After some time, all is good and we should be in stand by mode again
 	s.advanceTime(5*time.Second + time.Millisecond)
 	re, _, err = testutils.Get(srv.URL)
-	c.Assert(cb.state, Equals, cbState(stateStandby))
+	c.Assert(cb.state, Equals, StateStandby)
 	c.Assert(err, IsNil)
 	c.Assert(re.StatusCode, Equals, http.StatusOK)
 }
 
+func (s *CBSuite) TestStateListener(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	var transitions []Transition
+	cb, err := New(handler, triggerNetRatio, Clock(s.clock), OnStateChange(func(t Transition) {
+		transitions = append(transitions, t)
+	}))
+	c.Assert(err, IsNil)
+
+	serve := func() int {
+		w := httptest.NewRecorder()
+		cb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Code
+	}
+
+	cb.metrics = statsNetErrors(0.6)
+	s.advanceTime(defaultCheckPeriod + time.Millisecond)
+	serve()
+	c.Assert(cb.State(), Equals, StateTripped)
+	c.Assert(len(transitions), Equals, 1)
+	c.Assert(transitions[0].From, Equals, StateStandby)
+	c.Assert(transitions[0].To, Equals, StateTripped)
+	c.Assert(transitions[0].Forced, Equals, false)
+	c.Assert(transitions[0].Until, Equals, s.clock.UtcNow().Add(defaultFallbackDuration))
+	// the metrics that tripped the breaker are kept after the breaker resets them
+	c.Assert(transitions[0].Metrics.NetworkErrorRatio() > 0.5, Equals, true)
+	c.Assert(cb.metrics.TotalCount(), Equals, int64(0))
+
+	s.advanceTime(defaultFallbackDuration + time.Millisecond)
+	serve()
+	c.Assert(cb.State(), Equals, StateRecovering)
+
+	s.advanceTime(defaultRecoveryDuration + time.Millisecond)
+	serve()
+	c.Assert(cb.State(), Equals, StateStandby)
+
+	var states []State
+	for _, t := range transitions {
+		states = append(states, t.To)
+	}
+	c.Assert(states, DeepEquals, []State{StateTripped, StateRecovering, StateStandby})
+}
+
+// The side effects are not executed when the forced state is the current one
+func (s *CBSuite) TestForceSameState(c *C) {
+	events := make(ChanSideEffect, 10)
+	cb, err := New(nil, triggerNetRatio, Clock(s.clock), OnTripped(events), OnStandby(events))
+	c.Assert(err, IsNil)
+
+	cb.ForceReset()
+	cb.ForceTrip()
+	cb.ForceTrip()
+	cb.ForceReset()
+	cb.ForceReset()
+
+	// the side effects run concurrently, so their order is not defined
+	states := map[State]int{}
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-events:
+			states[e.State]++
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timeout waiting for the side effects")
+		}
+	}
+	c.Assert(states, DeepEquals, map[State]int{StateTripped: 1, StateStandby: 1})
+	select {
+	case e := <-events:
+		c.Fatalf("unexpected side effect for %v", e.State)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (s *CBSuite) TestManualControl(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	var transitions []Transition
+	var cb *CircuitBreaker
+	cb, err := New(handler, triggerNetRatio, Clock(s.clock), OnStateChange(func(t Transition) {
+		// the listener is called without the lock held
+		c.Assert(cb.State(), Equals, t.To)
+		transitions = append(transitions, t)
+	}))
+	c.Assert(err, IsNil)
+
+	serve := func() int {
+		w := httptest.NewRecorder()
+		cb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Code
+	}
+
+	cb.ForceTrip()
+	c.Assert(cb.State(), Equals, StateTripped)
+	c.Assert(serve(), Equals, http.StatusServiceUnavailable)
+
+	cb.ForceReset()
+	c.Assert(cb.State(), Equals, StateStandby)
+	c.Assert(serve(), Equals, http.StatusOK)
+
+	// the disabled breaker never trips
+	cb.Disable()
+	cb.metrics = statsNetErrors(0.6)
+	s.advanceTime(defaultCheckPeriod + time.Millisecond)
+	c.Assert(serve(), Equals, http.StatusOK)
+	c.Assert(cb.State(), Equals, StateDisabled)
+
+	cb.ForceReset()
+	c.Assert(cb.State(), Equals, StateStandby)
+
+	c.Assert(len(transitions), Equals, 4)
+	for _, t := range transitions {
+		c.Assert(t.Forced, Equals, true)
+	}
+	c.Assert(transitions[2].From, Equals, StateStandby)
+	c.Assert(transitions[2].To, Equals, StateDisabled)
+}
+
+func (s *CBSuite) TestMinRequests(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	cb, err := New(handler, triggerNetRatio, Clock(s.clock), MinRequests(200))
+	c.Assert(err, IsNil)
+
+	serve := func() {
+		cb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	// 100 requests are not enough to check the condition
+	cb.metrics = statsNetErrors(0.6)
+	s.advanceTime(defaultCheckPeriod + time.Millisecond)
+	serve()
+	c.Assert(cb.State(), Equals, StateStandby)
+
+	cb.metrics.Append(statsNetErrors(0.6))
+	s.advanceTime(defaultCheckPeriod + time.Millisecond)
+	serve()
+	c.Assert(cb.State(), Equals, StateTripped)
+
+	_, err = New(handler, triggerNetRatio, MinRequests(-1))
+	c.Assert(err, NotNil)
+}
+
+func (s *CBSuite) TestMetricsWindow(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	clock := &timetools.FreezedTime{CurrentTime: s.clock.CurrentTime}
+	cb, err := New(handler, `RequestCount() > 2 && NetworkErrorRatio() > 0.5`,
+		Clock(clock), CounterWindow(10, 100*time.Millisecond), LatencyWindow(2, time.Second))
+	c.Assert(err, IsNil)
+	c.Assert(cb.metrics.CounterWindowSize(), Equals, time.Second)
+
+	serve := func() {
+		cb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	// the errors spread over more than a second do not trip the circuit breaker
+	for i := 0; i < 3; i++ {
+		serve()
+		clock.Sleep(600 * time.Millisecond)
+	}
+	c.Assert(cb.State(), Equals, StateStandby)
+
+	for i := 0; i < 3; i++ {
+		serve()
+		clock.Sleep(defaultCheckPeriod + time.Millisecond)
+	}
+	c.Assert(cb.State(), Equals, StateTripped)
+
+	_, err = New(handler, triggerNetRatio, CounterWindow(0, time.Second))
+	c.Assert(err, NotNil)
+	_, err = New(handler, triggerNetRatio, LatencyWindow(1, 0))
+	c.Assert(err, NotNil)
+}
+
+func (s *CBSuite) TestSharedMetrics(c *C) {
+	m := statsNetErrors(0.6)
+	a, err := New(nil, `RequestCount() > 1000`, Metrics(m))
+	c.Assert(err, IsNil)
+	b, err := New(nil, triggerNetRatio, Metrics(m))
+	c.Assert(err, IsNil)
+
+	a.Record(http.StatusOK, 0)
+	c.Assert(a.State(), Equals, StateStandby)
+	c.Assert(b.metrics.TotalCount(), Equals, int64(101))
+	c.Assert(b.condition(b), Equals, true)
+
+	// the metrics are reset when either circuit breaker trips
+	b.Record(http.StatusOK, 0)
+	c.Assert(b.State(), Equals, StateTripped)
+	c.Assert(a.metrics.TotalCount(), Equals, int64(0))
+
+	_, err = New(nil, triggerNetRatio, Metrics(m), CounterWindow(1, time.Second))
+	c.Assert(err, NotNil)
+	_, err = New(nil, triggerNetRatio, Metrics(nil))
+	c.Assert(err, NotNil)
+}
+
+func (s *CBSuite) TestHalfOpenRecovery(c *C) {
+	code := http.StatusOK
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(code)
+	})
+
+	halfOpen, err := HalfOpen(2)
+	c.Assert(err, IsNil)
+	clock := &timetools.FreezedTime{CurrentTime: s.clock.CurrentTime}
+	cb, err := New(handler, triggerNetRatio, Clock(clock), Recover(halfOpen), FallbackBackoff(2, 25*time.Second))
+	c.Assert(err, IsNil)
+
+	serve := func(n int) []int {
+		var codes []int
+		for i := 0; i < n; i++ {
+			w := httptest.NewRecorder()
+			cb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			codes = append(codes, w.Code)
+		}
+		return codes
+	}
+
+	cb.ForceTrip()
+	clock.Sleep(defaultFallbackDuration + time.Millisecond)
+
+	// the failed probe trips the circuit breaker for the twice longer time
+	code = http.StatusInternalServerError
+	c.Assert(serve(2), DeepEquals, []int{http.StatusInternalServerError, http.StatusServiceUnavailable})
+	c.Assert(cb.State(), Equals, StateTripped)
+	c.Assert(cb.until, Equals, clock.UtcNow().Add(2*defaultFallbackDuration))
+
+	// the backoff is capped by the max fallback duration
+	clock.Sleep(2*defaultFallbackDuration + time.Millisecond)
+	serve(1)
+	c.Assert(cb.until, Equals, clock.UtcNow().Add(25*time.Second))
+
+	// the probes succeed
+	code = http.StatusOK
+	clock.Sleep(25*time.Second + time.Millisecond)
+	c.Assert(serve(3), DeepEquals, []int{http.StatusOK, http.StatusOK, http.StatusOK})
+	c.Assert(cb.State(), Equals, StateStandby)
+
+	// the backoff is reset in the standby state
+	cb.metrics = statsNetErrors(0.6)
+	clock.Sleep(defaultCheckPeriod + time.Millisecond)
+	serve(1)
+	c.Assert(cb.until, Equals, clock.UtcNow().Add(defaultFallbackDuration))
+
+	_, err = New(handler, triggerNetRatio, FallbackBackoff(0.5, time.Second))
+	c.Assert(err, NotNil)
+	_, err = New(handler, triggerNetRatio, Recover(nil))
+	c.Assert(err, NotNil)
+}
+
+func (s *CBSuite) TestRecoveryEndsWithFailures(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	clock := &timetools.FreezedTime{CurrentTime: s.clock.CurrentTime}
+	cb, err := New(handler, triggerNetRatio, Clock(clock), Recover(LinearRamp), CheckPeriod(time.Hour))
+	c.Assert(err, IsNil)
+
+	cb.ForceTrip()
+	cb.lastCheck = clock.UtcNow().Add(time.Hour)
+	clock.Sleep(defaultFallbackDuration + time.Millisecond)
+	cb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Assert(cb.State(), Equals, StateRecovering)
+
+	// the check period is too long to trip the circuit breaker, but the failing traffic
+	// keeps it from entering the standby state at the end of the recovery
+	clock.Sleep(defaultRecoveryDuration / 2)
+	for i := 0; i < 10; i++ {
+		cb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	c.Assert(cb.State(), Equals, StateRecovering)
+
+	clock.Sleep(defaultRecoveryDuration / 2)
+	cb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Assert(cb.State(), Equals, StateTripped)
+}
+
 func (s *CBSuite) TestRedirectWithPath(c *C) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte("hello"))
@@ -195,14 +482,14 @@ func (s *CBSuite) TestTriggerDuringRecovery(c *C) {
 	cb.metrics = statsNetErrors(0.6)
 	re, _, err := testutils.Get(srv.URL)
 	c.Assert(err, IsNil)
-	c.Assert(cb.state, Equals, cbState(stateTripped))
+	c.Assert(cb.state, Equals, StateTripped)
 
 	// We should be in recovering state by now
 	s.advanceTime(10*time.Second + time.Millisecond)
 	re, _, err = testutils.Get(srv.URL)
 	c.Assert(err, IsNil)
 	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
-	c.Assert(cb.state, Equals, cbState(stateRecovering))
+	c.Assert(cb.state, Equals, StateRecovering)
 
 	// We have matched error condition during recovery state and are going back to tripped state
 	s.advanceTime(5 * time.Second)
@@ -215,7 +502,7 @@ func (s *CBSuite) TestTriggerDuringRecovery(c *C) {
 		}
 	}
 	c.Assert(allowed, Not(Equals), 0)
-	c.Assert(cb.state, Equals, cbState(stateTripped))
+	c.Assert(cb.state, Equals, StateTripped)
 }
 
 func (s *CBSuite) TestSideEffects(c *C) {
@@ -269,7 +556,7 @@ func (s *CBSuite) TestSideEffects(c *C) {
 
 	_, _, err = testutils.Get(srv.URL)
 	c.Assert(err, IsNil)
-	c.Assert(cb.state, Equals, cbState(stateTripped))
+	c.Assert(cb.state, Equals, StateTripped)
 
 	select {
 	case req := <-srv1Chan:
@@ -285,12 +572,12 @@ func (s *CBSuite) TestSideEffects(c *C) {
 	s.advanceTime(10*time.Second + time.Millisecond)
 	cb.metrics = statsOK()
 	testutils.Get(srv.URL)
-	c.Assert(cb.state, Equals, cbState(stateRecovering))
+	c.Assert(cb.state, Equals, StateRecovering)
 
 	// Going back to standby
 	s.advanceTime(10*time.Second + time.Millisecond)
 	testutils.Get(srv.URL)
-	c.Assert(cb.state, Equals, cbState(stateStandby))
+	c.Assert(cb.state, Equals, StateStandby)
 
 	select {
 	case req := <-srv2Chan:
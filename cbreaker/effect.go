@@ -2,14 +2,22 @@ package cbreaker
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
+	"github.com/mailgun/timetools"
 	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/memmetrics"
 	"github.com/vulcand/oxy/utils"
 )
 
@@ -17,16 +25,59 @@ type SideEffect interface {
 	Exec() error
 }
 
+// Event describes the transition of the circuit breaker the side effect is executed for
+type Event struct {
+	// Name is the name of the circuit breaker, see the Name option
+	Name  string
+	State State
+	// Reason tells why the circuit breaker has tripped
+	Reason string
+	// Metrics is the copy of the metrics at the time of the transition
+	Metrics *memmetrics.RTMetrics
+	Time    time.Time
+
+	// idle runs wait, e.g. the retry backoff, without taking the slot of the side effects of the circuit breaker
+	idle func(wait func())
+}
+
+// EventSideEffect is the side effect that gets the event it is executed for,
+// the circuit breaker calls ExecEvent instead of Exec for it
+type EventSideEffect interface {
+	SideEffect
+	ExecEvent(e Event) error
+}
+
 type Webhook struct {
 	URL     string
 	Method  string
 	Headers http.Header
 	Form    url.Values
 	Body    []byte
+	// BodyTemplate is the text/template of the body executed with the Event, it is used instead of the Body
+	BodyTemplate string
+
+	// Client sends the webhook, http.DefaultClient by default
+	Client *http.Client
+	// Timeout limits every attempt to send the webhook, 10 seconds by default
+	Timeout time.Duration
+	// Retries is the number of the retries of the webhook failed with the network error or 5xx,
+	// the retries are delayed by the exponential backoff starting at RetryBackoff, 1 second by default
+	Retries      int
+	RetryBackoff time.Duration
+	// DedupWindow is the time the webhook is not sent again for the same state in,
+	// so the flapping circuit breaker does not send the same webhook over and over
+	DedupWindow time.Duration
+	// Clock measures the dedup window and the retry backoff, the real time by default
+	Clock timetools.TimeProvider
 }
 
 type WebhookSideEffect struct {
-	w Webhook
+	w     Webhook
+	t     *template.Template
+	clock timetools.TimeProvider
+
+	mtx      *sync.Mutex
+	lastSent map[State]time.Time
 }
 
 func NewWebhookSideEffect(w Webhook) (*WebhookSideEffect, error) {
@@ -37,42 +88,220 @@ func NewWebhookSideEffect(w Webhook) (*WebhookSideEffect, error) {
 	if err != nil {
 		return nil, err
 	}
+	if w.Retries < 0 || w.Timeout < 0 || w.RetryBackoff < 0 || w.DedupWindow < 0 {
+		return nil, fmt.Errorf("retries, timeout, retry backoff and dedup window should be >= 0")
+	}
+	if w.Client == nil {
+		w.Client = http.DefaultClient
+	}
+	if w.Timeout == 0 {
+		w.Timeout = defaultWebhookTimeout
+	}
+	if w.RetryBackoff == 0 {
+		w.RetryBackoff = defaultWebhookBackoff
+	}
+	if w.Clock == nil {
+		w.Clock = &timetools.RealTime{}
+	}
 
-	return &WebhookSideEffect{w: w}, nil
+	e := &WebhookSideEffect{
+		w:        w,
+		clock:    w.Clock,
+		mtx:      &sync.Mutex{},
+		lastSent: make(map[State]time.Time),
+	}
+	if w.BodyTemplate != "" {
+		if e.t, err = template.New("webhook").Parse(w.BodyTemplate); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
 }
 
-func (w *WebhookSideEffect) getBody() io.Reader {
+func (w *WebhookSideEffect) getBody(e Event) (io.Reader, error) {
+	if w.t != nil {
+		var buf bytes.Buffer
+		if err := w.t.Execute(&buf, e); err != nil {
+			return nil, err
+		}
+		return &buf, nil
+	}
 	if len(w.w.Form) != 0 {
-		return strings.NewReader(w.w.Form.Encode())
+		return strings.NewReader(w.w.Form.Encode()), nil
 	}
 	if len(w.w.Body) != 0 {
-		return bytes.NewBuffer(w.w.Body)
+		return bytes.NewBuffer(w.w.Body), nil
 	}
-	return nil
+	return nil, nil
 }
 
 func (w *WebhookSideEffect) Exec() error {
-	r, err := http.NewRequest(w.w.Method, w.w.URL, w.getBody())
+	return w.ExecEvent(Event{Time: w.clock.UtcNow()})
+}
+
+// ExecEvent sends the webhook for the event, retrying it if it fails
+func (w *WebhookSideEffect) ExecEvent(e Event) error {
+	reserved, ok := w.reserve(e)
+	if !ok {
+		log.Infof("%v skipped duplicate webhook for %v", w, e.State)
+		return nil
+	}
+	backoff := w.w.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.send(e)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= w.w.Retries {
+			w.release(e, reserved)
+			return err
+		}
+		log.Warningf("%v failed: %v, retrying in %v", w, err, backoff)
+		sleep := func() { w.clock.Sleep(backoff) }
+		if e.idle != nil {
+			e.idle(sleep)
+		} else {
+			sleep()
+		}
+		backoff *= 2
+	}
+}
+
+// reserve starts the dedup window of the state before the webhook is sent, so the events coming while
+// the webhook is being sent or retried are skipped, it returns false if the window has already started
+func (w *WebhookSideEffect) reserve(e Event) (time.Time, bool) {
+	if w.w.DedupWindow == 0 {
+		return time.Time{}, true
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	now := w.clock.UtcNow()
+	if last, ok := w.lastSent[e.State]; ok && now.Sub(last) < w.w.DedupWindow {
+		return time.Time{}, false
+	}
+	w.lastSent[e.State] = now
+	return now, true
+}
+
+// release ends the dedup window reserved for the webhook that has failed, so the next event is sent
+func (w *WebhookSideEffect) release(e Event, reserved time.Time) {
+	if w.w.DedupWindow == 0 {
+		return
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.lastSent[e.State].Equal(reserved) {
+		delete(w.lastSent, e.State)
+	}
+}
+
+// send sends the webhook once, it returns true if the failed webhook can be retried
+func (w *WebhookSideEffect) send(e Event) (bool, error) {
+	body, err := w.getBody(e)
 	if err != nil {
-		return err
+		return false, err
+	}
+	r, err := http.NewRequest(w.w.Method, w.w.URL, body)
+	if err != nil {
+		return false, err
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), w.w.Timeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+
 	if len(w.w.Headers) != 0 {
 		utils.CopyHeaders(r.Header, w.w.Headers)
 	}
-	if len(w.w.Form) != 0 {
+	if len(w.w.Form) != 0 && w.t == nil {
 		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	}
-	re, err := http.DefaultClient.Do(r)
+	re, err := w.w.Client.Do(r)
 	if err != nil {
-		return err
+		return true, err
 	}
 	if re.Body != nil {
 		defer re.Body.Close()
 	}
-	body, err := ioutil.ReadAll(re.Body)
+	respBody, err := ioutil.ReadAll(re.Body)
+	if err != nil {
+		return true, err
+	}
+	log.Infof("%v got response: (%s): %s", w, re.Status, string(respBody))
+	if re.StatusCode >= http.StatusInternalServerError || re.StatusCode == http.StatusTooManyRequests {
+		return true, fmt.Errorf("webhook %v failed: %v", w.w.URL, re.Status)
+	}
+	if re.StatusCode >= http.StatusBadRequest {
+		return false, fmt.Errorf("webhook %v failed: %v", w.w.URL, re.Status)
+	}
+	return false, nil
+}
+
+// FileSideEffect appends the events to the file as JSON lines
+type FileSideEffect struct {
+	mtx  *sync.Mutex
+	path string
+}
+
+type fileEvent struct {
+	Name              string        `json:"name,omitempty"`
+	State             string        `json:"state"`
+	Reason            string        `json:"reason,omitempty"`
+	Time              time.Time     `json:"time"`
+	Requests          int64         `json:"requests"`
+	NetworkErrorRatio float64       `json:"network_error_ratio"`
+	StatusCodes       map[int]int64 `json:"status_codes,omitempty"`
+}
+
+func NewFileSideEffect(path string) (*FileSideEffect, error) {
+	if path == "" {
+		return nil, fmt.Errorf("path can not be empty")
+	}
+	return &FileSideEffect{mtx: &sync.Mutex{}, path: path}, nil
+}
+
+func (f *FileSideEffect) Exec() error {
+	return f.ExecEvent(Event{Time: time.Now().UTC()})
+}
+
+func (f *FileSideEffect) ExecEvent(e Event) error {
+	fe := fileEvent{Name: e.Name, State: e.State.String(), Reason: e.Reason, Time: e.Time}
+	if e.Metrics != nil {
+		fe.Requests = e.Metrics.TotalCount()
+		fe.NetworkErrorRatio = e.Metrics.NetworkErrorRatio()
+		fe.StatusCodes = e.Metrics.StatusCodesCounts()
+	}
+	line, err := json.Marshal(fe)
+	if err != nil {
+		return err
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
-	log.Infof("%v got response: (%s): %s", w, re.Status, string(body))
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ChanSideEffect sends the events to the channel, e.g. to watch the circuit breaker in tests.
+// The side effect blocks until the event is received, so the channel should be buffered or read.
+type ChanSideEffect chan Event
+
+func (c ChanSideEffect) Exec() error {
+	return c.ExecEvent(Event{Time: time.Now().UTC()})
+}
+
+func (c ChanSideEffect) ExecEvent(e Event) error {
+	c <- e
 	return nil
 }
+
+const (
+	defaultWebhookTimeout = 10 * time.Second
+	defaultWebhookBackoff = time.Second
+)
@@ -0,0 +1,271 @@
+package cbreaker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/testutils"
+	. "gopkg.in/check.v1"
+)
+
+type EffectSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&EffectSuite{})
+
+func (s *EffectSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *EffectSuite) TestWebhookRetries(c *C) {
+	var calls int32
+	var body string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		body = string(b)
+	})
+	defer srv.Close()
+
+	e, err := NewWebhookSideEffect(Webhook{
+		URL:          srv.URL,
+		Method:       http.MethodPost,
+		BodyTemplate: `{"name": "{{.Name}}", "state": "{{.State}}", "requests": {{.Metrics.TotalCount}}}`,
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+		Clock:        s.clock,
+	})
+	c.Assert(err, IsNil)
+
+	c.Assert(e.ExecEvent(Event{Name: "api", State: StateTripped, Metrics: statsNetErrors(0.6)}), IsNil)
+	c.Assert(atomic.LoadInt32(&calls), Equals, int32(3))
+	c.Assert(body, Equals, `{"name": "api", "state": "tripped", "requests": 100}`)
+
+	// the retries are exhausted
+	atomic.StoreInt32(&calls, 0)
+	e.w.Retries = 1
+	c.Assert(e.ExecEvent(Event{State: StateTripped, Metrics: statsOK()}), NotNil)
+	c.Assert(atomic.LoadInt32(&calls), Equals, int32(2))
+}
+
+func (s *EffectSuite) TestWebhookNoRetryOnClientError(c *C) {
+	var calls int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	defer srv.Close()
+
+	e, err := NewWebhookSideEffect(Webhook{URL: srv.URL, Method: http.MethodPost, Retries: 3, RetryBackoff: time.Millisecond})
+	c.Assert(err, IsNil)
+	c.Assert(e.Exec(), NotNil)
+	c.Assert(atomic.LoadInt32(&calls), Equals, int32(1))
+}
+
+func (s *EffectSuite) TestWebhookTimeout(c *C) {
+	unblock := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		<-unblock
+	})
+	defer srv.Close()
+	defer close(unblock)
+
+	e, err := NewWebhookSideEffect(Webhook{URL: srv.URL, Method: http.MethodPost, Timeout: 10 * time.Millisecond})
+	c.Assert(err, IsNil)
+	c.Assert(e.Exec(), NotNil)
+}
+
+func (s *EffectSuite) TestWebhookDedup(c *C) {
+	var calls int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	})
+	defer srv.Close()
+
+	e, err := NewWebhookSideEffect(Webhook{URL: srv.URL, Method: http.MethodPost, DedupWindow: time.Minute, Clock: s.clock})
+	c.Assert(err, IsNil)
+
+	c.Assert(e.ExecEvent(Event{State: StateTripped}), IsNil)
+	c.Assert(e.ExecEvent(Event{State: StateTripped}), IsNil)
+	c.Assert(e.ExecEvent(Event{State: StateStandby}), IsNil)
+	c.Assert(atomic.LoadInt32(&calls), Equals, int32(2))
+
+	s.clock.Sleep(time.Minute)
+	c.Assert(e.ExecEvent(Event{State: StateTripped}), IsNil)
+	c.Assert(atomic.LoadInt32(&calls), Equals, int32(3))
+}
+
+// The failed webhook does not start the dedup window and is sent again
+func (s *EffectSuite) TestWebhookDedupFailed(c *C) {
+	var calls int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	defer srv.Close()
+
+	e, err := NewWebhookSideEffect(Webhook{URL: srv.URL, Method: http.MethodPost, DedupWindow: time.Minute, Clock: s.clock})
+	c.Assert(err, IsNil)
+
+	c.Assert(e.ExecEvent(Event{State: StateTripped}), NotNil)
+	c.Assert(e.ExecEvent(Event{State: StateTripped}), IsNil)
+	c.Assert(e.ExecEvent(Event{State: StateTripped}), IsNil)
+	c.Assert(atomic.LoadInt32(&calls), Equals, int32(2))
+}
+
+// The events coming while the webhook is retried are skipped
+func (s *EffectSuite) TestWebhookDedupRetrying(c *C) {
+	var calls int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	defer srv.Close()
+
+	var e *WebhookSideEffect
+	var duplicate error
+	clock := &hookSleeper{FreezedTime: s.clock, hook: func() {
+		duplicate = e.ExecEvent(Event{State: StateTripped})
+	}}
+	e, err := NewWebhookSideEffect(Webhook{URL: srv.URL, Method: http.MethodPost, Retries: 1, DedupWindow: time.Minute, Clock: clock})
+	c.Assert(err, IsNil)
+
+	c.Assert(e.ExecEvent(Event{State: StateTripped}), IsNil)
+	c.Assert(duplicate, IsNil)
+	c.Assert(atomic.LoadInt32(&calls), Equals, int32(2))
+}
+
+// hookSleeper calls the hook instead of sleeping
+type hookSleeper struct {
+	*timetools.FreezedTime
+	hook func()
+}
+
+func (s *hookSleeper) Sleep(d time.Duration) {
+	s.hook()
+}
+
+// The webhook waiting to retry does not hold the side effect slot of the circuit breaker
+func (s *EffectSuite) TestWebhookRetryReleasesSlot(c *C) {
+	var calls int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	defer srv.Close()
+
+	slots := make(chan int, 1)
+	sleeper := &slotSleeper{FreezedTime: s.clock, slots: slots}
+	e, err := NewWebhookSideEffect(Webhook{URL: srv.URL, Method: http.MethodPost, Retries: 1, Clock: sleeper})
+	c.Assert(err, IsNil)
+
+	cb, err := New(nil, "NetworkErrorRatio() > 0.5", OnTripped(e))
+	c.Assert(err, IsNil)
+	sleeper.cb = cb
+
+	cb.m.Lock()
+	cb.setState(StateTripped, s.clock.UtcNow().Add(time.Minute))
+	cb.unlock()
+
+	select {
+	case n := <-slots:
+		c.Assert(n, Equals, 0)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timeout waiting for the retry")
+	}
+	for i := 0; atomic.LoadInt32(&calls) != 2 || len(cb.sideEffects) != 0; i++ {
+		c.Assert(i < 100, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// slotSleeper reports the number of the side effect slots taken while sleeping
+type slotSleeper struct {
+	*timetools.FreezedTime
+	cb    *CircuitBreaker
+	slots chan int
+}
+
+func (s *slotSleeper) Sleep(d time.Duration) {
+	s.slots <- len(s.cb.sideEffects)
+}
+
+func (s *EffectSuite) TestBadWebhook(c *C) {
+	_, err := NewWebhookSideEffect(Webhook{URL: "http://localhost", Method: http.MethodPost, Retries: -1})
+	c.Assert(err, NotNil)
+	_, err = NewWebhookSideEffect(Webhook{URL: "http://localhost", Method: http.MethodPost, BodyTemplate: "{{.Oops"})
+	c.Assert(err, NotNil)
+}
+
+func (s *EffectSuite) TestFile(c *C) {
+	dir, err := ioutil.TempDir("", "cbreaker")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.log")
+	f, err := NewFileSideEffect(path)
+	c.Assert(err, IsNil)
+
+	c.Assert(f.ExecEvent(Event{Name: "api", State: StateTripped, Reason: "forced", Time: s.clock.UtcNow(), Metrics: statsNetErrors(0.6)}), IsNil)
+	c.Assert(f.ExecEvent(Event{Name: "api", State: StateStandby, Time: s.clock.UtcNow()}), IsNil)
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	c.Assert(len(lines), Equals, 2)
+
+	var e fileEvent
+	c.Assert(json.Unmarshal([]byte(lines[0]), &e), IsNil)
+	c.Assert(e.Name, Equals, "api")
+	c.Assert(e.State, Equals, "tripped")
+	c.Assert(e.Reason, Equals, "forced")
+	c.Assert(e.Requests, Equals, int64(100))
+	c.Assert(e.NetworkErrorRatio, Equals, 0.6)
+
+	_, err = NewFileSideEffect("")
+	c.Assert(err, NotNil)
+}
+
+func (s *EffectSuite) TestChan(c *C) {
+	events := make(ChanSideEffect, 2)
+	cb, err := New(nil, triggerNetRatio, Name("api"), OnTripped(events), OnStandby(events))
+	c.Assert(err, IsNil)
+
+	cb.metrics = statsNetErrors(0.6)
+	cb.Record(http.StatusOK, 0)
+	c.Assert(cb.State(), Equals, StateTripped)
+
+	select {
+	case e := <-events:
+		c.Assert(e.Name, Equals, "api")
+		c.Assert(e.State, Equals, StateTripped)
+		c.Assert(strings.Contains(e.Reason, triggerNetRatio), Equals, true)
+		c.Assert(e.Metrics.TotalCount(), Equals, int64(101))
+	case <-time.After(time.Second):
+		c.Error("timeout waiting for side effect to kick off")
+	}
+
+	cb.ForceReset()
+	select {
+	case e := <-events:
+		c.Assert(e.State, Equals, StateStandby)
+	case <-time.After(time.Second):
+		c.Error("timeout waiting for side effect to kick off")
+	}
+}
@@ -1,12 +1,21 @@
 package cbreaker
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/forward"
 	"github.com/vulcand/oxy/utils"
 )
 
@@ -76,3 +85,176 @@ func (f *RedirectFallback) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusFound)
 	w.Write([]byte(http.StatusText(http.StatusFound)))
 }
+
+type Upstream struct {
+	URL string
+	// Forwarder sends the requests to the upstream, the forwarder with the default options is used if it is nil
+	Forwarder *forward.Forwarder
+}
+
+// UpstreamFallback forwards the requests to the alternate upstream
+type UpstreamFallback struct {
+	u   *url.URL
+	fwd *forward.Forwarder
+}
+
+func NewUpstreamFallback(u Upstream) (*UpstreamFallback, error) {
+	parsed, err := url.ParseRequestURI(u.URL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Host == "" {
+		return nil, fmt.Errorf("upstream url should have host, got %q", u.URL)
+	}
+	fwd := u.Forwarder
+	if fwd == nil {
+		if fwd, err = forward.New(); err != nil {
+			return nil, err
+		}
+	}
+	return &UpstreamFallback{u: parsed, fwd: fwd}, nil
+}
+
+func (f *UpstreamFallback) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if log.GetLevel() >= log.DebugLevel {
+		logEntry := log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/fallback/upstream: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/fallback/upstream: competed ServeHttp on request")
+	}
+
+	newReq := *req
+	newReq.URL = utils.CopyURL(f.u)
+	f.fwd.ServeHTTP(w, &newReq)
+}
+
+type TemplateResponse struct {
+	StatusCode int
+	// ContentType selects how the values are escaped: text/html bodies are rendered with html/template,
+	// JSON bodies require every value to be piped through the json function, e.g. {{json .Reason}},
+	// other bodies are served as plain text, text/plain by default
+	ContentType string
+	// Body is the template executed with TemplateData
+	Body string
+}
+
+// TemplateData is passed to the template of the response body,
+// e.g. `{"error": {{json .Reason}}, "path": {{json .Request.URL.Path}}}`
+type TemplateData struct {
+	// Request is controlled by the client, its values should never be rendered unescaped
+	Request *http.Request
+	// Reason tells why the circuit breaker has tripped
+	Reason string
+}
+
+// TemplateFallback responds with the body rendered from the template
+type TemplateFallback struct {
+	r TemplateResponse
+	t executor
+}
+
+// executor is implemented by both text/template and html/template
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+func NewTemplateFallback(r TemplateResponse) (*TemplateFallback, error) {
+	if r.StatusCode == 0 {
+		return nil, fmt.Errorf("response code should not be 0")
+	}
+	if r.ContentType == "" {
+		r.ContentType = "text/plain; charset=utf-8"
+	}
+	mediaType, _, err := mime.ParseMediaType(r.ContentType)
+	if err != nil {
+		return nil, fmt.Errorf("bad content type %v: %v", r.ContentType, err)
+	}
+
+	if mediaType == "text/html" {
+		t, err := htmltemplate.New("fallback").Parse(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &TemplateFallback{r: r, t: t}, nil
+	}
+	t, err := template.New("fallback").Funcs(template.FuncMap{"json": jsonValue}).Parse(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		if err := checkEscaped(t.Tree.Root); err != nil {
+			return nil, err
+		}
+	}
+	return &TemplateFallback{r: r, t: t}, nil
+}
+
+// jsonValue encodes the value as JSON, escaping the HTML characters as well
+func jsonValue(v interface{}) (string, error) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// checkEscaped makes sure every value written by the template is piped through the json function
+func checkEscaped(n parse.Node) error {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Nodes {
+			if err := checkEscaped(c); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) != 0 {
+			return nil
+		}
+		last := n.Pipe.Cmds[len(n.Pipe.Cmds)-1]
+		if id, ok := last.Args[0].(*parse.IdentifierNode); !ok || id.Ident != "json" {
+			return fmt.Errorf("%v should be escaped with the json function, e.g. {{json .Reason}}", n)
+		}
+	case *parse.IfNode:
+		return checkBranch(&n.BranchNode)
+	case *parse.RangeNode:
+		return checkBranch(&n.BranchNode)
+	case *parse.WithNode:
+		return checkBranch(&n.BranchNode)
+	case *parse.TemplateNode:
+		return fmt.Errorf("%v is not supported in JSON templates", n)
+	}
+	return nil
+}
+
+func checkBranch(n *parse.BranchNode) error {
+	if err := checkEscaped(n.List); err != nil {
+		return err
+	}
+	return checkEscaped(n.ElseList)
+}
+
+func (f *TemplateFallback) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if log.GetLevel() >= log.DebugLevel {
+		logEntry := log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/fallback/template: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/fallback/template: competed ServeHttp on request")
+	}
+
+	var body bytes.Buffer
+	if err := f.t.Execute(&body, TemplateData{Request: req, Reason: TrippedReason(req)}); err != nil {
+		log.Errorf("vulcand/oxy/fallback/template: failed to render the response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		return
+	}
+
+	w.Header().Set("Content-Type", f.r.ContentType)
+	// the client should not sniff the plain text rendered with the request values as HTML
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.WriteHeader(f.r.StatusCode)
+	w.Write(body.Bytes())
+}
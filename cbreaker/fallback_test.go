@@ -0,0 +1,198 @@
+package cbreaker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/vulcand/oxy/testutils"
+	. "gopkg.in/check.v1"
+)
+
+type FallbackSuite struct{}
+
+var _ = Suite(&FallbackSuite{})
+
+func get(h http.Handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func (s *FallbackSuite) TestStaleCache(c *C) {
+	code := http.StatusOK
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(code)
+		w.Write([]byte("hello " + req.URL.Path))
+	})
+
+	fallback, err := NewStaleCacheFallback(StaleCache{Size: 2, MaxBodySize: 10})
+	c.Assert(err, IsNil)
+	cb, err := New(handler, triggerNetRatio, Fallback(fallback))
+	c.Assert(err, IsNil)
+
+	get(cb, "/a")
+	get(cb, "/b")
+	// the body is too big
+	get(cb, "/long/path")
+	// the failed responses are not cached
+	code = http.StatusInternalServerError
+	get(cb, "/c")
+	c.Assert(fallback.Len(), Equals, 2)
+
+	cb.ForceTrip()
+	w := get(cb, "/a")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "hello /a")
+	c.Assert(w.Header().Get("Content-Type"), Equals, "text/plain")
+	c.Assert(w.Header().Get("Warning"), Not(Equals), "")
+
+	c.Assert(get(cb, "/long/path").Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(get(cb, "/c").Code, Equals, http.StatusServiceUnavailable)
+
+	// /a has been used recently, so /b is evicted
+	cb.ForceReset()
+	code = http.StatusOK
+	get(cb, "/d")
+	cb.ForceTrip()
+	c.Assert(get(cb, "/a").Code, Equals, http.StatusOK)
+	c.Assert(get(cb, "/b").Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(get(cb, "/d").Body.String(), Equals, "hello /d")
+
+	_, err = NewStaleCacheFallback(StaleCache{Size: -1})
+	c.Assert(err, NotNil)
+}
+
+// The responses personalised for the client are not served to the other clients
+func (s *FallbackSuite) TestStaleCachePrivate(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/cookie":
+			w.Header().Set("Set-Cookie", "session=1")
+		case "/private":
+			w.Header().Set("Cache-Control", "max-age=60, private")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/vary":
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		w.Write([]byte("hello"))
+	})
+
+	fallback, err := NewStaleCacheFallback(StaleCache{})
+	c.Assert(err, IsNil)
+	cb, err := New(handler, triggerNetRatio, Fallback(fallback))
+	c.Assert(err, IsNil)
+
+	for _, path := range []string{"/cookie", "/private", "/no-store", "/vary"} {
+		get(cb, path)
+	}
+	for _, header := range []string{"Authorization", "Cookie"} {
+		req := httptest.NewRequest(http.MethodGet, "/"+header, nil)
+		req.Header.Set(header, "secret")
+		cb.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	c.Assert(fallback.Len(), Equals, 0)
+
+	get(cb, "/public")
+	c.Assert(fallback.Len(), Equals, 1)
+}
+
+func (s *FallbackSuite) TestUpstream(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("upstream " + req.URL.Path))
+	})
+	defer srv.Close()
+
+	fallback, err := NewUpstreamFallback(Upstream{URL: srv.URL})
+	c.Assert(err, IsNil)
+	cb, err := New(nil, triggerNetRatio, Fallback(fallback))
+	c.Assert(err, IsNil)
+	cb.ForceTrip()
+
+	proxy := httptest.NewServer(cb)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL + "/path")
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "upstream /path")
+
+	_, err = NewUpstreamFallback(Upstream{URL: "/path"})
+	c.Assert(err, NotNil)
+}
+
+func (s *FallbackSuite) TestTemplate(c *C) {
+	fallback, err := NewTemplateFallback(TemplateResponse{
+		StatusCode:  http.StatusServiceUnavailable,
+		ContentType: "application/json",
+		Body:        `{"error": {{json .Reason}}, "path": {{json .Request.URL.Path}}}`,
+	})
+	c.Assert(err, IsNil)
+	cb, err := New(nil, triggerNetRatio, Fallback(fallback))
+	c.Assert(err, IsNil)
+	cb.ForceTrip()
+
+	w := get(cb, "/path")
+	c.Assert(w.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(w.Header().Get("Content-Type"), Equals, "application/json")
+	c.Assert(w.Body.String(), Equals, `{"error": "forced", "path": "/path"}`)
+
+	// the reason of the trip by the condition
+	cb, err = New(nil, triggerNetRatio, Fallback(fallback))
+	c.Assert(err, IsNil)
+	cb.metrics = statsNetErrors(0.6)
+	cb.Record(http.StatusOK, 0)
+	c.Assert(cb.State(), Equals, StateTripped)
+	// the reason is escaped as JSON
+	c.Assert(strings.Contains(get(cb, "/").Body.String(), `NetworkErrorRatio() \u003e 0.5`), Equals, true)
+
+	_, err = NewTemplateFallback(TemplateResponse{StatusCode: http.StatusServiceUnavailable, Body: "{{.Oops"})
+	c.Assert(err, NotNil)
+	_, err = NewTemplateFallback(TemplateResponse{Body: "hello"})
+	c.Assert(err, NotNil)
+	_, err = NewTemplateFallback(TemplateResponse{StatusCode: http.StatusServiceUnavailable, ContentType: "text/html text", Body: "hello"})
+	c.Assert(err, NotNil)
+}
+
+// The request values controlled by the client are escaped for the content type of the response
+func (s *FallbackSuite) TestTemplateEscaping(c *C) {
+	path := "/%3Cscript%3Ealert(1)%3C/script%3E%22"
+
+	htmlFallback, err := NewTemplateFallback(TemplateResponse{
+		StatusCode:  http.StatusServiceUnavailable,
+		ContentType: "text/html; charset=utf-8",
+		Body:        `<p>{{.Request.URL.Path}} is unavailable</p>`,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(get(htmlFallback, path).Body.String(), Equals, `<p>/&lt;script&gt;alert(1)&lt;/script&gt;&#34; is unavailable</p>`)
+
+	jsonFallback, err := NewTemplateFallback(TemplateResponse{
+		StatusCode:  http.StatusServiceUnavailable,
+		ContentType: "application/json",
+		Body:        `{"path": {{json .Request.URL.Path}}{{if .Reason}}, "reason": {{.Reason | json}}{{end}}}`,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(get(jsonFallback, path).Body.String(), Equals, `{"path": "/\u003cscript\u003ealert(1)\u003c/script\u003e\""}`)
+
+	// the values not escaped with json are rejected
+	for _, body := range []string{`{"path": "{{.Request.URL.Path}}"}`, `{{if .Reason}}{{.Reason}}{{end}}`, `{{.Reason | printf "%v"}}`} {
+		_, err = NewTemplateFallback(TemplateResponse{StatusCode: http.StatusServiceUnavailable, ContentType: "application/problem+json", Body: body})
+		c.Assert(err, NotNil, Commentf(body))
+	}
+
+	// the plain text is not sniffed as HTML
+	text, err := NewTemplateFallback(TemplateResponse{StatusCode: http.StatusServiceUnavailable, Body: `{{.Request.URL.Path}}`})
+	c.Assert(err, IsNil)
+	w := get(text, path)
+	c.Assert(w.Header().Get("Content-Type"), Equals, "text/plain; charset=utf-8")
+	c.Assert(w.Header().Get("X-Content-Type-Options"), Equals, "nosniff")
+}
+
+func (s *FallbackSuite) TestTemplateExecError(c *C) {
+	fallback, err := NewTemplateFallback(TemplateResponse{StatusCode: http.StatusServiceUnavailable, Body: "{{.Oops}}"})
+	c.Assert(err, IsNil)
+	w := get(fallback, "/")
+	c.Assert(w.Code, Equals, http.StatusInternalServerError)
+}
@@ -1,7 +1,13 @@
 package cbreaker
 
 import (
+	"bytes"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -16,6 +22,7 @@ func parseExpression(in string) (hpredicate, error) {
 		Operators: predicate.Operators{
 			AND: and,
 			OR:  or,
+			NOT: not,
 			EQ:  eq,
 			NEQ: neq,
 			LT:  lt,
@@ -25,14 +32,28 @@ func parseExpression(in string) (hpredicate, error) {
 		},
 		Functions: map[string]interface{}{
 			"LatencyAtQuantileMS": latencyAtQuantile,
+			"LatencyMeanMS":       latencyMean,
 			"NetworkErrorRatio":   networkErrorRatio,
 			"ResponseCodeRatio":   responseCodeRatio,
+			"ErrorRatio":          errorRatio,
+			"RequestCount":        requestCount,
+			"RequestRate":         requestRate,
+			"ConsecutiveFailures": consecutiveFailures,
+			// arithmetic operators are rewritten into these functions
+			addFunc: add,
+			subFunc: sub,
+			mulFunc: mul,
+			quoFunc: quo,
 		},
 	})
 	if err != nil {
 		return nil, err
 	}
-	out, err := p.Parse(in)
+	rewritten, err := rewriteArithmetic(in)
+	if err != nil {
+		return nil, err
+	}
+	out, err := p.Parse(rewritten)
 	if err != nil {
 		return nil, err
 	}
@@ -57,6 +78,18 @@ func latencyAtQuantile(quantile float64) toInt {
 	}
 }
 
+// latencyMean returns the mean latency in milliseconds
+func latencyMean() toFloat64 {
+	return func(c *CircuitBreaker) float64 {
+		h, err := c.metrics.LatencyHistogram()
+		if err != nil {
+			log.Errorf("Failed to get latency histogram, for %v error: %v", c, err)
+			return 0
+		}
+		return float64(h.LatencyMean()) / float64(time.Millisecond)
+	}
+}
+
 func networkErrorRatio() toFloat64 {
 	return func(c *CircuitBreaker) float64 {
 		return c.metrics.NetworkErrorRatio()
@@ -69,6 +102,211 @@ func responseCodeRatio(startA, endA, startB, endB int) toFloat64 {
 	}
 }
 
+// errorRatio returns the ratio of the responses with the codes in [start, end) to all responses
+func errorRatio(start, end int) toFloat64 {
+	return func(c *CircuitBreaker) float64 {
+		total := c.metrics.TotalCount()
+		if total == 0 {
+			return 0
+		}
+		var errors int64
+		for code, count := range c.metrics.StatusCodesCounts() {
+			if code >= start && code < end {
+				errors += count
+			}
+		}
+		return float64(errors) / float64(total)
+	}
+}
+
+// requestCount returns the number of requests in the metrics window
+func requestCount() toInt {
+	return func(c *CircuitBreaker) int {
+		return int(c.metrics.TotalCount())
+	}
+}
+
+// requestRate returns the number of requests per second in the metrics window
+func requestRate() toFloat64 {
+	return func(c *CircuitBreaker) float64 {
+		window := c.metrics.CounterWindowSize()
+		if window <= 0 {
+			return 0
+		}
+		return float64(c.metrics.TotalCount()) / window.Seconds()
+	}
+}
+
+// consecutiveFailures returns the number of 5xx responses since the last successful one
+func consecutiveFailures() toInt {
+	return func(c *CircuitBreaker) int {
+		return int(atomic.LoadInt64(&c.failures))
+	}
+}
+
+const (
+	addFunc = "__add"
+	subFunc = "__sub"
+	mulFunc = "__mul"
+	quoFunc = "__quo"
+)
+
+// rewriteArithmetic rewrites the arithmetic operators into the calls of the arithmetic functions,
+// as the predicate parser supports only the logical and comparison operators,
+// e.g. "RequestCount() * 2 > 10" becomes "__mul(RequestCount(), 2) > 10"
+func rewriteArithmetic(in string) (string, error) {
+	expr, err := parser.ParseExpr(in)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, token.NewFileSet(), rewriteExpr(expr)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func rewriteExpr(expr ast.Expr) ast.Expr {
+	switch n := expr.(type) {
+	case *ast.BinaryExpr:
+		x, y := rewriteExpr(n.X), rewriteExpr(n.Y)
+		if fn := arithmeticFunc(n.Op); fn != "" {
+			return &ast.CallExpr{Fun: ast.NewIdent(fn), Args: []ast.Expr{x, y}}
+		}
+		return &ast.BinaryExpr{X: x, Op: n.Op, Y: y}
+	case *ast.ParenExpr:
+		x := rewriteExpr(n.X)
+		// the parser does not accept the parens around the function arguments
+		switch x.(type) {
+		case *ast.BinaryExpr, *ast.UnaryExpr:
+			return &ast.ParenExpr{X: x}
+		}
+		return x
+	case *ast.UnaryExpr:
+		x := rewriteExpr(n.X)
+		switch n.Op {
+		case token.ADD:
+			return x
+		case token.SUB:
+			// the predicate parser does not support the negative literals either
+			return &ast.CallExpr{Fun: ast.NewIdent(subFunc), Args: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: "0"}, x}}
+		}
+		return &ast.UnaryExpr{Op: n.Op, X: x}
+	case *ast.CallExpr:
+		args := make([]ast.Expr, len(n.Args))
+		for i, a := range n.Args {
+			args[i] = rewriteExpr(a)
+		}
+		return &ast.CallExpr{Fun: n.Fun, Args: args}
+	}
+	return expr
+}
+
+func arithmeticFunc(op token.Token) string {
+	switch op {
+	case token.ADD:
+		return addFunc
+	case token.SUB:
+		return subFunc
+	case token.MUL:
+		return mulFunc
+	case token.QUO:
+		return quoFunc
+	}
+	return ""
+}
+
+// add returns the sum of the values, the values are the mappers or the constants
+func add(a, b interface{}) (interface{}, error) {
+	return arithmetic("+", a, b,
+		func(x, y int) int { return x + y },
+		func(x, y float64) float64 { return x + y })
+}
+
+// sub returns the difference of the values
+func sub(a, b interface{}) (interface{}, error) {
+	return arithmetic("-", a, b,
+		func(x, y int) int { return x - y },
+		func(x, y float64) float64 { return x - y })
+}
+
+// mul returns the product of the values
+func mul(a, b interface{}) (interface{}, error) {
+	return arithmetic("*", a, b,
+		func(x, y int) int { return x * y },
+		func(x, y float64) float64 { return x * y })
+}
+
+// quo returns the quotient of the values, the division is always done in floats and the division by zero gives 0
+func quo(a, b interface{}) (interface{}, error) {
+	return arithmetic("/", a, b, nil, func(x, y float64) float64 {
+		if y == 0 {
+			return 0
+		}
+		return x / y
+	})
+}
+
+// arithmetic applies the integer operation if both values are integers and the integer operation is defined,
+// otherwise it applies the float operation
+func arithmetic(op string, a, b interface{}, intOp func(int, int) int, floatOp func(float64, float64) float64) (interface{}, error) {
+	if !isMapper(a) && !isMapper(b) {
+		// both values are constants
+		if x, ok := a.(int); ok && intOp != nil {
+			if y, ok := b.(int); ok {
+				return intOp(x, y), nil
+			}
+		}
+		x, okA := asFloat64(a)
+		y, okB := asFloat64(b)
+		if !okA || !okB {
+			return nil, fmt.Errorf("%v: unsupported arguments: %T and %T", op, a, b)
+		}
+		return floatOp(x(nil), y(nil)), nil
+	}
+	if intOp != nil {
+		x, okA := asInt(a)
+		y, okB := asInt(b)
+		if okA && okB {
+			return toInt(func(c *CircuitBreaker) int {
+				return intOp(x(c), y(c))
+			}), nil
+		}
+	}
+	x, okA := asFloat64(a)
+	y, okB := asFloat64(b)
+	if !okA || !okB {
+		return nil, fmt.Errorf("%v: unsupported arguments: %T and %T", op, a, b)
+	}
+	return toFloat64(func(c *CircuitBreaker) float64 {
+		return floatOp(x(c), y(c))
+	}), nil
+}
+
+func asInt(v interface{}) (toInt, bool) {
+	switch value := v.(type) {
+	case toInt:
+		return value, true
+	case int:
+		return func(c *CircuitBreaker) int { return value }, true
+	}
+	return nil, false
+}
+
+func asFloat64(v interface{}) (toFloat64, bool) {
+	switch value := v.(type) {
+	case toFloat64:
+		return value, true
+	case toInt:
+		return func(c *CircuitBreaker) float64 { return float64(value(c)) }, true
+	case float64:
+		return func(c *CircuitBreaker) float64 { return value }, true
+	case int:
+		return func(c *CircuitBreaker) float64 { return float64(value) }, true
+	}
+	return nil, false
+}
+
 // or returns predicate by joining the passed predicates with logical 'or'
 func or(fns ...hpredicate) hpredicate {
 	return func(c *CircuitBreaker) bool {
@@ -100,134 +338,77 @@ func not(p hpredicate) hpredicate {
 	}
 }
 
-// eq returns predicate that tests for equality of the value of the mapper and the constant
-func eq(m interface{}, value interface{}) (hpredicate, error) {
-	switch mapper := m.(type) {
-	case toInt:
-		return intEQ(mapper, value)
-	case toFloat64:
-		return float64EQ(mapper, value)
-	}
-	return nil, fmt.Errorf("eq: unsupported argument: %T", m)
+// eq returns predicate that tests for equality of the values, the values are the mappers or the constants
+func eq(a interface{}, b interface{}) (hpredicate, error) {
+	return compare("eq", a, b,
+		func(x, y int) bool { return x == y },
+		func(x, y float64) bool { return x == y })
 }
 
-// neq returns predicate that tests for inequality of the value of the mapper and the constant
-func neq(m interface{}, value interface{}) (hpredicate, error) {
-	p, err := eq(m, value)
+// neq returns predicate that tests for inequality of the values
+func neq(a interface{}, b interface{}) (hpredicate, error) {
+	p, err := eq(a, b)
 	if err != nil {
 		return nil, err
 	}
 	return not(p), nil
 }
 
-// lt returns predicate that tests that value of the mapper function is less than the constant
-func lt(m interface{}, value interface{}) (hpredicate, error) {
-	switch mapper := m.(type) {
-	case toInt:
-		return intLT(mapper, value)
-	case toFloat64:
-		return float64LT(mapper, value)
-	}
-	return nil, fmt.Errorf("lt: unsupported argument: %T", m)
-}
-
-// le returns predicate that tests that value of the mapper function is less or equal than the constant
-func le(m interface{}, value interface{}) (hpredicate, error) {
-	l, err := lt(m, value)
-	if err != nil {
-		return nil, err
-	}
-	e, err := eq(m, value)
-	if err != nil {
-		return nil, err
-	}
-	return func(c *CircuitBreaker) bool {
-		return l(c) || e(c)
-	}, nil
-}
-
-// gt returns predicate that tests that value of the mapper function is greater than the constant
-func gt(m interface{}, value interface{}) (hpredicate, error) {
-	switch mapper := m.(type) {
-	case toInt:
-		return intGT(mapper, value)
-	case toFloat64:
-		return float64GT(mapper, value)
-	}
-	return nil, fmt.Errorf("gt: unsupported argument: %T", m)
+// lt returns predicate that tests that the first value is less than the second one
+func lt(a interface{}, b interface{}) (hpredicate, error) {
+	return compare("lt", a, b,
+		func(x, y int) bool { return x < y },
+		func(x, y float64) bool { return x < y })
 }
 
-// ge returns predicate that tests that value of the mapper function is less or equal than the constant
-func ge(m interface{}, value interface{}) (hpredicate, error) {
-	g, err := gt(m, value)
-	if err != nil {
-		return nil, err
-	}
-	e, err := eq(m, value)
-	if err != nil {
-		return nil, err
-	}
-	return func(c *CircuitBreaker) bool {
-		return g(c) || e(c)
-	}, nil
+// le returns predicate that tests that the first value is less or equal than the second one
+func le(a interface{}, b interface{}) (hpredicate, error) {
+	return compare("le", a, b,
+		func(x, y int) bool { return x <= y },
+		func(x, y float64) bool { return x <= y })
 }
 
-func intEQ(m toInt, val interface{}) (hpredicate, error) {
-	value, ok := val.(int)
-	if !ok {
-		return nil, fmt.Errorf("expected int, got %T", val)
-	}
-	return func(c *CircuitBreaker) bool {
-		return m(c) == value
-	}, nil
+// gt returns predicate that tests that the first value is greater than the second one
+func gt(a interface{}, b interface{}) (hpredicate, error) {
+	return compare("gt", a, b,
+		func(x, y int) bool { return x > y },
+		func(x, y float64) bool { return x > y })
 }
 
-func float64EQ(m toFloat64, val interface{}) (hpredicate, error) {
-	value, ok := val.(float64)
-	if !ok {
-		return nil, fmt.Errorf("expected float64, got %T", val)
-	}
-	return func(c *CircuitBreaker) bool {
-		return m(c) == value
-	}, nil
+// ge returns predicate that tests that the first value is greater or equal than the second one
+func ge(a interface{}, b interface{}) (hpredicate, error) {
+	return compare("ge", a, b,
+		func(x, y int) bool { return x >= y },
+		func(x, y float64) bool { return x >= y })
 }
 
-func intLT(m toInt, val interface{}) (hpredicate, error) {
-	value, ok := val.(int)
-	if !ok {
-		return nil, fmt.Errorf("expected int, got %T", val)
+// compare compares the integers if both values are integers and the floats otherwise,
+// at least one of the values should be a mapper
+func compare(op string, a, b interface{}, intCmp func(int, int) bool, floatCmp func(float64, float64) bool) (hpredicate, error) {
+	if !isMapper(a) && !isMapper(b) {
+		return nil, fmt.Errorf("%v: unsupported arguments: %T and %T", op, a, b)
 	}
-	return func(c *CircuitBreaker) bool {
-		return m(c) < value
-	}, nil
-}
-
-func intGT(m toInt, val interface{}) (hpredicate, error) {
-	value, ok := val.(int)
-	if !ok {
-		return nil, fmt.Errorf("expected int, got %T", val)
+	if x, okA := asInt(a); okA {
+		if y, okB := asInt(b); okB {
+			return func(c *CircuitBreaker) bool {
+				return intCmp(x(c), y(c))
+			}, nil
+		}
 	}
-	return func(c *CircuitBreaker) bool {
-		return m(c) > value
-	}, nil
-}
-
-func float64LT(m toFloat64, val interface{}) (hpredicate, error) {
-	value, ok := val.(float64)
-	if !ok {
-		return nil, fmt.Errorf("expected int, got %T", val)
+	x, okA := asFloat64(a)
+	y, okB := asFloat64(b)
+	if !okA || !okB {
+		return nil, fmt.Errorf("%v: unsupported arguments: %T and %T", op, a, b)
 	}
 	return func(c *CircuitBreaker) bool {
-		return m(c) < value
+		return floatCmp(x(c), y(c))
 	}, nil
 }
 
-func float64GT(m toFloat64, val interface{}) (hpredicate, error) {
-	value, ok := val.(float64)
-	if !ok {
-		return nil, fmt.Errorf("expected int, got %T", val)
+func isMapper(v interface{}) bool {
+	switch v.(type) {
+	case toInt, toFloat64:
+		return true
 	}
-	return func(c *CircuitBreaker) bool {
-		return m(c) > value
-	}, nil
+	return false
 }
@@ -1,9 +1,10 @@
 package cbreaker
 
 import (
-	"github.com/vulcand/oxy/memmetrics"
 	"time"
 
+	"github.com/vulcand/oxy/memmetrics"
+
 	. "gopkg.in/check.v1"
 )
 
@@ -48,6 +49,62 @@ func (s *PredicatesSuite) TestTripped(c *C) {
 			M:          statsResponseCodes(statusCode{Code: 200, Count: 5}, statusCode{Code: 500, Count: 4}),
 			V:          false,
 		},
+		{
+			Expression: "RequestCount() > 20 && NetworkErrorRatio() > 0.5",
+			M:          statsNetErrors(0.6),
+			V:          true,
+		},
+		{
+			Expression: "RequestCount() > 200 && NetworkErrorRatio() > 0.5",
+			M:          statsNetErrors(0.6),
+			V:          false,
+		},
+		{
+			Expression: "!(NetworkErrorRatio() > 0.5)",
+			M:          statsNetErrors(0.6),
+			V:          false,
+		},
+		{
+			Expression: "ErrorRatio(500, 600) > 0.5",
+			M:          statsResponseCodes(statusCode{Code: 200, Count: 5}, statusCode{Code: 500, Count: 6}),
+			V:          true,
+		},
+		{
+			Expression: "ErrorRatio(400, 500) > 0.5",
+			M:          statsResponseCodes(statusCode{Code: 200, Count: 5}, statusCode{Code: 500, Count: 6}),
+			V:          false,
+		},
+		{
+			Expression: "LatencyMeanMS() > 50",
+			M:          statsLatencyAtQuantile(50, time.Millisecond*51),
+			V:          true,
+		},
+		{
+			// 100 requests in 10 seconds window
+			Expression: "RequestRate() >= 10.0",
+			M:          statsNetErrors(0.6),
+			V:          true,
+		},
+		{
+			Expression: "RequestCount() * NetworkErrorRatio() > 59",
+			M:          statsNetErrors(0.6),
+			V:          true,
+		},
+		{
+			Expression: "(RequestCount() - 40) / 2 == 30",
+			M:          statsNetErrors(0.6),
+			V:          true,
+		},
+		{
+			Expression: "LatencyAtQuantileMS(50.0) > -1 * 10 + 60",
+			M:          statsLatencyAtQuantile(50, time.Millisecond*51),
+			V:          true,
+		},
+		{
+			Expression: "ResponseCodeRatio(500, 600, 0, 600) > NetworkErrorRatio()",
+			M:          statsResponseCodes(statusCode{Code: 200, Count: 5}, statusCode{Code: 500, Count: 6}),
+			V:          true,
+		},
 	}
 	for _, t := range predicates {
 		p, err := parseExpression(t.Expression)
@@ -76,3 +133,29 @@ func (s *PredicatesSuite) TestErrors(c *C) {
 		c.Assert(p(&CircuitBreaker{metrics: t.M}), Equals, false)
 	}
 }
+
+func (s *PredicatesSuite) TestConsecutiveFailures(c *C) {
+	cb, err := New(nil, "ConsecutiveFailures() >= 3", CheckPeriod(time.Hour))
+	c.Assert(err, IsNil)
+
+	for _, code := range []int{500, 502, 200, 500, 503} {
+		cb.Record(code, 0)
+	}
+	c.Assert(cb.condition(cb), Equals, false)
+
+	cb.Record(504, 0)
+	c.Assert(cb.condition(cb), Equals, true)
+}
+
+func (s *PredicatesSuite) TestBadExpressions(c *C) {
+	for _, expr := range []string{
+		"1 > 2",
+		`NetworkErrorRatio() > "a"`,
+		`NetworkErrorRatio() + "a" > 1`,
+		"NetworkErrorRatio() % 2 > 1",
+		"Oops() > 1",
+	} {
+		_, err := parseExpression(expr)
+		c.Assert(err, NotNil, Commentf(expr))
+	}
+}
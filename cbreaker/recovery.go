@@ -0,0 +1,176 @@
+package cbreaker
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/mailgun/timetools"
+)
+
+// Recovery lets the traffic back to the endpoints in the recovering state. The circuit breaker creates
+// a new Recovery every time it starts recovering and calls its methods with the lock held.
+type Recovery interface {
+	// Allow tells whether the request can go through
+	Allow() bool
+	// Record is called with the response code of the request that went through
+	Record(code int)
+	// Result returns StateStandby when the recovery has succeeded, StateTripped when it has failed
+	// and StateRecovering while it is in progress. The circuit breaker checks the condition
+	// before it enters the standby state, so the recovery that ends while the endpoints still fail trips it again.
+	Result() State
+}
+
+// RecoveryStrategy creates the Recovery for the circuit breaker recovering for the recovery duration
+type RecoveryStrategy func(clock timetools.TimeProvider, duration time.Duration) Recovery
+
+// LinearRamp lets through the share of requests growing linearly from 0 to 100% over the recovery duration
+func LinearRamp(clock timetools.TimeProvider, duration time.Duration) Recovery {
+	return newRamp(clock, duration, func(x float64) float64 {
+		return x
+	})
+}
+
+// ExponentialRamp lets through the share of requests growing exponentially from 0 to 100% over the recovery duration,
+// so only a few requests go through in the first half of it
+func ExponentialRamp(clock timetools.TimeProvider, duration time.Duration) Recovery {
+	return newRamp(clock, duration, func(x float64) float64 {
+		return (math.Exp(rampExponent*x) - 1) / (math.Exp(rampExponent) - 1)
+	})
+}
+
+// HalfOpen lets through the probes requests, the recovery succeeds once all of them succeed and fails
+// on the first probe that fails with 5xx. The probes that have not been answered during
+// the recovery duration are sent again.
+func HalfOpen(probes int) (RecoveryStrategy, error) {
+	if probes <= 0 {
+		return nil, fmt.Errorf("probes should be > 0, got %v", probes)
+	}
+	return func(clock timetools.TimeProvider, duration time.Duration) Recovery {
+		return &halfOpen{
+			probes:   probes,
+			clock:    clock,
+			duration: duration,
+			start:    clock.UtcNow(),
+		}
+	}, nil
+}
+
+// rampExponent sets the steepness of the exponential ramp
+const rampExponent = 5
+
+// ramp lets through the share of requests set by the function of the elapsed share of the recovery duration
+type ramp struct {
+	clock    timetools.TimeProvider
+	duration time.Duration
+	start    time.Time
+	ratio    func(x float64) float64
+	// credit accumulates the target ratio, the request goes through once it adds up to one
+	credit float64
+}
+
+func newRamp(clock timetools.TimeProvider, duration time.Duration, ratio func(x float64) float64) *ramp {
+	return &ramp{
+		clock:    clock,
+		duration: duration,
+		start:    clock.UtcNow(),
+		ratio:    ratio,
+	}
+}
+
+func (r *ramp) Allow() bool {
+	r.credit += r.ratio(r.elapsed())
+	if r.credit >= 1 {
+		r.credit--
+		return true
+	}
+	return false
+}
+
+func (r *ramp) Record(code int) {}
+
+func (r *ramp) Result() State {
+	if r.elapsed() >= 1 {
+		return StateStandby
+	}
+	return StateRecovering
+}
+
+// elapsed returns the elapsed share of the recovery duration
+func (r *ramp) elapsed() float64 {
+	if r.duration <= 0 {
+		return 1
+	}
+	return math.Min(1, float64(r.clock.UtcNow().Sub(r.start))/float64(r.duration))
+}
+
+type halfOpen struct {
+	probes    int
+	clock     timetools.TimeProvider
+	duration  time.Duration
+	start     time.Time
+	sent      int
+	succeeded int
+	failed    bool
+}
+
+func (h *halfOpen) Allow() bool {
+	// resend the probes that have not been answered in time
+	if h.clock.UtcNow().Sub(h.start) > h.duration {
+		h.start = h.clock.UtcNow()
+		h.sent = h.succeeded
+	}
+	if h.sent >= h.probes {
+		return false
+	}
+	h.sent++
+	return true
+}
+
+func (h *halfOpen) Record(code int) {
+	if code >= http.StatusInternalServerError {
+		h.failed = true
+		return
+	}
+	h.succeeded++
+}
+
+func (h *halfOpen) Result() State {
+	switch {
+	case h.failed:
+		return StateTripped
+	case h.succeeded >= h.probes:
+		return StateStandby
+	}
+	return StateRecovering
+}
+
+// ratioRecovery is the default recovery, it lets through the share of requests growing linearly up to a half,
+// see ratioController, and succeeds after the recovery duration
+type ratioRecovery struct {
+	rc    *ratioController
+	clock timetools.TimeProvider
+	until time.Time
+}
+
+func newRatioRecovery(clock timetools.TimeProvider, duration time.Duration) Recovery {
+	return &ratioRecovery{
+		rc:    newRatioController(clock, duration),
+		clock: clock,
+		until: clock.UtcNow().Add(duration),
+	}
+}
+
+func (r *ratioRecovery) Allow() bool {
+	return r.rc.allowRequest()
+}
+
+func (r *ratioRecovery) Record(code int) {}
+
+func (r *ratioRecovery) Result() State {
+	if r.clock.UtcNow().After(r.until) {
+		return StateStandby
+	}
+	return StateRecovering
+}
@@ -0,0 +1,84 @@
+package cbreaker
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mailgun/timetools"
+	. "gopkg.in/check.v1"
+)
+
+type RecoverySuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&RecoverySuite{})
+
+func (s *RecoverySuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+// allowed sends n requests and returns the number of allowed ones
+func allowed(r Recovery, n int) int {
+	out := 0
+	for i := 0; i < n; i++ {
+		if r.Allow() {
+			out++
+		}
+	}
+	return out
+}
+
+func (s *RecoverySuite) TestLinearRamp(c *C) {
+	r := LinearRamp(s.tm, 10*time.Second)
+	c.Assert(allowed(r, 100), Equals, 0)
+	c.Assert(r.Result(), Equals, StateRecovering)
+
+	s.tm.Sleep(5 * time.Second)
+	c.Assert(allowed(r, 100), Equals, 50)
+
+	s.tm.Sleep(5 * time.Second)
+	c.Assert(r.Result(), Equals, StateStandby)
+	c.Assert(allowed(r, 200), Equals, 200)
+}
+
+func (s *RecoverySuite) TestExponentialRamp(c *C) {
+	r := ExponentialRamp(s.tm, 10*time.Second)
+
+	s.tm.Sleep(5 * time.Second)
+	half := allowed(r, 100)
+	c.Assert(half > 0 && half < 20, Equals, true, Commentf("allowed %v", half))
+
+	s.tm.Sleep(5 * time.Second)
+	c.Assert(r.Result(), Equals, StateStandby)
+}
+
+func (s *RecoverySuite) TestHalfOpen(c *C) {
+	strategy, err := HalfOpen(2)
+	c.Assert(err, IsNil)
+
+	r := strategy(s.tm, 10*time.Second)
+	c.Assert(allowed(r, 10), Equals, 2)
+	r.Record(http.StatusOK)
+	c.Assert(r.Result(), Equals, StateRecovering)
+	r.Record(http.StatusOK)
+	c.Assert(r.Result(), Equals, StateStandby)
+
+	r = strategy(s.tm, 10*time.Second)
+	c.Assert(allowed(r, 10), Equals, 2)
+	r.Record(http.StatusOK)
+	r.Record(http.StatusInternalServerError)
+	c.Assert(r.Result(), Equals, StateTripped)
+
+	// the lost probe is sent again after the recovery duration
+	r = strategy(s.tm, 10*time.Second)
+	c.Assert(allowed(r, 10), Equals, 2)
+	r.Record(http.StatusOK)
+	s.tm.Sleep(11 * time.Second)
+	c.Assert(allowed(r, 10), Equals, 1)
+
+	_, err = HalfOpen(0)
+	c.Assert(err, NotNil)
+}
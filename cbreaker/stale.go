@@ -0,0 +1,194 @@
+package cbreaker
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// StaleCache configures the fallback serving the last successful response cached for the same key
+type StaleCache struct {
+	// Size is the max number of the cached responses, the least recently used ones are evicted, 1000 by default
+	Size int
+	// MaxBodySize is the max size of the cached response body, the bigger responses are not cached, 1MB by default
+	MaxBodySize int64
+	// Key returns the cache key of the request, the requests with the empty key are not cached,
+	// by default the GET requests are cached by the host and the request URI. The key is shared by all clients,
+	// so the requests with credentials and the private responses are never cached, see StaleCacheFallback
+	Key func(req *http.Request) string
+	// Fallback serves the requests with no cached response, 503 by default
+	Fallback http.Handler
+}
+
+// StaleCacheFallback caches the successful responses served by the circuit breaker in the standby state
+// and serves them while the circuit breaker is tripped, with the Warning header telling that the response is stale.
+// The responses personalised for the client are not cached, so they are not served to the other clients:
+// the requests with Authorization or Cookie headers and the responses with Set-Cookie, Vary
+// or Cache-Control: private or no-store headers.
+type StaleCacheFallback struct {
+	mtx   *sync.Mutex
+	c     StaleCache
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type staleEntry struct {
+	key    string
+	code   int
+	header http.Header
+	body   []byte
+}
+
+// NewStaleCacheFallback returns the stale cache fallback, pass it to the circuit breaker with the Fallback option
+func NewStaleCacheFallback(c StaleCache) (*StaleCacheFallback, error) {
+	if c.Size < 0 || c.MaxBodySize < 0 {
+		return nil, fmt.Errorf("size and max body size should be >= 0")
+	}
+	if c.Size == 0 {
+		c.Size = defaultStaleCacheSize
+	}
+	if c.MaxBodySize == 0 {
+		c.MaxBodySize = defaultStaleCacheBodySize
+	}
+	if c.Key == nil {
+		c.Key = defaultStaleCacheKey
+	}
+	if c.Fallback == nil {
+		c.Fallback = defaultFallback
+	}
+	return &StaleCacheFallback{
+		mtx:   &sync.Mutex{},
+		c:     c,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}, nil
+}
+
+func (f *StaleCacheFallback) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if log.GetLevel() >= log.DebugLevel {
+		logEntry := log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/fallback/stale: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/fallback/stale: competed ServeHttp on request")
+	}
+
+	e := f.get(f.c.Key(req))
+	if e == nil {
+		f.c.Fallback.ServeHTTP(w, req)
+		return
+	}
+	utils.CopyHeaders(w.Header(), e.header)
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.body)))
+	w.WriteHeader(e.code)
+	w.Write(e.body)
+}
+
+// Len returns the number of the cached responses
+func (f *StaleCacheFallback) Len() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.ll.Len()
+}
+
+// observe captures the response of the request served in the standby state
+func (f *StaleCacheFallback) observe(p *utils.ProxyWriter, req *http.Request) (http.ResponseWriter, func()) {
+	key := f.c.Key(req)
+	if key == "" || req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "" {
+		return p, nil
+	}
+	cw := &capturingWriter{ProxyWriter: p, limit: f.c.MaxBodySize}
+	return cw, func() {
+		code := p.StatusCode()
+		if code < http.StatusOK || code >= http.StatusMultipleChoices || cw.overflow || isPrivate(p.Header()) {
+			return
+		}
+		header := make(http.Header)
+		utils.CopyHeaders(header, p.Header())
+		f.set(&staleEntry{key: key, code: code, header: header, body: cw.buf.Bytes()})
+	}
+}
+
+func (f *StaleCacheFallback) get(key string) *staleEntry {
+	if key == "" {
+		return nil
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	el, ok := f.items[key]
+	if !ok {
+		return nil
+	}
+	f.ll.MoveToFront(el)
+	return el.Value.(*staleEntry)
+}
+
+func (f *StaleCacheFallback) set(e *staleEntry) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if el, ok := f.items[e.key]; ok {
+		el.Value = e
+		f.ll.MoveToFront(el)
+		return
+	}
+	f.items[e.key] = f.ll.PushFront(e)
+	if f.ll.Len() > f.c.Size {
+		oldest := f.ll.Back()
+		f.ll.Remove(oldest)
+		delete(f.items, oldest.Value.(*staleEntry).key)
+	}
+}
+
+// isPrivate tells whether the response is personalised for the client or is not allowed to be stored
+func isPrivate(h http.Header) bool {
+	if h.Get("Set-Cookie") != "" || h.Get("Vary") != "" {
+		return true
+	}
+	for _, v := range h["Cache-Control"] {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "no-store" || directive == "private" || strings.HasPrefix(directive, "private=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// capturingWriter copies the response body up to the limit
+type capturingWriter struct {
+	*utils.ProxyWriter
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (w *capturingWriter) Write(buf []byte) (int, error) {
+	if !w.overflow {
+		if int64(w.buf.Len()+len(buf)) > w.limit {
+			w.overflow = true
+			w.buf.Reset()
+		} else {
+			w.buf.Write(buf)
+		}
+	}
+	return w.ProxyWriter.Write(buf)
+}
+
+func defaultStaleCacheKey(req *http.Request) string {
+	if req.Method != http.MethodGet {
+		return ""
+	}
+	return req.Host + req.URL.RequestURI()
+}
+
+const (
+	defaultStaleCacheSize     = 1000
+	defaultStaleCacheBodySize = 1024 * 1024
+)
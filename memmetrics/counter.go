@@ -7,6 +7,9 @@ import (
 	"github.com/mailgun/timetools"
 )
 
+// minResolution is the most precise resolution of the counter
+const minResolution = 10 * time.Millisecond
+
 type rcOptSetter func(*RollingCounter) error
 
 func CounterClock(c timetools.TimeProvider) rcOptSetter {
@@ -28,13 +31,14 @@ type RollingCounter struct {
 
 // NewCounter creates a counter with fixed amount of buckets that are rotated every resolution period.
 // E.g. 10 buckets with 1 second means that every new second the bucket is refreshed, so it maintains 10 second rolling window.
-// By default creates a bucket with 10 buckets and 1 second resolution
+// By default creates a bucket with 10 buckets and 1 second resolution, the resolution can be less than a second,
+// e.g. 10 buckets with 100 milliseconds maintain 1 second rolling window.
 func NewCounter(buckets int, resolution time.Duration, options ...rcOptSetter) (*RollingCounter, error) {
 	if buckets <= 0 {
 		return nil, fmt.Errorf("Buckets should be >= 0")
 	}
-	if resolution < time.Second {
-		return nil, fmt.Errorf("Resolution should be larger than a second")
+	if resolution < minResolution {
+		return nil, fmt.Errorf("Resolution should be at least %v", minResolution)
 	}
 
 	rc := &RollingCounter{
@@ -130,16 +134,16 @@ func (c *RollingCounter) incBucketValue(v int) {
 
 // Returns the number in the moving window bucket that this slot occupies
 func (c *RollingCounter) getBucket(t time.Time) int {
-	return int(t.Truncate(c.resolution).Unix() % int64(len(c.values)))
+	return int(t.UnixNano() / int64(c.resolution) % int64(len(c.values)))
 }
 
 // Reset buckets that were not updated
 func (c *RollingCounter) cleanup() {
 	now := c.clock.UtcNow()
 	for i := 0; i < len(c.values); i++ {
-		now = now.Add(time.Duration(-1*i) * c.resolution)
-		if now.Truncate(c.resolution).After(c.lastUpdated.Truncate(c.resolution)) {
-			c.values[c.getBucket(now)] = 0
+		t := now.Add(time.Duration(-1*i) * c.resolution)
+		if t.Truncate(c.resolution).After(c.lastUpdated.Truncate(c.resolution)) {
+			c.values[c.getBucket(t)] = 0
 		} else {
 			break
 		}
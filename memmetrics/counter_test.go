@@ -32,3 +32,22 @@ func (s *CounterSuite) TestCloneExpired(c *C) {
 	out := cnt.Clone()
 	c.Assert(out.Count(), Equals, int64(2))
 }
+
+func (s *CounterSuite) TestSubSecondResolution(c *C) {
+	cnt, err := NewCounter(10, 100*time.Millisecond, CounterClock(s.clock))
+	c.Assert(err, IsNil)
+	c.Assert(cnt.WindowSize(), Equals, time.Second)
+
+	for i := 0; i < 5; i++ {
+		cnt.Inc(1)
+		s.clock.Sleep(100 * time.Millisecond)
+	}
+	c.Assert(cnt.Count(), Equals, int64(5))
+
+	// the values recorded more than a second ago leave the window
+	s.clock.Sleep(700 * time.Millisecond)
+	c.Assert(cnt.Count(), Equals, int64(2))
+
+	_, err = NewCounter(10, time.Microsecond)
+	c.Assert(err, NotNil)
+}
@@ -39,6 +39,11 @@ func (h *HDRHistogram) LatencyAtQuantile(q float64) time.Duration {
 	return time.Duration(h.ValueAtQuantile(q)) * time.Microsecond
 }
 
+// Returns mean latency with microsecond precision
+func (h *HDRHistogram) LatencyMean() time.Duration {
+	return time.Duration(h.h.Mean() * float64(time.Microsecond))
+}
+
 // Records latencies with microsecond precision
 func (h *HDRHistogram) RecordLatencies(d time.Duration, n int64) error {
 	return h.RecordValues(int64(d/time.Microsecond), n)
@@ -88,6 +93,12 @@ type RollingHDRHistogram struct {
 }
 
 func NewRollingHDRHistogram(low, high int64, sigfigs int, period time.Duration, bucketCount int, options ...rhOptSetter) (*RollingHDRHistogram, error) {
+	if bucketCount <= 0 {
+		return nil, fmt.Errorf("bucket count should be > 0, got %v", bucketCount)
+	}
+	if period <= 0 {
+		return nil, fmt.Errorf("period should be > 0, got %v", period)
+	}
 	rh := &RollingHDRHistogram{
 		bucketCount: bucketCount,
 		period:      period,
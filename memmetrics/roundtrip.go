@@ -1,7 +1,9 @@
 package memmetrics
 
 import (
+	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/mailgun/timetools"
@@ -11,8 +13,10 @@ import (
 // such as round trip latency, response codes counters network error and total requests.
 // all counters are collected as rolling window counters with defined precision, histograms
 // are a rolling window histograms with defined precision as well.
-// See RTOptions for more detail on parameters.
+// See RTOptions for more detail on parameters. RTMetrics is safe for concurrent use.
 type RTMetrics struct {
+	// mtx guards the counters and the histogram, even reading the counters rotates their buckets
+	mtx         *sync.Mutex
 	total       *RollingCounter
 	netErrors   *RollingCounter
 	statusCodes map[int]*RollingCounter
@@ -43,6 +47,34 @@ func RTHistogram(new NewRollingHistogramFn) rrOptSetter {
 	}
 }
 
+// RTCounterWindow sets the rolling window of the counters, the window has the buckets rotated every resolution period,
+// by default it is 10 buckets of 1 second
+func RTCounterWindow(buckets int, resolution time.Duration) rrOptSetter {
+	return func(r *RTMetrics) error {
+		if _, err := NewCounter(buckets, resolution); err != nil {
+			return err
+		}
+		r.newCounter = func() (*RollingCounter, error) {
+			return NewCounter(buckets, resolution, CounterClock(r.clock))
+		}
+		return nil
+	}
+}
+
+// RTHistogramWindow sets the rolling window of the latency histogram, the window has the buckets rotated every period,
+// by default it is 6 buckets of 10 seconds
+func RTHistogramWindow(buckets int, period time.Duration) rrOptSetter {
+	return func(r *RTMetrics) error {
+		if _, err := NewRollingHDRHistogram(histMin, histMax, histSignificantFigures, period, buckets); err != nil {
+			return err
+		}
+		r.newHist = func() (*RollingHDRHistogram, error) {
+			return NewRollingHDRHistogram(histMin, histMax, histSignificantFigures, period, buckets, RollingClock(r.clock))
+		}
+		return nil
+	}
+}
+
 func RTClock(clock timetools.TimeProvider) rrOptSetter {
 	return func(r *RTMetrics) error {
 		r.clock = clock
@@ -53,6 +85,7 @@ func RTClock(clock timetools.TimeProvider) rrOptSetter {
 // NewRTMetrics returns new instance of metrics collector.
 func NewRTMetrics(settings ...rrOptSetter) (*RTMetrics, error) {
 	m := &RTMetrics{
+		mtx:         &sync.Mutex{},
 		statusCodes: make(map[int]*RollingCounter),
 	}
 	for _, s := range settings {
@@ -99,12 +132,18 @@ func NewRTMetrics(settings ...rrOptSetter) (*RTMetrics, error) {
 }
 
 func (m *RTMetrics) CounterWindowSize() time.Duration {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
 	return m.total.WindowSize()
 }
 
 // GetNetworkErrorRatio calculates the amont of network errors such as time outs and dropped connection
 // that occured in the given time window compared to the total requests count.
 func (m *RTMetrics) NetworkErrorRatio() float64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
 	if m.total.Count() == 0 {
 		return 0
 	}
@@ -113,6 +152,9 @@ func (m *RTMetrics) NetworkErrorRatio() float64 {
 
 // GetResponseCodeRatio calculates ratio of count(startA to endA) / count(startB to endB)
 func (m *RTMetrics) ResponseCodeRatio(startA, endA, startB, endB int) float64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
 	a := int64(0)
 	b := int64(0)
 	for code, v := range m.statusCodes {
@@ -130,6 +172,14 @@ func (m *RTMetrics) ResponseCodeRatio(startA, endA, startB, endB int) float64 {
 }
 
 func (m *RTMetrics) Append(other *RTMetrics) error {
+	if m == other {
+		return fmt.Errorf("can not append the metrics to themselves")
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	other.mtx.Lock()
+	defer other.mtx.Unlock()
+
 	if err := m.total.Append(other.total); err != nil {
 		return err
 	}
@@ -152,27 +202,64 @@ func (m *RTMetrics) Append(other *RTMetrics) error {
 	return m.histogram.Append(other.histogram)
 }
 
+// Clone returns the copy of the metrics that is not affected by the further updates
+func (m *RTMetrics) Clone() (*RTMetrics, error) {
+	out, err := NewRTMetrics(RTCounter(m.newCounter), RTHistogram(m.newHist), RTClock(m.clock))
+	if err != nil {
+		return nil, err
+	}
+	if err := out.Append(m); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (m *RTMetrics) Record(code int, duration time.Duration) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.recordCode(code)
+	m.recordLatency(duration)
+}
+
+// RecordCode records the response that has no round trip latency, e.g. the request rejected
+// before it has reached the upstream, only the counters are updated and the histogram is not
+func (m *RTMetrics) RecordCode(code int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.recordCode(code)
+}
+
+func (m *RTMetrics) recordCode(code int) {
 	m.total.Inc(1)
 	if code == http.StatusGatewayTimeout || code == http.StatusBadGateway {
 		m.netErrors.Inc(1)
 	}
 	m.recordStatusCode(code)
-	m.recordLatency(duration)
 }
 
 // GetTotalCount returns total count of processed requests collected.
 func (m *RTMetrics) TotalCount() int64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
 	return m.total.Count()
 }
 
 // GetNetworkErrorCount returns total count of processed requests observed
 func (m *RTMetrics) NetworkErrorCount() int64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
 	return m.netErrors.Count()
 }
 
 // GetStatusCodesCounts returns map with counts of the response codes
 func (m *RTMetrics) StatusCodesCounts() map[int]int64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
 	sc := make(map[int]int64)
 	for k, v := range m.statusCodes {
 		if v.Count() != 0 {
@@ -184,10 +271,16 @@ func (m *RTMetrics) StatusCodesCounts() map[int]int64 {
 
 // GetLatencyHistogram computes and returns resulting histogram with latencies observed.
 func (m *RTMetrics) LatencyHistogram() (*HDRHistogram, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
 	return m.histogram.Merged()
 }
 
 func (m *RTMetrics) Reset() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
 	m.histogram.Reset()
 	m.total.Reset()
 	m.netErrors.Reset()
@@ -19,6 +19,24 @@ func (s *RRSuite) SetUpSuite(c *C) {
 	}
 }
 
+func (s *RRSuite) TestRecordCode(c *C) {
+	rr, err := NewRTMetrics(RTClock(s.tm))
+	c.Assert(err, IsNil)
+
+	rr.Record(200, time.Second)
+	rr.RecordCode(503)
+	rr.RecordCode(502)
+
+	c.Assert(rr.TotalCount(), Equals, int64(3))
+	c.Assert(rr.NetworkErrorCount(), Equals, int64(1))
+	c.Assert(rr.StatusCodesCounts(), DeepEquals, map[int]int64{200: 1, 502: 1, 503: 1})
+
+	// the codes without latency do not affect the quantiles
+	h, err := rr.LatencyHistogram()
+	c.Assert(err, IsNil)
+	c.Assert(int(h.LatencyAtQuantile(50)/time.Second), Equals, 1)
+}
+
 func (s *RRSuite) TestDefaults(c *C) {
 	rr, err := NewRTMetrics(RTClock(s.tm))
 	c.Assert(err, IsNil)
@@ -79,3 +97,41 @@ func (s *RRSuite) TestAppend(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(int(h.LatencyAtQuantile(100)/time.Second), Equals, 3)
 }
+
+func (s *RRSuite) TestClone(c *C) {
+	rr, err := NewRTMetrics(RTClock(s.tm))
+	c.Assert(err, IsNil)
+
+	rr.Record(200, time.Second)
+	rr.Record(502, 2*time.Second)
+
+	clone, err := rr.Clone()
+	c.Assert(err, IsNil)
+	rr.Reset()
+
+	c.Assert(clone.TotalCount(), Equals, int64(2))
+	c.Assert(clone.NetworkErrorCount(), Equals, int64(1))
+	c.Assert(clone.StatusCodesCounts(), DeepEquals, map[int]int64{200: 1, 502: 1})
+
+	h, err := clone.LatencyHistogram()
+	c.Assert(err, IsNil)
+	c.Assert(int(h.LatencyAtQuantile(100)/time.Second), Equals, 2)
+}
+
+func (s *RRSuite) TestWindows(c *C) {
+	rr, err := NewRTMetrics(RTClock(s.tm), RTCounterWindow(5, 100*time.Millisecond), RTHistogramWindow(2, time.Second))
+	c.Assert(err, IsNil)
+	c.Assert(rr.CounterWindowSize(), Equals, 500*time.Millisecond)
+
+	rr.Record(502, time.Second)
+	c.Assert(rr.NetworkErrorRatio(), Equals, 1.0)
+
+	s.tm.Sleep(600 * time.Millisecond)
+	c.Assert(rr.TotalCount(), Equals, int64(0))
+	c.Assert(rr.NetworkErrorRatio(), Equals, 0.0)
+
+	_, err = NewRTMetrics(RTCounterWindow(0, time.Second))
+	c.Assert(err, NotNil)
+	_, err = NewRTMetrics(RTHistogramWindow(2, 0))
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,353 @@
+package roundrobin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Authorizer decides whether the request to the admin API is allowed, the request is rejected
+// with 401 if Authorize returns error
+type Authorizer interface {
+	Authorize(req *http.Request) error
+}
+
+// AuthorizerFunc adapts the function to the Authorizer interface
+type AuthorizerFunc func(req *http.Request) error
+
+// Authorize calls f(req)
+func (f AuthorizerFunc) Authorize(req *http.Request) error {
+	return f(req)
+}
+
+// BasicAuthorizer allows the requests with the basic auth credentials
+func BasicAuthorizer(username, password string) Authorizer {
+	return AuthorizerFunc(func(req *http.Request) error {
+		auth, err := utils.ParseAuthHeader(req.Header.Get("Authorization"))
+		if err != nil {
+			return err
+		}
+		userOK := subtle.ConstantTimeCompare([]byte(auth.Username), []byte(username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(auth.Password), []byte(password)) == 1
+		if !userOK || !passOK {
+			return fmt.Errorf("bad credentials")
+		}
+		return nil
+	})
+}
+
+// AdminOption provides options for the admin API
+type AdminOption func(*Admin) error
+
+// AdminBalancer exposes the load balancer, RoundRobin or Rebalancer, under the name
+func AdminBalancer(name string, lb adminTarget) AdminOption {
+	return func(a *Admin) error {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("balancer name should be non empty and have no slashes, got %q", name)
+		}
+		if lb == nil {
+			return fmt.Errorf("balancer %v can not be nil", name)
+		}
+		if _, ok := a.balancers[name]; ok {
+			return fmt.Errorf("balancer %v is already exposed", name)
+		}
+		a.balancers[name] = lb
+		return nil
+	}
+}
+
+// AdminAuthorizer sets the authorizer every request is checked with, it is required as the admin API
+// changes the servers in rotation, use AuthorizerFunc returning nil to allow all requests explicitly
+func AdminAuthorizer(auth Authorizer) AdminOption {
+	return func(a *Admin) error {
+		if auth == nil {
+			return fmt.Errorf("authorizer can not be nil")
+		}
+		a.authorizer = auth
+		return nil
+	}
+}
+
+// adminTarget is a load balancer managed by the admin API
+type adminTarget interface {
+	Snapshot() []ServerSnapshot
+	UpsertServer(u *url.URL, options ...ServerOption) error
+	RemoveServer(u *url.URL) error
+	Drain(u *url.URL, timeout time.Duration, listener DrainListener) error
+}
+
+// Admin is the HTTP handler that lets operators manage the load balancers at runtime:
+//
+//	GET    /balancers                      names of the balancers
+//	GET    /balancers/<name>/servers       servers with their weights, ratings and health
+//	PUT    /balancers/<name>/servers       upsert the server, e.g. {"url": "http://10.0.0.1", "weight": 2},
+//	                                       the fields missing in the body keep their current values
+//	DELETE /balancers/<name>/servers?url=  remove the server
+//	POST   /balancers/<name>/drain         drain the server in the background, e.g. {"url": "http://10.0.0.1", "timeout": "30s"}
+//
+// Mount it with http.StripPrefix to serve it under the prefix.
+type Admin struct {
+	balancers  map[string]adminTarget
+	authorizer Authorizer
+}
+
+// NewAdmin returns the admin API handler for the balancers
+func NewAdmin(opts ...AdminOption) (*Admin, error) {
+	a := &Admin{balancers: make(map[string]adminTarget)}
+	for _, o := range opts {
+		if err := o(a); err != nil {
+			return nil, err
+		}
+	}
+	if a.authorizer == nil {
+		return nil, fmt.Errorf("authorizer is required, set it with AdminAuthorizer")
+	}
+	return a, nil
+}
+
+type adminServer struct {
+	URL             string            `json:"url"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Weight          int               `json:"weight"`
+	EffectiveWeight float64           `json:"effective_weight"`
+	Rating          float64           `json:"rating"`
+	Priority        int               `json:"priority"`
+	Region          string            `json:"region,omitempty"`
+	Zone            string            `json:"zone,omitempty"`
+	Healthy         bool              `json:"healthy"`
+	Ejected         bool              `json:"ejected"`
+	Draining        bool              `json:"draining"`
+	InFlight        int64             `json:"in_flight"`
+}
+
+// adminUpsert is the body of the upsert request, the fields are pointers to tell the missing ones apart
+type adminUpsert struct {
+	URL      string             `json:"url"`
+	Weight   *int               `json:"weight"`
+	Priority *int               `json:"priority"`
+	Region   *string            `json:"region"`
+	Zone     *string            `json:"zone"`
+	Labels   *map[string]string `json:"labels"`
+}
+
+// target merges the body into the current server, the new server gets the defaults for the missing fields
+func (b adminUpsert) target(lb adminTarget) (Target, error) {
+	u, err := adminURL(b.URL)
+	if err != nil {
+		return Target{}, err
+	}
+	t := Target{URL: u}
+	if s := findSnapshot(lb, u); s != nil {
+		t = Target{URL: u, Weight: s.Weight, Priority: s.Priority, Region: s.Region, Zone: s.Zone, Labels: s.Labels}
+	}
+	if b.Weight != nil {
+		t.Weight = *b.Weight
+	}
+	if b.Priority != nil {
+		t.Priority = *b.Priority
+	}
+	if b.Region != nil {
+		t.Region = *b.Region
+	}
+	if b.Zone != nil {
+		t.Zone = *b.Zone
+	}
+	if b.Labels != nil {
+		t.Labels = *b.Labels
+	}
+	if t.Weight < 0 || t.Priority < 0 {
+		return Target{}, fmt.Errorf("weight and priority of %v should be >= 0", b.URL)
+	}
+	return t, nil
+}
+
+type adminDrain struct {
+	URL     string `json:"url"`
+	Timeout string `json:"timeout"`
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := a.authorizer.Authorize(req); err != nil {
+		writeAdminError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) == 1 && parts[0] == "balancers" {
+		if req.Method != http.MethodGet {
+			writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v is not allowed", req.Method))
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, a.names())
+		return
+	}
+	if len(parts) != 3 || parts[0] != "balancers" {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("%v not found", req.URL.Path))
+		return
+	}
+
+	lb, ok := a.balancers[parts[1]]
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("balancer %v not found", parts[1]))
+		return
+	}
+
+	switch {
+	case parts[2] == "servers" && req.Method == http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, adminServers(lb))
+	case parts[2] == "servers" && req.Method == http.MethodPut:
+		a.upsertServer(w, req, lb)
+	case parts[2] == "servers" && req.Method == http.MethodDelete:
+		a.removeServer(w, req, lb)
+	case parts[2] == "drain" && req.Method == http.MethodPost:
+		a.drainServer(w, req, lb)
+	case parts[2] == "servers" || parts[2] == "drain":
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v is not allowed", req.Method))
+	default:
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("%v not found", req.URL.Path))
+	}
+}
+
+func (a *Admin) names() []string {
+	names := make([]string, 0, len(a.balancers))
+	for name := range a.balancers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (a *Admin) upsertServer(w http.ResponseWriter, req *http.Request, lb adminTarget) {
+	var body adminUpsert
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxAdminBodyBytes)).Decode(&body); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	t, err := body.target(lb)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := lb.UpsertServer(t.URL, t.options()...); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	log.Infof("vulcand/oxy/roundrobin/admin: upserted %v", t.URL)
+	writeAdminJSON(w, http.StatusOK, adminServers(lb))
+}
+
+func (a *Admin) removeServer(w http.ResponseWriter, req *http.Request, lb adminTarget) {
+	u, err := adminURL(req.URL.Query().Get("url"))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := lb.RemoveServer(u); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	log.Infof("vulcand/oxy/roundrobin/admin: removed %v", u)
+	writeAdminJSON(w, http.StatusOK, adminServers(lb))
+}
+
+func (a *Admin) drainServer(w http.ResponseWriter, req *http.Request, lb adminTarget) {
+	var d adminDrain
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxAdminBodyBytes)).Decode(&d); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	u, err := adminURL(d.URL)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	var timeout time.Duration
+	if d.Timeout != "" {
+		if timeout, err = time.ParseDuration(d.Timeout); err != nil || timeout < 0 {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("bad drain timeout %q", d.Timeout))
+			return
+		}
+	}
+	if !hasServer(lb, u) {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("server %v not found", u))
+		return
+	}
+
+	go func() {
+		if err := lb.Drain(u, timeout, nil); err != nil {
+			log.Errorf("vulcand/oxy/roundrobin/admin: failed to drain %v: %v", u, err)
+			return
+		}
+		log.Infof("vulcand/oxy/roundrobin/admin: drained %v", u)
+	}()
+	writeAdminJSON(w, http.StatusAccepted, adminServers(lb))
+}
+
+func adminServers(lb adminTarget) []adminServer {
+	snapshot := lb.Snapshot()
+	out := make([]adminServer, len(snapshot))
+	for i, s := range snapshot {
+		out[i] = adminServer{
+			URL:             s.URL.String(),
+			Labels:          s.Labels,
+			Weight:          s.Weight,
+			EffectiveWeight: s.EffectiveWeight,
+			Rating:          s.Rating,
+			Priority:        s.Priority,
+			Region:          s.Region,
+			Zone:            s.Zone,
+			Healthy:         s.Healthy,
+			Ejected:         s.Ejected,
+			Draining:        s.Draining,
+			InFlight:        s.InFlight,
+		}
+	}
+	return out
+}
+
+func hasServer(lb adminTarget, u *url.URL) bool {
+	return findSnapshot(lb, u) != nil
+}
+
+func findSnapshot(lb adminTarget, u *url.URL) *ServerSnapshot {
+	for _, s := range lb.Snapshot() {
+		if sameURL(s.URL, u) {
+			return &s
+		}
+	}
+	return nil
+}
+
+func adminURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("server url should have scheme and host, got %q", raw)
+	}
+	return u, nil
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("vulcand/oxy/roundrobin/admin: failed to write response: %v", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, code int, err error) {
+	writeAdminJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// maxAdminBodyBytes limits the request bodies, the bodies are small JSON objects
+const maxAdminBodyBytes = 1 << 20
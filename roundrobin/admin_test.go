@@ -0,0 +1,223 @@
+package roundrobin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+
+	. "gopkg.in/check.v1"
+)
+
+type AdminSuite struct{}
+
+var _ = Suite(&AdminSuite{})
+
+var allowAll = AdminAuthorizer(AuthorizerFunc(func(*http.Request) error { return nil }))
+
+func adminDo(c *C, h http.Handler, method, path, body string, auth *utils.BasicAuth) (int, string) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if auth != nil {
+		req.Header.Set("Authorization", auth.String())
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Code, w.Body.String()
+}
+
+func adminDecode(c *C, body string) []adminServer {
+	var out []adminServer
+	c.Assert(json.Unmarshal([]byte(body), &out), IsNil)
+	return out
+}
+
+func (s *AdminSuite) TestServers(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000"), Weight(2)), IsNil)
+
+	admin, err := NewAdmin(AdminBalancer("web", lb), allowAll)
+	c.Assert(err, IsNil)
+
+	code, body := adminDo(c, admin, http.MethodGet, "/balancers", "", nil)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(strings.TrimSpace(body), Equals, `["web"]`)
+
+	code, body = adminDo(c, admin, http.MethodGet, "/balancers/web/servers", "", nil)
+	c.Assert(code, Equals, http.StatusOK)
+	servers := adminDecode(c, body)
+	c.Assert(len(servers), Equals, 1)
+	c.Assert(servers[0].URL, Equals, "http://localhost:5000")
+	c.Assert(servers[0].Weight, Equals, 2)
+	c.Assert(servers[0].Healthy, Equals, true)
+
+	code, body = adminDo(c, admin, http.MethodPut, "/balancers/web/servers",
+		`{"url": "http://localhost:5001", "weight": 3, "zone": "a", "labels": {"version": "v2"}}`, nil)
+	c.Assert(code, Equals, http.StatusOK)
+	servers = adminDecode(c, body)
+	c.Assert(len(servers), Equals, 2)
+	c.Assert(servers[1].Weight, Equals, 3)
+	c.Assert(servers[1].Zone, Equals, "a")
+	c.Assert(servers[1].Labels, DeepEquals, map[string]string{"version": "v2"})
+
+	code, body = adminDo(c, admin, http.MethodDelete, "/balancers/web/servers?url=http://localhost:5000", "", nil)
+	c.Assert(code, Equals, http.StatusOK)
+	servers = adminDecode(c, body)
+	c.Assert(len(servers), Equals, 1)
+	c.Assert(servers[0].URL, Equals, "http://localhost:5001")
+
+	code, _ = adminDo(c, admin, http.MethodDelete, "/balancers/web/servers?url=http://localhost:5000", "", nil)
+	c.Assert(code, Equals, http.StatusNotFound)
+
+	code, _ = adminDo(c, admin, http.MethodPut, "/balancers/web/servers", `{"url": "localhost"}`, nil)
+	c.Assert(code, Equals, http.StatusBadRequest)
+
+	code, _ = adminDo(c, admin, http.MethodGet, "/balancers/api/servers", "", nil)
+	c.Assert(code, Equals, http.StatusNotFound)
+
+	code, _ = adminDo(c, admin, http.MethodPost, "/balancers/web/servers", "", nil)
+	c.Assert(code, Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *AdminSuite) TestUpdateWeight(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000"),
+		Weight(2), Priority(1), Locality("us", "a"), Labels(map[string]string{"version": "v2"})), IsNil)
+
+	admin, err := NewAdmin(AdminBalancer("web", lb), allowAll)
+	c.Assert(err, IsNil)
+
+	// the fields missing in the body are not reset
+	code, body := adminDo(c, admin, http.MethodPut, "/balancers/web/servers", `{"url": "http://localhost:5000", "weight": 5}`, nil)
+	c.Assert(code, Equals, http.StatusOK)
+	servers := adminDecode(c, body)
+	c.Assert(len(servers), Equals, 1)
+	c.Assert(servers[0].Weight, Equals, 5)
+	c.Assert(servers[0].Priority, Equals, 1)
+	c.Assert(servers[0].Region, Equals, "us")
+	c.Assert(servers[0].Zone, Equals, "a")
+	c.Assert(servers[0].Labels, DeepEquals, map[string]string{"version": "v2"})
+
+	code, body = adminDo(c, admin, http.MethodPut, "/balancers/web/servers", `{"url": "http://localhost:5000", "zone": "b"}`, nil)
+	c.Assert(code, Equals, http.StatusOK)
+	servers = adminDecode(c, body)
+	c.Assert(servers[0].Weight, Equals, 5)
+	c.Assert(servers[0].Region, Equals, "us")
+	c.Assert(servers[0].Zone, Equals, "b")
+
+	code, _ = adminDo(c, admin, http.MethodPut, "/balancers/web/servers", `{"url": "http://localhost:5000", "weight": -1}`, nil)
+	c.Assert(code, Equals, http.StatusBadRequest)
+}
+
+func (s *AdminSuite) TestDrain(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000")), IsNil)
+
+	admin, err := NewAdmin(AdminBalancer("web", lb), allowAll)
+	c.Assert(err, IsNil)
+
+	code, _ := adminDo(c, admin, http.MethodPost, "/balancers/web/drain", `{"url": "http://localhost:5000", "timeout": "1s"}`, nil)
+	c.Assert(code, Equals, http.StatusAccepted)
+
+	for i := 0; len(lb.Servers()) != 0; i++ {
+		c.Assert(i < 100, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	code, _ = adminDo(c, admin, http.MethodPost, "/balancers/web/drain", `{"url": "http://localhost:5000"}`, nil)
+	c.Assert(code, Equals, http.StatusNotFound)
+
+	code, _ = adminDo(c, admin, http.MethodPost, "/balancers/web/drain", `{"url": "http://localhost:5000", "timeout": "soon"}`, nil)
+	c.Assert(code, Equals, http.StatusBadRequest)
+}
+
+func (s *AdminSuite) TestRebalancerRatings(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+	rb, err := NewRebalancer(lb)
+	c.Assert(err, IsNil)
+
+	admin, err := NewAdmin(AdminBalancer("web", rb), allowAll)
+	c.Assert(err, IsNil)
+
+	code, body := adminDo(c, admin, http.MethodPut, "/balancers/web/servers", `{"url": "http://localhost:5000", "weight": 2}`, nil)
+	c.Assert(code, Equals, http.StatusOK)
+	servers := adminDecode(c, body)
+	c.Assert(len(servers), Equals, 1)
+	c.Assert(servers[0].Weight, Equals, 2)
+	c.Assert(servers[0].Rating, Equals, 0.0)
+	c.Assert(len(rb.Servers()), Equals, 1)
+}
+
+func (s *AdminSuite) TestAuthorizer(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	admin, err := NewAdmin(AdminBalancer("web", lb), AdminAuthorizer(BasicAuthorizer("admin", "secret")))
+	c.Assert(err, IsNil)
+
+	code, _ := adminDo(c, admin, http.MethodGet, "/balancers", "", nil)
+	c.Assert(code, Equals, http.StatusUnauthorized)
+
+	code, _ = adminDo(c, admin, http.MethodGet, "/balancers", "", &utils.BasicAuth{Username: "admin", Password: "oops"})
+	c.Assert(code, Equals, http.StatusUnauthorized)
+
+	code, _ = adminDo(c, admin, http.MethodGet, "/balancers", "", &utils.BasicAuth{Username: "admin", Password: "secret"})
+	c.Assert(code, Equals, http.StatusOK)
+
+	// read only access
+	readOnly := AuthorizerFunc(func(req *http.Request) error {
+		if req.Method != http.MethodGet {
+			return http.ErrNotSupported
+		}
+		return nil
+	})
+	admin, err = NewAdmin(AdminBalancer("web", lb), AdminAuthorizer(readOnly))
+	c.Assert(err, IsNil)
+
+	code, _ = adminDo(c, admin, http.MethodPut, "/balancers/web/servers", `{"url": "http://localhost:5000"}`, nil)
+	c.Assert(code, Equals, http.StatusUnauthorized)
+	c.Assert(len(lb.Servers()), Equals, 0)
+}
+
+func (s *AdminSuite) TestBadOptions(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	_, err = NewAdmin(AdminBalancer("", lb), allowAll)
+	c.Assert(err, NotNil)
+	_, err = NewAdmin(AdminBalancer("a/b", lb), allowAll)
+	c.Assert(err, NotNil)
+	_, err = NewAdmin(AdminBalancer("web", nil), allowAll)
+	c.Assert(err, NotNil)
+	_, err = NewAdmin(AdminBalancer("web", lb), AdminBalancer("web", lb), allowAll)
+	c.Assert(err, NotNil)
+
+	// the admin API is never left open by mistake
+	_, err = NewAdmin(AdminBalancer("web", lb))
+	c.Assert(err, NotNil)
+	_, err = NewAdmin(AdminBalancer("web", lb), AdminAuthorizer(nil))
+	c.Assert(err, NotNil)
+}
+
+func (s *AdminSuite) TestBodyLimit(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	admin, err := NewAdmin(AdminBalancer("web", lb), allowAll)
+	c.Assert(err, IsNil)
+
+	labels := `{"big": "` + strings.Repeat("a", maxAdminBodyBytes) + `"}`
+	code, _ := adminDo(c, admin, http.MethodPut, "/balancers/web/servers", `{"url": "http://localhost:5000", "labels": `+labels+`}`, nil)
+	c.Assert(code, Equals, http.StatusBadRequest)
+	c.Assert(len(lb.Servers()), Equals, 0)
+
+	code, _ = adminDo(c, admin, http.MethodPost, "/balancers/web/drain", `{"url": "http://localhost:5000", "timeout": "`+strings.Repeat("1", maxAdminBodyBytes)+`"}`, nil)
+	c.Assert(code, Equals, http.StatusBadRequest)
+}
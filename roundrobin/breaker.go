@@ -0,0 +1,68 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/vulcand/oxy/cbreaker"
+)
+
+// ServerCircuitBreakers gives every server of the load balancer its own circuit breaker with the condition
+// and the options, see cbreaker.New. Servers with tripped breakers are skipped while their peers keep serving,
+// the breaker fallback is not used, the requests are sent to the other servers instead.
+func ServerCircuitBreakers(expression string, options ...cbreaker.CircuitBreakerOption) LBOption {
+	return func(s *RoundRobin) error {
+		// fail early on the bad expression or options
+		if _, err := cbreaker.New(nil, expression, options...); err != nil {
+			return err
+		}
+		s.newBreaker = func() (*cbreaker.CircuitBreaker, error) {
+			return cbreaker.New(nil, expression, options...)
+		}
+		return nil
+	}
+}
+
+// ServerCircuitBreakersFallback sets the handler that serves the requests when the breakers of all servers
+// are tripped, by default the load balancer responds with 503
+func ServerCircuitBreakersFallback(h http.Handler) LBOption {
+	return func(s *RoundRobin) error {
+		s.breakersFallback = h
+		return nil
+	}
+}
+
+// errAllServersTripped is returned by NextServer when the circuit breakers of all servers in rotation are tripped
+var errAllServersTripped = fmt.Errorf("circuit breakers of all servers are tripped")
+
+// allowed tells whether the circuit breaker of the server lets the request through
+func (s *server) allowed() bool {
+	return s.breaker == nil || s.breaker.Allow()
+}
+
+// allowedURL tells whether the circuit breaker of the server with the URL lets the request through
+func (rr *RoundRobin) allowedURL(u *url.URL) bool {
+	rr.mutex.Lock()
+	s, _ := rr.findServerByURL(u)
+	rr.mutex.Unlock()
+
+	return s == nil || s.allowed()
+}
+
+// allowedURL tells whether the circuit breaker of the server lets the request through, if the next load balancer has breakers
+func (rb *Rebalancer) allowedURL(u *url.URL) bool {
+	if rr, ok := rb.next.(*RoundRobin); ok {
+		return rr.allowedURL(u)
+	}
+	return true
+}
+
+func (rr *RoundRobin) serveAllTripped(w http.ResponseWriter, req *http.Request) {
+	if rr.breakersFallback != nil {
+		rr.breakersFallback.ServeHTTP(w, req)
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+}
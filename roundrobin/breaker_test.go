@@ -0,0 +1,170 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/cbreaker"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type BreakerSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&BreakerSuite{})
+
+func (s *BreakerSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+// codeHandler responds with the status code set for the host of the request URL
+type codeHandler map[string]int
+
+func (h codeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(h[req.URL.Host])
+	w.Write([]byte(req.URL.Host))
+}
+
+func (s *BreakerSuite) newLB(c *C, codes codeHandler, opts ...LBOption) *RoundRobin {
+	opts = append([]LBOption{
+		ServerCircuitBreakers(`NetworkErrorRatio() > 0.5`,
+			cbreaker.Clock(s.clock), cbreaker.FallbackDuration(10*time.Second), cbreaker.RecoveryDuration(10*time.Second)),
+	}, opts...)
+	lb, err := New(codes, opts...)
+	c.Assert(err, IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://a")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://b")), IsNil)
+	return lb
+}
+
+// serve sends the requests in the test goroutine, as the frozen clock is not safe for concurrent use
+func serve(h http.Handler, n int) []string {
+	var out []string
+	for i := 0; i < n; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code == http.StatusOK || w.Code == http.StatusBadGateway {
+			out = append(out, w.Body.String())
+		} else {
+			out = append(out, http.StatusText(w.Code))
+		}
+	}
+	return out
+}
+
+func (s *BreakerSuite) TestTrippedServerIsSkipped(c *C) {
+	codes := codeHandler{"a": http.StatusBadGateway, "b": http.StatusOK}
+	lb := s.newLB(c, codes)
+
+	// a trips on the first error, b keeps serving
+	c.Assert(serve(lb, 4), DeepEquals, []string{"a", "b", "b", "b"})
+
+	u, err := lb.NextServer()
+	c.Assert(err, IsNil)
+	c.Assert(u.Host, Equals, "b")
+
+	// a recovers once the fallback and recovery durations pass
+	codes["a"] = http.StatusOK
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(11 * time.Second)
+	serve(lb, 2)
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(11 * time.Second)
+	counts := map[string]int{}
+	for _, host := range serve(lb, 4) {
+		counts[host]++
+	}
+	c.Assert(counts, DeepEquals, map[string]int{"a": 2, "b": 2})
+}
+
+// The breakers record the responses of the concurrent requests, run with -race to catch unguarded metrics
+func (s *BreakerSuite) TestParallelTraffic(c *C) {
+	codes := codeHandler{"a": http.StatusBadGateway, "b": http.StatusOK}
+	// the requests are slowed down, so they are in flight at the same time
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(time.Millisecond)
+		codes.ServeHTTP(w, req)
+	})
+	lb, err := New(handler, ServerCircuitBreakers(`NetworkErrorRatio() > 0.5 || LatencyAtQuantileMS(50.0) > 1000`))
+	c.Assert(err, IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://a")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://b")), IsNil)
+
+	results := make(chan int, 400)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				w := httptest.NewRecorder()
+				lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+				results <- w.Code
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	counts := map[int]int{}
+	for code := range results {
+		counts[code]++
+	}
+	// a trips quickly, so most of the requests are served by b
+	c.Assert(counts[http.StatusOK] > counts[http.StatusBadGateway], Equals, true)
+	c.Assert(counts[http.StatusOK]+counts[http.StatusBadGateway], Equals, 400)
+}
+
+func (s *BreakerSuite) TestAllTripped(c *C) {
+	codes := codeHandler{"a": http.StatusBadGateway, "b": http.StatusBadGateway}
+	lb := s.newLB(c, codes)
+
+	c.Assert(serve(lb, 4), DeepEquals, []string{"a", "b", "Service Unavailable", "Service Unavailable"})
+
+	_, err := lb.NextServer()
+	c.Assert(err, Equals, errAllServersTripped)
+
+	teapot := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	lb = s.newLB(c, codes, ServerCircuitBreakersFallback(teapot))
+	c.Assert(serve(lb, 3), DeepEquals, []string{"a", "b", "I'm a teapot"})
+}
+
+func (s *BreakerSuite) TestRebalancer(c *C) {
+	codes := codeHandler{"a": http.StatusBadGateway, "b": http.StatusBadGateway}
+	lb := s.newLB(c, codes)
+
+	rb, err := NewRebalancer(lb)
+	c.Assert(err, IsNil)
+
+	c.Assert(serve(rb, 3), DeepEquals, []string{"a", "b", "Service Unavailable"})
+}
+
+func (s *BreakerSuite) TestRetriesSkipTrippedServers(c *C) {
+	codes := codeHandler{"a": http.StatusBadGateway, "b": http.StatusOK}
+	lb := s.newLB(c, codes)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://c")), IsNil)
+	codes["c"] = http.StatusOK
+
+	c.Assert(serve(lb, 1), DeepEquals, []string{"a"})
+
+	// b is excluded and a is tripped
+	for i := 0; i < 3; i++ {
+		u, err := lb.NextServerExcept([]*url.URL{testutils.ParseURI("http://b")})
+		c.Assert(err, IsNil)
+		c.Assert(u.Host, Equals, "c")
+	}
+}
+
+func (s *BreakerSuite) TestBadExpression(c *C) {
+	_, err := New(nil, ServerCircuitBreakers(`Oops()`))
+	c.Assert(err, NotNil)
+}
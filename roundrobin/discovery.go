@@ -0,0 +1,291 @@
+package roundrobin
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Target is the server found by the discovery Provider
+type Target struct {
+	URL *url.URL
+	// Weight of the server, the default weight is used if 0
+	Weight   int
+	Priority int
+	Region   string
+	Zone     string
+	Labels   map[string]string
+	// SlowStart is the slow start window of the server, the server keeps its current window if 0
+	SlowStart time.Duration
+}
+
+// Provider returns the servers the load balancer should have
+type Provider interface {
+	Targets(ctx context.Context) ([]Target, error)
+}
+
+// ProviderFunc adapts the function to the Provider interface
+type ProviderFunc func(ctx context.Context) ([]Target, error)
+
+// Targets calls f(ctx)
+func (f ProviderFunc) Targets(ctx context.Context) ([]Target, error) {
+	return f(ctx)
+}
+
+// DiscoveryOption provides options for the discovery
+type DiscoveryOption func(*Discovery) error
+
+// DiscoveryInterval sets how often the provider is polled
+func DiscoveryInterval(interval time.Duration) DiscoveryOption {
+	return func(d *Discovery) error {
+		if interval <= 0 {
+			return fmt.Errorf("interval should be > 0, got %v", interval)
+		}
+		d.interval = interval
+		return nil
+	}
+}
+
+// DiscoveryClock sets the clock used to schedule the polls, intended for tests
+func DiscoveryClock(clock timetools.TimeProvider) DiscoveryOption {
+	return func(d *Discovery) error {
+		d.clock = clock
+		return nil
+	}
+}
+
+// DiscoveryDrain makes the discovery drain the servers that are gone from the provider instead of removing
+// them right away, see RoundRobin.Drain for the meaning of the timeout
+func DiscoveryDrain(timeout time.Duration) DiscoveryOption {
+	return func(d *Discovery) error {
+		if timeout < 0 {
+			return fmt.Errorf("drain timeout should be >= 0, got %v", timeout)
+		}
+		d.drain = true
+		d.drainTimeout = timeout
+		return nil
+	}
+}
+
+// discoveryTarget is a load balancer the servers are added to and removed from
+type discoveryTarget interface {
+	Servers() []*url.URL
+	UpsertServer(u *url.URL, options ...ServerOption) error
+	RemoveServer(u *url.URL) error
+}
+
+// drainer is implemented by the load balancers that can drain servers
+type drainer interface {
+	Drain(u *url.URL, timeout time.Duration, listener DrainListener) error
+}
+
+// Discovery keeps the servers of the load balancer in sync with the provider. The load balancer
+// gets exactly the servers the provider returns, servers added by other means are removed on sync.
+// If the provider fails, the load balancer keeps its current servers.
+type Discovery struct {
+	mtx      *sync.Mutex
+	target   discoveryTarget
+	provider Provider
+
+	interval     time.Duration
+	clock        timetools.TimeProvider
+	drain        bool
+	drainTimeout time.Duration
+
+	// targets applied to the load balancer by URL
+	applied map[string]Target
+	// servers being drained, they are not touched until the drain completes
+	draining map[string]bool
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewDiscovery returns discovery that syncs the load balancer with the provider, call Start to begin polling
+func NewDiscovery(target discoveryTarget, provider Provider, opts ...DiscoveryOption) (*Discovery, error) {
+	if target == nil {
+		return nil, fmt.Errorf("load balancer can not be nil")
+	}
+	if provider == nil {
+		return nil, fmt.Errorf("provider can not be nil")
+	}
+	d := &Discovery{
+		mtx:      &sync.Mutex{},
+		target:   target,
+		provider: provider,
+		interval: defaultDiscoveryInterval,
+		applied:  make(map[string]Target),
+		draining: make(map[string]bool),
+	}
+	for _, o := range opts {
+		if err := o(d); err != nil {
+			return nil, err
+		}
+	}
+	if d.clock == nil {
+		d.clock = &timetools.RealTime{}
+	}
+	if d.drain {
+		if _, ok := target.(drainer); !ok {
+			return nil, fmt.Errorf("load balancer does not support draining")
+		}
+	}
+	return d, nil
+}
+
+// Start syncs the load balancer in the background, right away and then every interval
+func (d *Discovery) Start() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.stop != nil {
+		return
+	}
+	d.stop = make(chan struct{})
+	d.stopped = make(chan struct{})
+	go d.run(d.stop, d.stopped)
+}
+
+// Stop stops syncing the load balancer, servers being drained keep draining
+func (d *Discovery) Stop() {
+	d.mtx.Lock()
+	stop, stopped := d.stop, d.stopped
+	d.stop, d.stopped = nil, nil
+	d.mtx.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-stopped
+}
+
+func (d *Discovery) run(stop, stopped chan struct{}) {
+	defer close(stopped)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		if err := d.Sync(ctx); err != nil {
+			log.Errorf("vulcand/oxy/roundrobin/discovery: failed to sync servers: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-d.clock.After(d.interval):
+		}
+	}
+}
+
+// Sync fetches the targets from the provider and applies the difference to the load balancer
+func (d *Discovery) Sync(ctx context.Context) error {
+	targets, err := d.provider.Targets(ctx)
+	if err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	wanted := make(map[string]Target, len(targets))
+	for _, t := range targets {
+		if t.URL == nil {
+			return fmt.Errorf("target URL can not be nil")
+		}
+		wanted[serverKey(t.URL)] = t
+	}
+
+	servers := d.target.Servers()
+	present := make(map[string]bool, len(servers))
+	for _, u := range servers {
+		present[serverKey(u)] = true
+	}
+	// servers removed by other means are upserted again
+	for key := range d.applied {
+		if !present[key] {
+			delete(d.applied, key)
+		}
+	}
+
+	for _, u := range servers {
+		key := serverKey(u)
+		if _, ok := wanted[key]; ok || d.draining[key] {
+			continue
+		}
+		delete(d.applied, key)
+		d.removeServer(utils.CopyURL(u))
+	}
+
+	for key, t := range wanted {
+		// the server is added back once the drain completes
+		if d.draining[key] {
+			continue
+		}
+		if prev, ok := d.applied[key]; ok && reflect.DeepEqual(prev, t) {
+			continue
+		}
+		if err := d.target.UpsertServer(t.URL, t.options()...); err != nil {
+			log.Errorf("vulcand/oxy/roundrobin/discovery: failed to upsert %v: %v", t.URL, err)
+			continue
+		}
+		d.applied[key] = t
+	}
+	return nil
+}
+
+// removeServer removes or drains the server, should be called with the lock held
+func (d *Discovery) removeServer(u *url.URL) {
+	if !d.drain {
+		if err := d.target.RemoveServer(u); err != nil {
+			log.Errorf("vulcand/oxy/roundrobin/discovery: failed to remove %v: %v", u, err)
+		}
+		return
+	}
+	key := serverKey(u)
+	d.draining[key] = true
+	go func() {
+		if err := d.target.(drainer).Drain(u, d.drainTimeout, nil); err != nil {
+			log.Errorf("vulcand/oxy/roundrobin/discovery: failed to drain %v: %v", u, err)
+		}
+		d.mtx.Lock()
+		delete(d.draining, key)
+		d.mtx.Unlock()
+	}()
+}
+
+// IsDraining tells whether the server removed by the discovery is still draining
+func (d *Discovery) IsDraining(u *url.URL) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	return d.draining[serverKey(u)]
+}
+
+func (t Target) options() []ServerOption {
+	weight := t.Weight
+	if weight == 0 {
+		weight = defaultWeight
+	}
+	options := []ServerOption{Weight(weight), Priority(t.Priority), Locality(t.Region, t.Zone), Labels(t.Labels)}
+	if t.SlowStart > 0 {
+		options = append(options, SlowStart(t.SlowStart))
+	}
+	return options
+}
+
+const defaultDiscoveryInterval = 30 * time.Second
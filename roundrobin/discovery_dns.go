@@ -0,0 +1,155 @@
+package roundrobin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Resolver looks up the DNS records, *net.Resolver implements it. A net.Resolver with a custom Dial
+// can be used to query the particular DNS server.
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSOption provides options for the DNS provider
+type DNSOption func(*DNSProvider) error
+
+// DNSResolver sets the resolver, net.DefaultResolver is used by default
+func DNSResolver(r Resolver) DNSOption {
+	return func(p *DNSProvider) error {
+		if r == nil {
+			return fmt.Errorf("resolver can not be nil")
+		}
+		p.resolver = r
+		return nil
+	}
+}
+
+// DNSScheme sets the scheme of the server URLs, http by default
+func DNSScheme(scheme string) DNSOption {
+	return func(p *DNSProvider) error {
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("scheme should be http or https, got %q", scheme)
+		}
+		p.scheme = scheme
+		return nil
+	}
+}
+
+// DNSPort sets the port of the servers found by A and AAAA records, the default port of the scheme by default
+func DNSPort(port int) DNSOption {
+	return func(p *DNSProvider) error {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("port should be in [1, 65535], got %d", port)
+		}
+		p.port = port
+		return nil
+	}
+}
+
+// DNSNetwork restricts A and AAAA lookups, "ip4" looks up A records only, "ip6" AAAA records only
+// and "ip", the default, both
+func DNSNetwork(network string) DNSOption {
+	return func(p *DNSProvider) error {
+		if network != "ip" && network != "ip4" && network != "ip6" {
+			return fmt.Errorf("network should be ip, ip4 or ip6, got %q", network)
+		}
+		p.network = network
+		return nil
+	}
+}
+
+// DNSSRV makes the provider look up the SRV records _service._proto.name instead of A and AAAA records,
+// if both service and proto are empty, the name is looked up as is. Targets get their weight
+// and priority from the records.
+func DNSSRV(service, proto string) DNSOption {
+	return func(p *DNSProvider) error {
+		p.srv = true
+		p.service = service
+		p.proto = proto
+		return nil
+	}
+}
+
+// DNSProvider finds the servers by looking up A, AAAA or SRV records of the name
+type DNSProvider struct {
+	name     string
+	resolver Resolver
+	scheme   string
+	port     int
+	network  string
+
+	srv     bool
+	service string
+	proto   string
+}
+
+// NewDNSProvider returns provider that looks up the servers in DNS
+func NewDNSProvider(name string, opts ...DNSOption) (*DNSProvider, error) {
+	if name == "" {
+		return nil, fmt.Errorf("name can not be empty")
+	}
+	p := &DNSProvider{
+		name:     name,
+		resolver: net.DefaultResolver,
+		scheme:   "http",
+		network:  "ip",
+	}
+	for _, o := range opts {
+		if err := o(p); err != nil {
+			return nil, err
+		}
+	}
+	if p.port == 0 {
+		p.port = 80
+		if p.scheme == "https" {
+			p.port = 443
+		}
+	}
+	return p, nil
+}
+
+// Targets looks up the records and returns the servers sorted by URL
+func (p *DNSProvider) Targets(ctx context.Context) ([]Target, error) {
+	var targets []Target
+	if p.srv {
+		_, records, err := p.resolver.LookupSRV(ctx, p.service, p.proto, p.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			weight := int(r.Weight)
+			// weight 0 is the lowest weight in SRV, but the default one in the load balancer
+			if weight == 0 {
+				weight = 1
+			}
+			targets = append(targets, Target{
+				URL:      p.url(strings.TrimSuffix(r.Target, "."), int(r.Port)),
+				Weight:   weight,
+				Priority: int(r.Priority),
+			})
+		}
+	} else {
+		ips, err := p.resolver.LookupIP(ctx, p.network, p.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			targets = append(targets, Target{URL: p.url(ip.String(), p.port)})
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].URL.String() < targets[j].URL.String()
+	})
+	return targets, nil
+}
+
+func (p *DNSProvider) url(host string, port int) *url.URL {
+	return &url.URL{Scheme: p.scheme, Host: net.JoinHostPort(host, strconv.Itoa(port))}
+}
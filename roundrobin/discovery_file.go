@@ -0,0 +1,130 @@
+package roundrobin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileProvider reads the servers from the JSON file. The file is read again only when it changes,
+// so it is watched by polling it with Discovery:
+//
+//	{"servers": [{
+//		"url": "http://10.0.0.1:8080",
+//		"weight": 2,
+//		"priority": 0,
+//		"region": "us-east-1",
+//		"zone": "us-east-1a",
+//		"labels": {"version": "v2"},
+//		"slow_start": "30s"
+//	}]}
+type FileProvider struct {
+	mtx  *sync.Mutex
+	path string
+
+	modTime time.Time
+	size    int64
+	targets []Target
+}
+
+type fileConfig struct {
+	Servers []serverSpec `json:"servers"`
+}
+
+// serverSpec describes the server in the file
+type serverSpec struct {
+	URL      string            `json:"url"`
+	Weight   int               `json:"weight"`
+	Priority int               `json:"priority"`
+	Region   string            `json:"region"`
+	Zone     string            `json:"zone"`
+	Labels   map[string]string `json:"labels"`
+	// SlowStart is the slow start window, e.g. "30s"
+	SlowStart string `json:"slow_start"`
+}
+
+// NewFileProvider returns provider that reads the servers from the file
+func NewFileProvider(path string) (*FileProvider, error) {
+	if path == "" {
+		return nil, fmt.Errorf("path can not be empty")
+	}
+	return &FileProvider{mtx: &sync.Mutex{}, path: path}, nil
+}
+
+// Targets returns the servers listed in the file
+func (p *FileProvider) Targets(ctx context.Context) ([]Target, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		return nil, err
+	}
+	if p.targets != nil && fi.ModTime().Equal(p.modTime) && fi.Size() == p.size {
+		return p.targets, nil
+	}
+
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := parseTargets(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", p.path, err)
+	}
+	p.modTime, p.size, p.targets = fi.ModTime(), fi.Size(), targets
+	return targets, nil
+}
+
+func parseTargets(data []byte) ([]Target, error) {
+	var cfg fileConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	targets := make([]Target, 0, len(cfg.Servers))
+	for _, s := range cfg.Servers {
+		t, err := s.target()
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+func (s serverSpec) target() (Target, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return Target{}, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return Target{}, fmt.Errorf("server url should have scheme and host, got %q", s.URL)
+	}
+	if s.Weight < 0 || s.Priority < 0 {
+		return Target{}, fmt.Errorf("weight and priority of %v should be >= 0", s.URL)
+	}
+	var slowStart time.Duration
+	if s.SlowStart != "" {
+		if slowStart, err = time.ParseDuration(s.SlowStart); err != nil {
+			return Target{}, err
+		}
+		if slowStart < 0 {
+			return Target{}, fmt.Errorf("slow start window of %v should be >= 0", s.URL)
+		}
+	}
+	return Target{
+		URL:       u,
+		Weight:    s.Weight,
+		Priority:  s.Priority,
+		Region:    s.Region,
+		Zone:      s.Zone,
+		Labels:    s.Labels,
+		SlowStart: slowStart,
+	}, nil
+}
@@ -0,0 +1,319 @@
+package roundrobin
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type DiscoverySuite struct{}
+
+var _ = Suite(&DiscoverySuite{})
+
+// staticProvider returns the targets set by the test
+type staticProvider struct {
+	mtx     sync.Mutex
+	targets []Target
+	err     error
+}
+
+func (p *staticProvider) set(targets []Target, err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.targets, p.err = targets, err
+}
+
+func (p *staticProvider) Targets(ctx context.Context) ([]Target, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.targets, p.err
+}
+
+func targets(urls ...string) []Target {
+	out := make([]Target, len(urls))
+	for i, u := range urls {
+		out[i] = Target{URL: testutils.ParseURI(u)}
+	}
+	return out
+}
+
+func serverStrings(urls []*url.URL) []string {
+	out := make([]string, len(urls))
+	for i, u := range urls {
+		out[i] = u.String()
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (s *DiscoverySuite) TestSync(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:4000")), IsNil)
+
+	p := &staticProvider{}
+	p.set(targets("http://localhost:5000", "http://localhost:5001"), nil)
+
+	d, err := NewDiscovery(lb, p)
+	c.Assert(err, IsNil)
+
+	c.Assert(d.Sync(context.Background()), IsNil)
+	c.Assert(serverStrings(lb.Servers()), DeepEquals, []string{"http://localhost:5000", "http://localhost:5001"})
+
+	t := targets("http://localhost:5001", "http://localhost:5002")
+	t[0].Weight = 3
+	p.set(t, nil)
+	c.Assert(d.Sync(context.Background()), IsNil)
+	c.Assert(serverStrings(lb.Servers()), DeepEquals, []string{"http://localhost:5001", "http://localhost:5002"})
+
+	w, _ := lb.ServerWeight(testutils.ParseURI("http://localhost:5001"))
+	c.Assert(w, Equals, 3)
+
+	// servers are kept when the provider fails
+	p.set(nil, fmt.Errorf("oops"))
+	c.Assert(d.Sync(context.Background()), NotNil)
+	c.Assert(len(lb.Servers()), Equals, 2)
+
+	// servers removed by other means are added back
+	c.Assert(lb.RemoveServer(testutils.ParseURI("http://localhost:5002")), IsNil)
+	p.set(t, nil)
+	c.Assert(d.Sync(context.Background()), IsNil)
+	c.Assert(serverStrings(lb.Servers()), DeepEquals, []string{"http://localhost:5001", "http://localhost:5002"})
+}
+
+func (s *DiscoverySuite) TestSyncRebalancer(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+	rb, err := NewRebalancer(lb)
+	c.Assert(err, IsNil)
+
+	p := &staticProvider{}
+	p.set(targets("http://localhost:5000", "http://localhost:5001"), nil)
+
+	d, err := NewDiscovery(rb, p)
+	c.Assert(err, IsNil)
+	c.Assert(d.Sync(context.Background()), IsNil)
+	c.Assert(serverStrings(rb.Servers()), DeepEquals, []string{"http://localhost:5000", "http://localhost:5001"})
+
+	p.set(targets("http://localhost:5001"), nil)
+	c.Assert(d.Sync(context.Background()), IsNil)
+	c.Assert(serverStrings(rb.Servers()), DeepEquals, []string{"http://localhost:5001"})
+	c.Assert(serverStrings(lb.Servers()), DeepEquals, []string{"http://localhost:5001"})
+}
+
+func (s *DiscoverySuite) TestDrain(c *C) {
+	a, unblock := newBlockingServer("a")
+	defer a.Close()
+	unblocked := false
+	defer func() {
+		if !unblocked {
+			close(unblock)
+		}
+	}()
+	u := testutils.ParseURI(a.URL)
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	p := &staticProvider{}
+	p.set(targets(a.URL), nil)
+
+	d, err := NewDiscovery(lb, p, DiscoveryDrain(0))
+	c.Assert(err, IsNil)
+	c.Assert(d.Sync(context.Background()), IsNil)
+
+	done := make(chan struct{})
+	go func() {
+		testutils.Get(proxy.URL)
+		close(done)
+	}()
+	waitInFlight(c, lb, u, 1)
+
+	// the server is drained and is not added back until the drain completes
+	p.set(nil, nil)
+	c.Assert(d.Sync(context.Background()), IsNil)
+	c.Assert(d.IsDraining(u), Equals, true)
+
+	p.set(targets(a.URL), nil)
+	c.Assert(d.Sync(context.Background()), IsNil)
+	for i := 0; !lb.Snapshot()[0].Draining; i++ {
+		c.Assert(i < 100, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(len(lb.Servers()), Equals, 1)
+
+	unblocked = true
+	close(unblock)
+	<-done
+	for i := 0; d.IsDraining(u); i++ {
+		c.Assert(i < 100, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(len(lb.Servers()), Equals, 0)
+
+	c.Assert(d.Sync(context.Background()), IsNil)
+	c.Assert(serverStrings(lb.Servers()), DeepEquals, []string{a.URL})
+}
+
+func (s *DiscoverySuite) TestStartStop(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	synced := make(chan struct{}, 1)
+	p := ProviderFunc(func(ctx context.Context) ([]Target, error) {
+		select {
+		case synced <- struct{}{}:
+		default:
+		}
+		return targets("http://localhost:5000"), nil
+	})
+
+	d, err := NewDiscovery(lb, p, DiscoveryInterval(time.Hour))
+	c.Assert(err, IsNil)
+	d.Start()
+	<-synced
+	d.Stop()
+	c.Assert(serverStrings(lb.Servers()), DeepEquals, []string{"http://localhost:5000"})
+}
+
+func (s *DiscoverySuite) TestBadOptions(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+	p := &staticProvider{}
+
+	_, err = NewDiscovery(nil, p)
+	c.Assert(err, NotNil)
+	_, err = NewDiscovery(lb, nil)
+	c.Assert(err, NotNil)
+	_, err = NewDiscovery(lb, p, DiscoveryInterval(0))
+	c.Assert(err, NotNil)
+	_, err = NewDiscovery(lb, p, DiscoveryDrain(-1))
+	c.Assert(err, NotNil)
+}
+
+func (s *DiscoverySuite) TestFileProvider(c *C) {
+	dir, err := ioutil.TempDir("", "discovery")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "servers.json")
+	c.Assert(ioutil.WriteFile(path, []byte(`{"servers": [
+		{"url": "http://localhost:5000", "weight": 2, "priority": 1, "region": "us-east-1", "zone": "us-east-1a", "labels": {"version": "v2"}, "slow_start": "30s"}
+	]}`), 0600), IsNil)
+
+	p, err := NewFileProvider(path)
+	c.Assert(err, IsNil)
+
+	t, err := p.Targets(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(t, DeepEquals, []Target{{
+		URL:       testutils.ParseURI("http://localhost:5000"),
+		Weight:    2,
+		Priority:  1,
+		Region:    "us-east-1",
+		Zone:      "us-east-1a",
+		Labels:    map[string]string{"version": "v2"},
+		SlowStart: 30 * time.Second,
+	}})
+
+	c.Assert(ioutil.WriteFile(path, []byte(`{"servers": [{"url": "localhost"}]}`), 0600), IsNil)
+	c.Assert(os.Chtimes(path, time.Now(), time.Now().Add(time.Second)), IsNil)
+	_, err = p.Targets(context.Background())
+	c.Assert(err, NotNil)
+
+	c.Assert(ioutil.WriteFile(path, []byte(`{"servers": [{"url": "http://localhost:5000", "slow_start": "soon"}]}`), 0600), IsNil)
+	c.Assert(os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)), IsNil)
+	_, err = p.Targets(context.Background())
+	c.Assert(err, NotNil)
+
+	p, err = NewFileProvider(filepath.Join(dir, "missing.json"))
+	c.Assert(err, IsNil)
+	_, err = p.Targets(context.Background())
+	c.Assert(err, NotNil)
+}
+
+func (s *DiscoverySuite) TestDNSProviderA(c *C) {
+	p, err := NewDNSProvider("backends.oxy.test", DNSResolver(stubResolver{}), DNSNetwork("ip4"), DNSPort(8080))
+	c.Assert(err, IsNil)
+
+	t, err := p.Targets(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(t, DeepEquals, targets("http://10.0.0.1:8080", "http://10.0.0.2:8080"))
+
+	p, err = NewDNSProvider("backends.oxy.test", DNSResolver(stubResolver{}), DNSNetwork("ip6"), DNSScheme("https"))
+	c.Assert(err, IsNil)
+
+	t, err = p.Targets(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(t, DeepEquals, targets("https://[fd00::1]:443"))
+}
+
+func (s *DiscoverySuite) TestDNSProviderSRV(c *C) {
+	p, err := NewDNSProvider("backends.oxy.test", DNSResolver(stubResolver{}), DNSSRV("http", "tcp"))
+	c.Assert(err, IsNil)
+
+	t, err := p.Targets(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(t, DeepEquals, []Target{
+		{URL: testutils.ParseURI("http://a.oxy.test:5000"), Weight: 10, Priority: 0},
+		{URL: testutils.ParseURI("http://b.oxy.test:5001"), Weight: 1, Priority: 1},
+	})
+}
+
+func (s *DiscoverySuite) TestDNSProviderBadOptions(c *C) {
+	_, err := NewDNSProvider("")
+	c.Assert(err, NotNil)
+	_, err = NewDNSProvider("oxy.test", DNSScheme("ftp"))
+	c.Assert(err, NotNil)
+	_, err = NewDNSProvider("oxy.test", DNSPort(0))
+	c.Assert(err, NotNil)
+	_, err = NewDNSProvider("oxy.test", DNSNetwork("tcp"))
+	c.Assert(err, NotNil)
+	_, err = NewDNSProvider("oxy.test", DNSResolver(nil))
+	c.Assert(err, NotNil)
+}
+
+// stubResolver answers the lookups for backends.oxy.test
+type stubResolver struct{}
+
+func (stubResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if host != "backends.oxy.test" {
+		return nil, fmt.Errorf("no such host %v", host)
+	}
+	switch network {
+	case "ip4":
+		return []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1")}, nil
+	case "ip6":
+		return []net.IP{net.ParseIP("fd00::1")}, nil
+	}
+	return []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}, nil
+}
+
+func (stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if service != "http" || proto != "tcp" || name != "backends.oxy.test" {
+		return "", nil, fmt.Errorf("no such host _%v._%v.%v", service, proto, name)
+	}
+	return "_http._tcp.backends.oxy.test.", []*net.SRV{
+		{Target: "b.oxy.test.", Port: 5001, Priority: 1, Weight: 0},
+		{Target: "a.oxy.test.", Port: 5000, Priority: 0, Weight: 10},
+	}, nil
+}
@@ -0,0 +1,79 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// DrainStatus reports progress of draining the server
+type DrainStatus struct {
+	URL *url.URL
+	// InFlight is the amount of requests the server is still processing
+	InFlight int64
+	// Done is set on the last status, after the server has been removed from the load balancer
+	Done bool
+	// TimedOut is set if the server has been removed with requests still in flight
+	TimedOut bool
+}
+
+// DrainListener is notified every time the amount of requests in flight on the draining server changes
+type DrainListener func(DrainStatus)
+
+// inflightHandler sits between the load balancer and the next handler, counts requests in flight per server
+// and records the server metrics
+type inflightHandler struct {
+	lb *RoundRobin
+}
+
+func (h *inflightHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	srv := h.lb.acquire(req.URL)
+	if srv == nil {
+		h.lb.next.ServeHTTP(w, req)
+		return
+	}
+	if !h.lb.serverMetrics && srv.breaker == nil {
+		defer h.lb.release(srv, 0, 0)
+		h.lb.next.ServeHTTP(w, req)
+		return
+	}
+	pw := &utils.ProxyWriter{W: w}
+	start := h.lb.clock.UtcNow()
+	defer func() {
+		h.lb.release(srv, pw.StatusCode(), h.lb.clock.UtcNow().Sub(start))
+	}()
+	h.lb.next.ServeHTTP(pw, req)
+}
+
+// drainWait blocks until the server has no requests in flight or the timeout expires, timeout 0 means no timeout.
+// It returns the amount of requests still in flight.
+func drainWait(clock timetools.TimeProvider, u *url.URL, timeout time.Duration, inflight func() int64, released <-chan struct{}, listener DrainListener) int64 {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = clock.After(timeout)
+	}
+	last := int64(-1)
+	for {
+		n := inflight()
+		if n != last && listener != nil {
+			listener(DrainStatus{URL: utils.CopyURL(u), InFlight: n})
+		}
+		last = n
+		if n == 0 {
+			return 0
+		}
+		select {
+		case <-released:
+		case <-deadline:
+			n = inflight()
+			if n != 0 {
+				log.Warningf("vulcand/oxy/roundrobin/drain: timed out draining %v with %d requests in flight", u, n)
+			}
+			return n
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type DrainSuite struct{}
+
+var _ = Suite(&DrainSuite{})
+
+func (s *DrainSuite) TestDrainWaitsForRequests(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b, unblock := newBlockingServer("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI(b.URL)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL)), IsNil)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	// the first request goes to b and blocks there
+	inflight := make(chan string)
+	go func() {
+		_, body, _ := testutils.Get(proxy.URL)
+		inflight <- string(body)
+	}()
+	waitInFlight(c, lb, testutils.ParseURI(b.URL), 1)
+
+	statuses := &drainStatuses{}
+	drained := make(chan error)
+	go func() {
+		drained <- lb.Drain(testutils.ParseURI(b.URL), 0, statuses.add)
+	}()
+
+	// new requests are not sent to the draining server
+	for i := 0; i < 100 && len(statuses.get()) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(seq(c, proxy.URL, 3), DeepEquals, []string{"a", "a", "a"})
+
+	select {
+	case <-drained:
+		c.Fatalf("server is drained with requests in flight")
+	default:
+	}
+
+	close(unblock)
+	c.Assert(<-inflight, Equals, "b")
+	c.Assert(<-drained, IsNil)
+
+	c.Assert(len(lb.Servers()), Equals, 1)
+	c.Assert(lb.Servers()[0].String(), Equals, a.URL)
+
+	out := statuses.get()
+	c.Assert(len(out), Equals, 3)
+	c.Assert(out[0].InFlight, Equals, int64(1))
+	c.Assert(out[1].InFlight, Equals, int64(0))
+	c.Assert(out[2].Done, Equals, true)
+	c.Assert(out[2].TimedOut, Equals, false)
+}
+
+func (s *DrainSuite) TestDrainTimeout(c *C) {
+	b, unblock := newBlockingServer("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	lb, err := New(fwd, RoundRobinClock(clock))
+	c.Assert(err, IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(b.URL)), IsNil)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+	// unblock the request before closing the servers, they wait for active connections
+	defer close(unblock)
+
+	go testutils.Get(proxy.URL)
+	waitInFlight(c, lb, testutils.ParseURI(b.URL), 1)
+
+	statuses := &drainStatuses{}
+	c.Assert(lb.Drain(testutils.ParseURI(b.URL), time.Minute, statuses.add), IsNil)
+	c.Assert(len(lb.Servers()), Equals, 0)
+
+	out := statuses.get()
+	last := out[len(out)-1]
+	c.Assert(last.Done, Equals, true)
+	c.Assert(last.TimedOut, Equals, true)
+	c.Assert(last.InFlight, Equals, int64(1))
+}
+
+func (s *DrainSuite) TestDrainIdleServer(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000")), IsNil)
+	c.Assert(lb.Drain(testutils.ParseURI("http://localhost:5000"), time.Second, nil), IsNil)
+	c.Assert(len(lb.Servers()), Equals, 0)
+
+	c.Assert(lb.Drain(testutils.ParseURI("http://localhost:5000"), time.Second, nil), NotNil)
+}
+
+func (s *DrainSuite) TestRebalancerDrain(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b, unblock := newBlockingServer("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+	// the requests in flight are tracked internally, the next handler is the one the load balancer was given
+	c.Assert(lb.Next(), Equals, http.Handler(fwd))
+
+	rb, err := NewRebalancer(lb)
+	c.Assert(err, IsNil)
+
+	c.Assert(rb.UpsertServer(testutils.ParseURI(b.URL)), IsNil)
+	c.Assert(rb.UpsertServer(testutils.ParseURI(a.URL)), IsNil)
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	inflight := make(chan string)
+	go func() {
+		_, body, _ := testutils.Get(proxy.URL)
+		inflight <- string(body)
+	}()
+	waitInFlight(c, lb, testutils.ParseURI(b.URL), 1)
+
+	drained := make(chan error)
+	go func() {
+		drained <- rb.Drain(testutils.ParseURI(b.URL), 0, nil)
+	}()
+	for i := 0; i < 100 && len(lb.enabledServers()) != 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(seq(c, proxy.URL, 3), DeepEquals, []string{"a", "a", "a"})
+
+	close(unblock)
+	c.Assert(<-inflight, Equals, "b")
+	c.Assert(<-drained, IsNil)
+
+	c.Assert(len(rb.Servers()), Equals, 1)
+	c.Assert(len(rb.servers), Equals, 1)
+	c.Assert(seq(c, proxy.URL, 2), DeepEquals, []string{"a", "a"})
+}
+
+type drainStatuses struct {
+	mtx      sync.Mutex
+	statuses []DrainStatus
+}
+
+func (d *drainStatuses) add(s DrainStatus) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.statuses = append(d.statuses, s)
+}
+
+func (d *drainStatuses) get() []DrainStatus {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return append([]DrainStatus{}, d.statuses...)
+}
+
+// newBlockingServer returns server that responds with body once the returned channel is closed
+func newBlockingServer(body string) (*httptest.Server, chan struct{}) {
+	unblock := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		<-unblock
+		w.Write([]byte(body))
+	})
+	return srv, unblock
+}
+
+// waitInFlight waits until the server has n requests in flight
+func waitInFlight(c *C, lb *RoundRobin, u *url.URL, n int64) {
+	for i := 0; i < 1000; i++ {
+		lb.mutex.Lock()
+		srv, _ := lb.findServerByURL(u)
+		lb.mutex.Unlock()
+		if srv != nil && lb.inflight(srv) == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Fatalf("%v has no %d requests in flight", u, n)
+}
@@ -0,0 +1,527 @@
+package roundrobin
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// HashAlgorithm selects the way HashBalancer maps request keys to the servers
+type HashAlgorithm int
+
+const (
+	// RingHash places every server on the hash ring multiple times (virtual nodes) proportionally to its weight,
+	// the request goes to the first server found clockwise from the hash of the key
+	RingHash HashAlgorithm = iota
+	// MaglevHash builds a lookup table as described in the Google's Maglev paper, that provides even
+	// load distribution and fast constant time lookups at the cost of a slightly higher reshuffling
+	MaglevHash
+)
+
+func (a HashAlgorithm) String() string {
+	switch a {
+	case RingHash:
+		return "ring"
+	case MaglevHash:
+		return "maglev"
+	}
+	return "undefined"
+}
+
+// HashOption provides options for the consistent hashing load balancer
+type HashOption func(*HashBalancer) error
+
+// HashRing selects ring hash algorithm, replicas is the amount of virtual nodes placed on the ring
+// for each unit of the server weight
+func HashRing(replicas int) HashOption {
+	return func(h *HashBalancer) error {
+		if replicas <= 0 {
+			return fmt.Errorf("replicas should be > 0, got %d", replicas)
+		}
+		h.algorithm = RingHash
+		h.replicas = replicas
+		return nil
+	}
+}
+
+// HashMaglev selects maglev algorithm, tableSize is the size of the lookup table,
+// it should be a prime number much larger than the expected amount of servers
+func HashMaglev(tableSize int) HashOption {
+	return func(h *HashBalancer) error {
+		if !isPrime(tableSize) {
+			return fmt.Errorf("table size should be a prime number, got %d", tableSize)
+		}
+		h.algorithm = MaglevHash
+		h.tableSize = tableSize
+		return nil
+	}
+}
+
+// HashBoundedLoad enables consistent hashing with bounded loads. Server receives the request
+// only if its amount of in-flight requests stays below factor * average load, otherwise the next server
+// on the ring (or in the lookup table) is tried, what prevents the popular keys from overloading one server.
+func HashBoundedLoad(factor float64) HashOption {
+	return func(h *HashBalancer) error {
+		if factor < 1 {
+			return fmt.Errorf("load factor should be >= 1, got %v", factor)
+		}
+		h.loadFactor = factor
+		return nil
+	}
+}
+
+// HashErrorHandler is a functional argument that sets error handler of the server
+func HashErrorHandler(e utils.ErrorHandler) HashOption {
+	return func(h *HashBalancer) error {
+		h.errHandler = e
+		return nil
+	}
+}
+
+// HashRequestRewriteListener is a functional argument that sets the listener called on every request rewrite
+func HashRequestRewriteListener(rrl RequestRewriteListener) HashOption {
+	return func(h *HashBalancer) error {
+		h.requestRewriteListener = rrl
+		return nil
+	}
+}
+
+// HashBalancer is a consistent hashing load balancer, it forwards the requests with the same key (client ip,
+// header or host as returned by the source extractor) to the same server, and reshuffles
+// only a small portion of keys when servers are added or removed.
+type HashBalancer struct {
+	mutex      *sync.Mutex
+	next       http.Handler
+	errHandler utils.ErrorHandler
+	extract    utils.SourceExtractor
+
+	algorithm HashAlgorithm
+	// virtual nodes per unit of weight, used by ring hash
+	replicas int
+	// lookup table size, used by maglev
+	tableSize int
+	// bounded load factor, 0 means that the load is not bounded
+	loadFactor float64
+
+	servers []*server
+	ring    []ringNode
+	table   []*server
+
+	// share of the total load each server in rotation can take multiplied by the load factor,
+	// computed on rebuild, so the probes of the bounded load do not sum up the weights every time
+	shares map[*server]float64
+
+	// in-flight requests per server and in total, used by bounded load
+	load      map[*server]int64
+	totalLoad int64
+
+	requestRewriteListener RequestRewriteListener
+}
+
+// NewHashBalancer returns a new consistent hashing load balancer that uses extract to get the key from the request
+func NewHashBalancer(next http.Handler, extract utils.SourceExtractor, opts ...HashOption) (*HashBalancer, error) {
+	if extract == nil {
+		return nil, fmt.Errorf("extract function can not be nil")
+	}
+	h := &HashBalancer{
+		mutex:     &sync.Mutex{},
+		next:      next,
+		extract:   extract,
+		algorithm: RingHash,
+		replicas:  defaultHashReplicas,
+		tableSize: defaultMaglevTableSize,
+		load:      make(map[*server]int64),
+	}
+	for _, o := range opts {
+		if err := o(h); err != nil {
+			return nil, err
+		}
+	}
+	if h.errHandler == nil {
+		h.errHandler = utils.DefaultHandler
+	}
+	return h, nil
+}
+
+func (h *HashBalancer) Next() http.Handler {
+	return h.next
+}
+
+func (h *HashBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if log.GetLevel() >= log.DebugLevel {
+		logEntry := log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/roundrobin/hash: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/roundrobin/hash: competed ServeHttp on request")
+	}
+
+	key, _, err := h.extract.Extract(req)
+	if err != nil {
+		log.Errorf("failed to extract hash key of the request: %v", err)
+		h.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	srv, err := h.acquire(key)
+	if err != nil {
+		h.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	defer h.release(srv)
+
+	url := utils.CopyURL(srv.url)
+	if log.GetLevel() >= log.DebugLevel {
+		//log which backend URL we're sending this request to
+		log.WithFields(log.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": url}).Debugf("vulcand/oxy/roundrobin/hash: Forwarding this request to URL")
+	}
+
+	// make shallow copy of request before changing anything to avoid side effects
+	newReq := *req
+	newReq.URL = url
+
+	//Emit event to a listener if one exists
+	if h.requestRewriteListener != nil {
+		h.requestRewriteListener(req, &newReq)
+	}
+
+	h.next.ServeHTTP(w, &newReq)
+}
+
+// ServerForKey returns the server the key is mapped to, ignoring the current load of the servers
+func (h *HashBalancer) ServerForKey(key string) (*url.URL, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	srv, err := h.lookup(key, false)
+	if err != nil {
+		return nil, err
+	}
+	return utils.CopyURL(srv.url), nil
+}
+
+func (h *HashBalancer) acquire(key string) (*server, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	srv, err := h.lookup(key, h.loadFactor != 0)
+	if err != nil {
+		return nil, err
+	}
+	h.load[srv]++
+	h.totalLoad++
+	return srv, nil
+}
+
+func (h *HashBalancer) release(srv *server) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.totalLoad--
+	// server could have been removed or updated while request was in flight
+	if _, ok := h.load[srv]; !ok {
+		return
+	}
+	h.load[srv]--
+}
+
+func (h *HashBalancer) lookup(key string, bounded bool) (*server, error) {
+	if len(h.servers) == 0 {
+		return nil, fmt.Errorf("no servers in the pool")
+	}
+	if len(h.ring) == 0 && len(h.table) == 0 {
+		for _, s := range h.servers {
+			if s.enabled() {
+				return nil, fmt.Errorf("all servers have 0 weight")
+			}
+		}
+		return nil, fmt.Errorf("no healthy servers in the pool")
+	}
+	hash := hashKey(key)
+	if h.algorithm == MaglevHash {
+		return h.lookupTable(hash, bounded), nil
+	}
+	return h.lookupRing(hash, bounded), nil
+}
+
+func (h *HashBalancer) lookupRing(hash uint64, bounded bool) *server {
+	start := sort.Search(len(h.ring), func(i int) bool { return h.ring[i].hash >= hash })
+	if !bounded {
+		return h.ring[start%len(h.ring)].srv
+	}
+	return h.probe(len(h.ring), func(i int) *server { return h.ring[(start+i)%len(h.ring)].srv })
+}
+
+func (h *HashBalancer) lookupTable(hash uint64, bounded bool) *server {
+	start := int(hash % uint64(len(h.table)))
+	if !bounded {
+		return h.table[start]
+	}
+	return h.probe(len(h.table), func(i int) *server { return h.table[(start+i)%len(h.table)] })
+}
+
+// probe walks the slots starting from the one the key is mapped to and returns the first server
+// with the spare capacity, every server is checked once and the walk ends once all of them are checked
+func (h *HashBalancer) probe(slots int, at func(int) *server) *server {
+	first := at(0)
+	checked := make(map[*server]bool, len(h.shares))
+	for i := 0; i < slots && len(checked) < len(h.shares); i++ {
+		srv := at(i)
+		if checked[srv] {
+			continue
+		}
+		if h.hasCapacity(srv) {
+			return srv
+		}
+		checked[srv] = true
+	}
+	return first
+}
+
+// hasCapacity tells whether the server can accept one more request without exceeding
+// its share of the total load multiplied by the load factor
+func (h *HashBalancer) hasCapacity(srv *server) bool {
+	capacity := math.Ceil(h.shares[srv] * float64(h.totalLoad+1))
+	return float64(h.load[srv]) < capacity
+}
+
+func (h *HashBalancer) Servers() []*url.URL {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	out := make([]*url.URL, len(h.servers))
+	for i, srv := range h.servers {
+		out[i] = srv.url
+	}
+	return out
+}
+
+func (h *HashBalancer) ServerWeight(u *url.URL) (int, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if s, _ := h.findServerByURL(u); s != nil {
+		return s.weight, true
+	}
+	return -1, false
+}
+
+// ServerHealth tells whether the server is marked as healthy, see SetServerHealth
+func (h *HashBalancer) ServerHealth(u *url.URL) (bool, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if s, _ := h.findServerByURL(u); s != nil {
+		return !s.unhealthy, true
+	}
+	return false, false
+}
+
+// SetServerHealth takes the unhealthy server off the ring, its keys are spread across the other servers
+// until the server is marked as healthy again
+func (h *HashBalancer) SetServerHealth(u *url.URL, healthy bool) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, _ := h.findServerByURL(u)
+	if s == nil {
+		return fmt.Errorf("server not found")
+	}
+	if s.unhealthy == !healthy {
+		return nil
+	}
+	s.unhealthy = !healthy
+	h.rebuild()
+	return nil
+}
+
+func (h *HashBalancer) RemoveServer(u *url.URL) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	e, index := h.findServerByURL(u)
+	if e == nil {
+		return fmt.Errorf("server not found")
+	}
+	h.servers = append(h.servers[:index], h.servers[index+1:]...)
+	delete(h.load, e)
+	h.rebuild()
+	return nil
+}
+
+// UpsertServer adds the server to the hash ring or updates the weight of the existing one
+func (h *HashBalancer) UpsertServer(u *url.URL, options ...ServerOption) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if u == nil {
+		return fmt.Errorf("server URL can't be nil")
+	}
+
+	if s, _ := h.findServerByURL(u); s != nil {
+		for _, o := range options {
+			if err := o(s); err != nil {
+				return err
+			}
+		}
+		h.rebuild()
+		return nil
+	}
+
+	srv := &server{url: utils.CopyURL(u)}
+	for _, o := range options {
+		if err := o(srv); err != nil {
+			return err
+		}
+	}
+
+	if srv.weight == 0 {
+		srv.weight = defaultWeight
+	}
+
+	h.servers = append(h.servers, srv)
+	h.load[srv] = 0
+	h.rebuild()
+	return nil
+}
+
+func (h *HashBalancer) findServerByURL(u *url.URL) (*server, int) {
+	for i, s := range h.servers {
+		if sameURL(u, s.url) {
+			return s, i
+		}
+	}
+	return nil, -1
+}
+
+func (h *HashBalancer) rebuild() {
+	total := 0
+	for _, s := range h.servers {
+		if s.enabled() {
+			total += s.weight
+		}
+	}
+	h.shares = make(map[*server]float64, len(h.servers))
+	for _, s := range h.servers {
+		if s.enabled() && s.weight > 0 {
+			h.shares[s] = h.loadFactor * float64(s.weight) / float64(total)
+		}
+	}
+
+	if h.algorithm == MaglevHash {
+		h.table = buildMaglevTable(h.servers, h.tableSize)
+	} else {
+		h.ring = buildRing(h.servers, h.replicas)
+	}
+}
+
+type ringNode struct {
+	hash uint64
+	srv  *server
+}
+
+type ringNodes []ringNode
+
+func (r ringNodes) Len() int           { return len(r) }
+func (r ringNodes) Less(i, j int) bool { return r[i].hash < r[j].hash }
+func (r ringNodes) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+func buildRing(servers []*server, replicas int) []ringNode {
+	ring := ringNodes{}
+	for _, s := range servers {
+		if !s.enabled() {
+			continue
+		}
+		name := s.url.String()
+		for i := 0; i < s.weight*replicas; i++ {
+			ring = append(ring, ringNode{hash: hashKey(fmt.Sprintf("%s-%d", name, i)), srv: s})
+		}
+	}
+	sort.Sort(ring)
+	return ring
+}
+
+// buildMaglevTable populates the lookup table by letting servers take turns in claiming their preferred
+// positions, servers with larger weights take more turns in every round.
+func buildMaglevTable(servers []*server, size int) []*server {
+	var enabled []*server
+	for _, s := range servers {
+		if s.enabled() && s.weight > 0 {
+			enabled = append(enabled, s)
+		}
+	}
+	if len(enabled) == 0 {
+		return nil
+	}
+
+	divisor := enabled[0].weight
+	for _, s := range enabled {
+		divisor = gcd(divisor, s.weight)
+	}
+
+	m := uint64(size)
+	offsets := make([]uint64, len(enabled))
+	skips := make([]uint64, len(enabled))
+	next := make([]uint64, len(enabled))
+	for i, s := range enabled {
+		name := s.url.String()
+		offsets[i] = hashKey(name) % m
+		skips[i] = hashKey(name+"#skip")%(m-1) + 1
+	}
+
+	table := make([]*server, size)
+	filled := 0
+	for {
+		for i, s := range enabled {
+			for turn := 0; turn < s.weight/divisor; turn++ {
+				c := (offsets[i] + next[i]*skips[i]) % m
+				for table[c] != nil {
+					next[i]++
+					c = (offsets[i] + next[i]*skips[i]) % m
+				}
+				table[c] = s
+				next[i]++
+				filled++
+				if filled == size {
+					return table
+				}
+			}
+		}
+	}
+}
+
+// hashKey is FNV-1a with the murmur3 finalizer on top of it, the finalizer improves the avalanche
+// of the similar keys, e.g. virtual node names that differ only by the last digits.
+func hashKey(key string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(key))
+	h := f.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func isPrime(n int) bool {
+	if n < 2 {
+		return false
+	}
+	for i := 2; i*i <= n; i++ {
+		if n%i == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	defaultHashReplicas    = 100
+	defaultMaglevTableSize = 65537
+)
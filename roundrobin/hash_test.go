@@ -0,0 +1,238 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+
+	. "gopkg.in/check.v1"
+)
+
+type HashSuite struct{}
+
+var _ = Suite(&HashSuite{})
+
+func (s *HashSuite) TestNoServers(c *C) {
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := NewHashBalancer(fwd, headerExtractor(c, "X-Key"))
+	c.Assert(err, IsNil)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusInternalServerError)
+}
+
+func (s *HashSuite) TestBadOptions(c *C) {
+	_, err := NewHashBalancer(nil, nil)
+	c.Assert(err, NotNil)
+
+	_, err = NewHashBalancer(nil, headerExtractor(c, "X-Key"), HashRing(0))
+	c.Assert(err, NotNil)
+
+	_, err = NewHashBalancer(nil, headerExtractor(c, "X-Key"), HashMaglev(100))
+	c.Assert(err, NotNil)
+
+	_, err = NewHashBalancer(nil, headerExtractor(c, "X-Key"), HashBoundedLoad(0.5))
+	c.Assert(err, NotNil)
+}
+
+func (s *HashSuite) TestSameKeySameServer(c *C) {
+	a, b, d := testutils.NewResponder("a"), testutils.NewResponder("b"), testutils.NewResponder("d")
+	defer a.Close()
+	defer b.Close()
+	defer d.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	for _, opt := range []HashOption{HashRing(defaultHashReplicas), HashMaglev(defaultMaglevTableSize)} {
+		lb, err := NewHashBalancer(fwd, headerExtractor(c, "X-Key"), opt)
+		c.Assert(err, IsNil)
+
+		c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL)), IsNil)
+		c.Assert(lb.UpsertServer(testutils.ParseURI(b.URL)), IsNil)
+		c.Assert(lb.UpsertServer(testutils.ParseURI(d.URL)), IsNil)
+
+		proxy := httptest.NewServer(lb)
+
+		for _, key := range []string{"alice", "bob", "carol"} {
+			out := keySeq(c, proxy.URL, key, 3)
+			c.Assert(out[1], Equals, out[0])
+			c.Assert(out[2], Equals, out[0])
+		}
+		proxy.Close()
+	}
+}
+
+func (s *HashSuite) TestRingMinimalReshuffle(c *C) {
+	lb, err := NewHashBalancer(nil, headerExtractor(c, "X-Key"))
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 4; i++ {
+		c.Assert(lb.UpsertServer(testutils.ParseURI(fmt.Sprintf("http://localhost:%d", 5000+i))), IsNil)
+	}
+	before := mapKeys(c, lb, 1000)
+
+	removed := testutils.ParseURI("http://localhost:5002")
+	c.Assert(lb.RemoveServer(removed), IsNil)
+	after := mapKeys(c, lb, 1000)
+
+	for key, u := range before {
+		if u == removed.String() {
+			c.Assert(after[key], Not(Equals), u)
+			continue
+		}
+		c.Assert(after[key], Equals, u)
+	}
+}
+
+func (s *HashSuite) TestMaglevReshuffle(c *C) {
+	lb, err := NewHashBalancer(nil, headerExtractor(c, "X-Key"), HashMaglev(defaultMaglevTableSize))
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 4; i++ {
+		c.Assert(lb.UpsertServer(testutils.ParseURI(fmt.Sprintf("http://localhost:%d", 5000+i))), IsNil)
+	}
+	before := mapKeys(c, lb, 1000)
+
+	removed := testutils.ParseURI("http://localhost:5002")
+	c.Assert(lb.RemoveServer(removed), IsNil)
+	after := mapKeys(c, lb, 1000)
+
+	moved := 0
+	for key, u := range before {
+		if u != removed.String() && after[key] != u {
+			moved++
+		}
+	}
+	// maglev trades some reshuffling for the even distribution, but it should stay small
+	c.Assert(moved < 50, Equals, true)
+}
+
+func (s *HashSuite) TestWeights(c *C) {
+	for _, opt := range []HashOption{HashRing(defaultHashReplicas), HashMaglev(defaultMaglevTableSize)} {
+		lb, err := NewHashBalancer(nil, headerExtractor(c, "X-Key"), opt)
+		c.Assert(err, IsNil)
+
+		c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000"), Weight(3)), IsNil)
+		c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5001"), Weight(1)), IsNil)
+
+		w, ok := lb.ServerWeight(testutils.ParseURI("http://localhost:5000"))
+		c.Assert(ok, Equals, true)
+		c.Assert(w, Equals, 3)
+
+		counts := map[string]int{}
+		for _, u := range mapKeys(c, lb, 4000) {
+			counts[u]++
+		}
+		heavy := counts["http://localhost:5000"]
+		c.Assert(heavy > 2600 && heavy < 3400, Equals, true, Commentf("got %v", counts))
+	}
+}
+
+func (s *HashSuite) TestBoundedLoad(c *C) {
+	lb, err := NewHashBalancer(nil, headerExtractor(c, "X-Key"), HashBoundedLoad(1.25))
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5001")), IsNil)
+
+	preferred, err := lb.ServerForKey("hot")
+	c.Assert(err, IsNil)
+
+	// the same hot key keeps arriving while the previous requests are still in flight,
+	// bounded load spills it over to the other server instead of piling up on one
+	counts := map[string]int{}
+	for i := 0; i < 10; i++ {
+		srv, err := lb.acquire("hot")
+		c.Assert(err, IsNil)
+		counts[srv.url.String()]++
+	}
+	c.Assert(counts[preferred.String()] < 10, Equals, true)
+	c.Assert(counts[preferred.String()] <= 7, Equals, true)
+
+	// once released, the key goes back to its server
+	for srv := range lb.load {
+		lb.load[srv] = 0
+	}
+	lb.totalLoad = 0
+	srv, err := lb.acquire("hot")
+	c.Assert(err, IsNil)
+	c.Assert(srv.url.String(), Equals, preferred.String())
+}
+
+// The probes stop once every server has been checked instead of walking the whole table
+func (s *HashSuite) TestBoundedLoadProbe(c *C) {
+	lb, err := NewHashBalancer(nil, headerExtractor(c, "X-Key"), HashMaglev(defaultMaglevTableSize), HashBoundedLoad(1))
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000"), Weight(3)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5001")), IsNil)
+	c.Assert(len(lb.shares), Equals, 2)
+
+	// no server has the spare capacity, the key stays with its server
+	for srv := range lb.load {
+		lb.load[srv] = 100
+	}
+	preferred, err := lb.ServerForKey("hot")
+	c.Assert(err, IsNil)
+
+	probes := 0
+	srv := lb.probe(len(lb.table), func(i int) *server {
+		probes++
+		return lb.table[(int(hashKey("hot")%uint64(len(lb.table)))+i)%len(lb.table)]
+	})
+	c.Assert(srv.url.String(), Equals, preferred.String())
+	c.Assert(probes < 100, Equals, true, Commentf("got %v probes", probes))
+
+	// disabled servers take no share of the load
+	c.Assert(lb.SetServerHealth(testutils.ParseURI("http://localhost:5001"), false), IsNil)
+	c.Assert(len(lb.shares), Equals, 1)
+}
+
+func (s *HashSuite) TestAllZeroWeights(c *C) {
+	lb, err := NewHashBalancer(nil, headerExtractor(c, "X-Key"))
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000"), Weight(0)), IsNil)
+
+	_, err = lb.ServerForKey("a")
+	c.Assert(err, NotNil)
+}
+
+func headerExtractor(c *C, header string) utils.SourceExtractor {
+	extract, err := utils.NewExtractor("request.header." + header)
+	c.Assert(err, IsNil)
+	return extract
+}
+
+func mapKeys(c *C, lb *HashBalancer, count int) map[string]string {
+	out := make(map[string]string, count)
+	for i := 0; i < count; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		u, err := lb.ServerForKey(key)
+		c.Assert(err, IsNil)
+		out[key] = u.String()
+	}
+	return out
+}
+
+func keySeq(c *C, url, key string, repeat int) []string {
+	out := []string{}
+	for i := 0; i < repeat; i++ {
+		_, body, err := testutils.Get(url, testutils.Header("X-Key", key))
+		c.Assert(err, IsNil)
+		out = append(out, string(body))
+	}
+	return out
+}
@@ -0,0 +1,361 @@
+package roundrobin
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// HealthCheck defines how and how often the servers are probed
+type HealthCheck struct {
+	// Path is requested on every server with GET relative to the path of the server URL,
+	// if empty, server is probed by opening TCP connection to its host
+	Path string
+	// ExpectedStatus is the status code the server should respond with, any 2xx or 3xx code is accepted if 0
+	ExpectedStatus int
+	// ExpectedBody, if set, should be present in the response body
+	ExpectedBody string
+
+	// Interval between the probes
+	Interval time.Duration
+	// Timeout of a single probe
+	Timeout time.Duration
+	// Jitter is the maximum random delay added to every interval, so probes from many proxies don't come at once
+	Jitter time.Duration
+
+	// HealthyThreshold is the amount of consecutive successful probes after which the server is back in rotation
+	HealthyThreshold int
+	// UnhealthyThreshold is the amount of consecutive failed probes after which the server is taken out of rotation
+	UnhealthyThreshold int
+}
+
+// HealthCheckerOption provides options for the health checker
+type HealthCheckerOption func(*HealthChecker) error
+
+// HealthCheckClock sets the clock used to schedule the probes, intended for tests
+func HealthCheckClock(clock timetools.TimeProvider) HealthCheckerOption {
+	return func(h *HealthChecker) error {
+		h.clock = clock
+		return nil
+	}
+}
+
+// HealthCheckTransport sets the round tripper used by HTTP probes
+func HealthCheckTransport(t http.RoundTripper) HealthCheckerOption {
+	return func(h *HealthChecker) error {
+		h.transport = t
+		return nil
+	}
+}
+
+// healthTarget is a load balancer that can take servers in and out of rotation
+type healthTarget interface {
+	Servers() []*url.URL
+	ServerHealth(u *url.URL) (bool, bool)
+	SetServerHealth(u *url.URL, healthy bool) error
+}
+
+// HealthChecker periodically probes the servers of the load balancer and takes
+// the failing servers out of rotation until they recover.
+type HealthChecker struct {
+	mtx    *sync.Mutex
+	target healthTarget
+	check  HealthCheck
+
+	clock     timetools.TimeProvider
+	transport http.RoundTripper
+	client    *http.Client
+
+	// health state of the servers by URL
+	states map[string]*healthState
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type healthState struct {
+	healthy   bool
+	successes int
+	failures  int
+}
+
+// NewHealthChecker returns health checker for the load balancer, call Start to begin probing the servers
+func NewHealthChecker(target healthTarget, check HealthCheck, opts ...HealthCheckerOption) (*HealthChecker, error) {
+	if target == nil {
+		return nil, fmt.Errorf("load balancer can not be nil")
+	}
+	if check.Interval < 0 || check.Timeout < 0 || check.Jitter < 0 {
+		return nil, fmt.Errorf("interval, timeout and jitter should be >= 0")
+	}
+	if check.HealthyThreshold < 0 || check.UnhealthyThreshold < 0 {
+		return nil, fmt.Errorf("thresholds should be >= 0")
+	}
+	if check.Interval == 0 {
+		check.Interval = defaultHealthCheckInterval
+	}
+	if check.Timeout == 0 {
+		check.Timeout = defaultHealthCheckTimeout
+	}
+	if check.HealthyThreshold == 0 {
+		check.HealthyThreshold = defaultHealthyThreshold
+	}
+	if check.UnhealthyThreshold == 0 {
+		check.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+
+	h := &HealthChecker{
+		mtx:    &sync.Mutex{},
+		target: target,
+		check:  check,
+		states: make(map[string]*healthState),
+	}
+	for _, o := range opts {
+		if err := o(h); err != nil {
+			return nil, err
+		}
+	}
+	if h.clock == nil {
+		h.clock = &timetools.RealTime{}
+	}
+	if h.transport == nil {
+		h.transport = http.DefaultTransport
+	}
+	h.client = &http.Client{
+		Transport: h.transport,
+		Timeout:   check.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return h, nil
+}
+
+// Start begins probing the servers in the background
+func (h *HealthChecker) Start() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.stop != nil {
+		return
+	}
+	h.stop = make(chan struct{})
+	h.stopped = make(chan struct{})
+	go h.run(h.stop, h.stopped)
+}
+
+// Stop stops probing the servers, servers keep their current health status
+func (h *HealthChecker) Stop() {
+	h.mtx.Lock()
+	stop, stopped := h.stop, h.stopped
+	h.stop, h.stopped = nil, nil
+	h.mtx.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-stopped
+}
+
+// IsHealthy tells whether the server passes the health checks, servers that haven't been probed yet are healthy
+func (h *HealthChecker) IsHealthy(u *url.URL) bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if s, ok := h.states[serverKey(u)]; ok {
+		return s.healthy
+	}
+	return true
+}
+
+func (h *HealthChecker) run(stop, stopped chan struct{}) {
+	defer close(stopped)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-h.clock.After(h.nextInterval()):
+			h.checkServers()
+		}
+	}
+}
+
+func (h *HealthChecker) nextInterval() time.Duration {
+	if h.check.Jitter <= 0 {
+		return h.check.Interval
+	}
+	return h.check.Interval + time.Duration(rand.Int63n(int64(h.check.Jitter)))
+}
+
+// checkServers probes all servers of the load balancer concurrently and updates their health status
+func (h *HealthChecker) checkServers() {
+	servers := h.target.Servers()
+	results := make([]error, len(servers))
+
+	wg := &sync.WaitGroup{}
+	for i, u := range servers {
+		wg.Add(1)
+		go func(i int, u *url.URL) {
+			defer wg.Done()
+			results[i] = h.probe(u)
+		}(i, utils.CopyURL(u))
+	}
+	wg.Wait()
+
+	// the server could have been removed and added back or its health set by someone else since the last probe,
+	// so the state follows the health the load balancer has now
+	current := make([]*bool, len(servers))
+	for i, u := range servers {
+		if healthy, ok := h.target.ServerHealth(u); ok {
+			current[i] = &healthy
+		}
+	}
+
+	// the load balancer notifies its observers when the health changes, so it is updated after unlocking,
+	// otherwise the observer calling back the health checker would deadlock
+	var changes []healthChange
+	h.mtx.Lock()
+	seen := make(map[string]bool, len(servers))
+	for i, u := range servers {
+		key := serverKey(u)
+		seen[key] = true
+		s, ok := h.states[key]
+		if !ok {
+			s = &healthState{healthy: true}
+			h.states[key] = s
+		}
+		if current[i] != nil && *current[i] != s.healthy {
+			*s = healthState{healthy: *current[i]}
+		}
+		if h.update(u, s, results[i]) {
+			changes = append(changes, healthChange{url: u, healthy: s.healthy})
+		}
+	}
+	// forget the servers that are no longer in the load balancer
+	for key := range h.states {
+		if !seen[key] {
+			delete(h.states, key)
+		}
+	}
+	h.mtx.Unlock()
+
+	for _, c := range changes {
+		h.setHealth(c.url, c.healthy)
+	}
+}
+
+// healthChange is the health transition of the server found by the probes
+type healthChange struct {
+	url     *url.URL
+	healthy bool
+}
+
+// update counts the probe result and tells whether the health of the server has changed
+func (h *HealthChecker) update(u *url.URL, s *healthState, err error) bool {
+	if err == nil {
+		s.successes++
+		s.failures = 0
+		if !s.healthy && s.successes >= h.check.HealthyThreshold {
+			log.Infof("vulcand/oxy/roundrobin/healthcheck: server %v is healthy", u)
+			s.healthy = true
+			return true
+		}
+		return false
+	}
+	s.failures++
+	s.successes = 0
+	if s.healthy && s.failures >= h.check.UnhealthyThreshold {
+		log.Warningf("vulcand/oxy/roundrobin/healthcheck: server %v is unhealthy: %v", u, err)
+		s.healthy = false
+		return true
+	}
+	return false
+}
+
+func (h *HealthChecker) setHealth(u *url.URL, healthy bool) {
+	if err := h.target.SetServerHealth(u, healthy); err != nil {
+		log.Errorf("vulcand/oxy/roundrobin/healthcheck: failed to update health of %v: %v", u, err)
+	}
+}
+
+func (h *HealthChecker) probe(u *url.URL) error {
+	if h.check.Path == "" {
+		return h.probeTCP(u)
+	}
+	return h.probeHTTP(u)
+}
+
+func (h *HealthChecker) probeTCP(u *url.URL) error {
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if u.Scheme == "https" {
+			host = net.JoinHostPort(host, "443")
+		} else {
+			host = net.JoinHostPort(host, "80")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", host, h.check.Timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (h *HealthChecker) probeHTTP(u *url.URL) error {
+	target := utils.CopyURL(u)
+	// the server can be mounted under the path prefix, e.g. http://10.0.0.1/api is checked at /api/health
+	target.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(h.check.Path, "/")
+	target.RawPath = ""
+	target.RawQuery = ""
+
+	re, err := h.client.Get(target.String())
+	if err != nil {
+		return err
+	}
+	defer re.Body.Close()
+
+	if h.check.ExpectedStatus != 0 {
+		if re.StatusCode != h.check.ExpectedStatus {
+			return fmt.Errorf("expected status %d, got %d", h.check.ExpectedStatus, re.StatusCode)
+		}
+	} else if re.StatusCode < http.StatusOK || re.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status %d", re.StatusCode)
+	}
+
+	if h.check.ExpectedBody == "" {
+		io.Copy(ioutil.Discard, io.LimitReader(re.Body, maxHealthCheckBodyBytes))
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(re.Body, maxHealthCheckBodyBytes))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(body), h.check.ExpectedBody) {
+		return fmt.Errorf("response body does not contain %q", h.check.ExpectedBody)
+	}
+	return nil
+}
+
+// serverKey identifies the server the same way sameURL does
+func serverKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+	defaultHealthyThreshold    = 2
+	defaultUnhealthyThreshold  = 3
+	maxHealthCheckBodyBytes    = 64 * 1024
+)
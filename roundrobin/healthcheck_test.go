@@ -0,0 +1,308 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type HealthCheckSuite struct{}
+
+var _ = Suite(&HealthCheckSuite{})
+
+func (s *HealthCheckSuite) TestHTTPCheck(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b, healthy := newCheckedServer("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(b.URL), Weight(3)), IsNil)
+
+	hc, err := NewHealthChecker(lb, HealthCheck{Path: "/health", HealthyThreshold: 2, UnhealthyThreshold: 2})
+	c.Assert(err, IsNil)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	atomic.StoreInt32(healthy, 0)
+	hc.checkServers()
+	c.Assert(hc.IsHealthy(testutils.ParseURI(b.URL)), Equals, true)
+
+	hc.checkServers()
+	c.Assert(hc.IsHealthy(testutils.ParseURI(b.URL)), Equals, false)
+	c.Assert(seq(c, proxy.URL, 3), DeepEquals, []string{"a", "a", "a"})
+
+	// server keeps its weight while it's out of rotation
+	w, ok := lb.ServerWeight(testutils.ParseURI(b.URL))
+	c.Assert(ok, Equals, true)
+	c.Assert(w, Equals, 3)
+
+	atomic.StoreInt32(healthy, 1)
+	hc.checkServers()
+	c.Assert(hc.IsHealthy(testutils.ParseURI(b.URL)), Equals, false)
+
+	hc.checkServers()
+	c.Assert(hc.IsHealthy(testutils.ParseURI(b.URL)), Equals, true)
+	c.Assert(seq(c, proxy.URL, 4), DeepEquals, []string{"b", "b", "a", "b"})
+}
+
+func (s *HealthCheckSuite) TestExpectedStatusAndBody(c *C) {
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("status: ok"))
+	})
+	defer a.Close()
+
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL)), IsNil)
+
+	hc, err := NewHealthChecker(lb, HealthCheck{Path: "/", ExpectedStatus: http.StatusAccepted, ExpectedBody: "ok"})
+	c.Assert(err, IsNil)
+	c.Assert(hc.probe(testutils.ParseURI(a.URL)), IsNil)
+
+	hc, err = NewHealthChecker(lb, HealthCheck{Path: "/", ExpectedStatus: http.StatusOK})
+	c.Assert(err, IsNil)
+	c.Assert(hc.probe(testutils.ParseURI(a.URL)), NotNil)
+
+	hc, err = NewHealthChecker(lb, HealthCheck{Path: "/", ExpectedBody: "alive"})
+	c.Assert(err, IsNil)
+	c.Assert(hc.probe(testutils.ParseURI(a.URL)), NotNil)
+}
+
+// The check path is joined with the path prefix of the server
+func (s *HealthCheckSuite) TestPathPrefix(c *C) {
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	defer a.Close()
+
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	hc, err := NewHealthChecker(lb, HealthCheck{Path: "/health"})
+	c.Assert(err, IsNil)
+	c.Assert(hc.probe(testutils.ParseURI(a.URL+"/api")), IsNil)
+	c.Assert(hc.probe(testutils.ParseURI(a.URL+"/api/")), IsNil)
+	c.Assert(hc.probe(testutils.ParseURI(a.URL)), NotNil)
+
+	hc, err = NewHealthChecker(lb, HealthCheck{Path: "health"})
+	c.Assert(err, IsNil)
+	c.Assert(hc.probe(testutils.ParseURI(a.URL+"/api")), IsNil)
+}
+
+func (s *HealthCheckSuite) TestTCPCheck(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:64321")), IsNil)
+
+	hc, err := NewHealthChecker(lb, HealthCheck{UnhealthyThreshold: 1, Timeout: time.Second})
+	c.Assert(err, IsNil)
+
+	hc.checkServers()
+	c.Assert(hc.IsHealthy(testutils.ParseURI(a.URL)), Equals, true)
+	c.Assert(hc.IsHealthy(testutils.ParseURI("http://localhost:64321")), Equals, false)
+
+	for i := 0; i < 3; i++ {
+		u, err := lb.NextServer()
+		c.Assert(err, IsNil)
+		c.Assert(u.String(), Equals, a.URL)
+	}
+}
+
+func (s *HealthCheckSuite) TestAllServersUnhealthy(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:64321")), IsNil)
+	c.Assert(lb.SetServerHealth(testutils.ParseURI("http://localhost:64321"), false), IsNil)
+
+	_, err = lb.NextServer()
+	c.Assert(err, NotNil)
+
+	c.Assert(lb.SetServerHealth(testutils.ParseURI("http://localhost:64321"), true), IsNil)
+	_, err = lb.NextServer()
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.SetServerHealth(testutils.ParseURI("http://localhost:64322"), true), NotNil)
+}
+
+func (s *HealthCheckSuite) TestRebalancer(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b, healthy := newCheckedServer("b")
+	defer b.Close()
+	atomic.StoreInt32(healthy, 0)
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+
+	rb, err := NewRebalancer(lb)
+	c.Assert(err, IsNil)
+
+	c.Assert(rb.UpsertServer(testutils.ParseURI(a.URL)), IsNil)
+	c.Assert(rb.UpsertServer(testutils.ParseURI(b.URL)), IsNil)
+
+	hc, err := NewHealthChecker(rb, HealthCheck{Path: "/health", UnhealthyThreshold: 1})
+	c.Assert(err, IsNil)
+	hc.checkServers()
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	c.Assert(seq(c, proxy.URL, 3), DeepEquals, []string{"a", "a", "a"})
+}
+
+func (s *HealthCheckSuite) TestStartStop(c *C) {
+	b, healthy := newCheckedServer("b")
+	defer b.Close()
+	atomic.StoreInt32(healthy, 0)
+
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(b.URL)), IsNil)
+
+	clock := timetools.SleepProvider(time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC))
+	hc, err := NewHealthChecker(lb, HealthCheck{
+		Path:               "/health",
+		Interval:           time.Second,
+		Jitter:             100 * time.Millisecond,
+		UnhealthyThreshold: 1,
+	}, HealthCheckClock(clock))
+	c.Assert(err, IsNil)
+
+	hc.Start()
+	defer hc.Stop()
+
+	for i := 0; i < 100 && hc.IsHealthy(testutils.ParseURI(b.URL)); i++ {
+		timetools.AdvanceTimeBy(clock, 2*time.Second)
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(hc.IsHealthy(testutils.ParseURI(b.URL)), Equals, false)
+
+	_, err = lb.NextServer()
+	c.Assert(err, NotNil)
+}
+
+// The observers are notified after the health checker has released its lock, so they can call it back
+func (s *HealthCheckSuite) TestObserverCallsBack(c *C) {
+	b, healthy := newCheckedServer("b")
+	defer b.Close()
+	atomic.StoreInt32(healthy, 0)
+
+	var hc *HealthChecker
+	var observed []bool
+	lb, err := New(nil, RoundRobinObserver(ObserverFunc(func(e BalancerEvent) {
+		if e.Type == HealthChanged {
+			observed = append(observed, hc.IsHealthy(e.URL))
+		}
+	})))
+	c.Assert(err, IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(b.URL)), IsNil)
+
+	hc, err = NewHealthChecker(lb, HealthCheck{Path: "/health", UnhealthyThreshold: 1})
+	c.Assert(err, IsNil)
+
+	done := make(chan bool)
+	go func() {
+		hc.checkServers()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("health checker has deadlocked notifying the observer")
+	}
+	c.Assert(observed, DeepEquals, []bool{false})
+}
+
+// The server removed and added back between the probes is taken out of rotation again when it keeps failing
+func (s *HealthCheckSuite) TestServerAddedBack(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b, healthy := newCheckedServer("b")
+	defer b.Close()
+	atomic.StoreInt32(healthy, 0)
+
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(b.URL)), IsNil)
+
+	hc, err := NewHealthChecker(lb, HealthCheck{Path: "/health", UnhealthyThreshold: 1})
+	c.Assert(err, IsNil)
+
+	hc.checkServers()
+	c.Assert(hc.IsHealthy(testutils.ParseURI(b.URL)), Equals, false)
+
+	c.Assert(lb.RemoveServer(testutils.ParseURI(b.URL)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(b.URL)), IsNil)
+	up, ok := lb.ServerHealth(testutils.ParseURI(b.URL))
+	c.Assert(ok, Equals, true)
+	c.Assert(up, Equals, true)
+
+	hc.checkServers()
+	c.Assert(hc.IsHealthy(testutils.ParseURI(b.URL)), Equals, false)
+	up, _ = lb.ServerHealth(testutils.ParseURI(b.URL))
+	c.Assert(up, Equals, false)
+}
+
+func (s *HealthCheckSuite) TestBadHealthCheck(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	_, err = NewHealthChecker(nil, HealthCheck{})
+	c.Assert(err, NotNil)
+
+	_, err = NewHealthChecker(lb, HealthCheck{Interval: -1})
+	c.Assert(err, NotNil)
+
+	_, err = NewHealthChecker(lb, HealthCheck{UnhealthyThreshold: -1})
+	c.Assert(err, NotNil)
+}
+
+// newCheckedServer returns server that responds with body on all paths except /health,
+// /health responds with 200 or 503 depending on the value of the returned flag
+func newCheckedServer(body string) (*httptest.Server, *int32) {
+	healthy := int32(1)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/health" {
+			w.Write([]byte(body))
+			return
+		}
+		if atomic.LoadInt32(&healthy) == 1 {
+			w.Write([]byte("ok"))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	return srv, &healthy
+}
@@ -0,0 +1,49 @@
+package roundrobin
+
+// Locality is an optional functional argument that tags the server with the region and zone it runs in
+func Locality(region, zone string) ServerOption {
+	return func(s *server) error {
+		s.region = region
+		s.zone = zone
+		return nil
+	}
+}
+
+// PreferLocality makes the load balancer send the traffic to the servers in its own zone. The traffic spills over
+// to the other zones of the region and then to the other regions proportionally, when the healthy capacity
+// of the local servers falls below the PriorityThreshold. Servers without locality are treated as remote.
+// Locality is preferred within the priority tier, higher priority servers in other zones are still preferred
+// to the lower priority local servers.
+func PreferLocality(region, zone string) LBOption {
+	return func(s *RoundRobin) error {
+		s.region = region
+		s.zone = zone
+		return nil
+	}
+}
+
+const (
+	localZone = iota
+	localRegion
+	remoteRegion
+	localityTiers
+)
+
+// locality returns how close the server is to the load balancer
+func (rr *RoundRobin) locality(s *server) int {
+	switch {
+	case rr.region == "" && rr.zone == "":
+		return localZone
+	case s.region != rr.region:
+		return remoteRegion
+	case s.zone == rr.zone:
+		return localZone
+	default:
+		return localRegion
+	}
+}
+
+// tierRank orders the servers by priority first and locality second
+func (rr *RoundRobin) tierRank(s *server) int {
+	return s.priority*localityTiers + rr.locality(s)
+}
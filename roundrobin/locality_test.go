@@ -0,0 +1,71 @@
+package roundrobin
+
+import (
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type LocalitySuite struct{}
+
+var _ = Suite(&LocalitySuite{})
+
+func (s *LocalitySuite) TestLocalZoneIsPreferred(c *C) {
+	lb, err := New(nil, PreferLocality("us-east", "us-east-1a"))
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000"), Locality("us-east", "us-east-1a")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5001"), Locality("us-east", "us-east-1a"), Weight(2)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:6000"), Locality("us-east", "us-east-1b")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:7000"), Locality("eu-west", "eu-west-1a")), IsNil)
+
+	c.Assert(countServers(c, lb, 9), DeepEquals, map[string]int{
+		"http://localhost:5000": 3,
+		"http://localhost:5001": 6,
+	})
+}
+
+func (s *LocalitySuite) TestSpillOver(c *C) {
+	lb, err := New(nil, PreferLocality("us-east", "us-east-1a"), PriorityThreshold(100))
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000"), Locality("us-east", "us-east-1a")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5001"), Locality("us-east", "us-east-1a")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:6000"), Locality("us-east", "us-east-1b")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:7000"), Locality("eu-west", "eu-west-1a")), IsNil)
+
+	// local zone has half of its capacity, the rest goes to the other zone of the region
+	c.Assert(lb.SetServerHealth(testutils.ParseURI("http://localhost:5001"), false), IsNil)
+	c.Assert(countServers(c, lb, 10), DeepEquals, map[string]int{
+		"http://localhost:5000": 5,
+		"http://localhost:6000": 5,
+	})
+
+	// region is down, traffic goes to the other region
+	c.Assert(lb.SetServerHealth(testutils.ParseURI("http://localhost:5000"), false), IsNil)
+	c.Assert(lb.SetServerHealth(testutils.ParseURI("http://localhost:6000"), false), IsNil)
+	c.Assert(countServers(c, lb, 3), DeepEquals, map[string]int{"http://localhost:7000": 3})
+}
+
+func (s *LocalitySuite) TestPriorityFirst(c *C) {
+	lb, err := New(nil, PreferLocality("us-east", "us-east-1a"))
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000"), Locality("us-east", "us-east-1a"), Priority(1)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:6000"), Locality("us-east", "us-east-1b")), IsNil)
+
+	c.Assert(countServers(c, lb, 3), DeepEquals, map[string]int{"http://localhost:6000": 3})
+}
+
+func (s *LocalitySuite) TestLocalityIgnored(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000"), Locality("us-east", "us-east-1a")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:6000"), Locality("eu-west", "eu-west-1a")), IsNil)
+
+	c.Assert(countServers(c, lb, 4), DeepEquals, map[string]int{
+		"http://localhost:5000": 2,
+		"http://localhost:6000": 2,
+	})
+}
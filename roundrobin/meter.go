@@ -0,0 +1,191 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/memmetrics"
+)
+
+// PeerMeter is the Meter that rates the server relative to the other servers. Rebalancer calls RatePeers
+// with the meters of all servers, including this one, before reading the ratings.
+type PeerMeter interface {
+	Meter
+	RatePeers(peers []Meter)
+}
+
+// NewErrorRatioMeter returns the meter the Rebalancer uses by default, it rates servers by the ratio of 5xx responses
+func NewErrorRatioMeter(clock timetools.TimeProvider) (Meter, error) {
+	rc, err := memmetrics.NewRatioCounter(meterBuckets, meterResolution, memmetrics.RatioClock(clock))
+	if err != nil {
+		return nil, err
+	}
+	return &codeMeter{
+		r:     rc,
+		codeS: http.StatusInternalServerError,
+		codeE: http.StatusGatewayTimeout + 1,
+	}, nil
+}
+
+// LatencyMeter rates servers by the latency quantile, the rating is 1 if the latency of the server
+// is an outlier among its peers according to memmetrics.SplitLatencies, 0 otherwise
+type LatencyMeter struct {
+	quantile  float64
+	clock     timetools.TimeProvider
+	histogram *memmetrics.RollingHDRHistogram
+	counter   *memmetrics.RollingCounter
+	rating    float64
+
+	// latency at the quantile is cached until the next request is recorded or the histogram rolls
+	cached    bool
+	cachedAt  time.Time
+	cachedVal time.Duration
+}
+
+// NewLatencyMeter returns the meter that rates the server by latency at the quantile, given in percent, e.g. 50 or 99
+func NewLatencyMeter(quantile float64, clock timetools.TimeProvider) (*LatencyMeter, error) {
+	if quantile <= 0 || quantile > 100 {
+		return nil, fmt.Errorf("quantile should be in (0, 100], got %v", quantile)
+	}
+	if clock == nil {
+		clock = &timetools.RealTime{}
+	}
+	h, err := memmetrics.NewRollingHDRHistogram(
+		meterHistMin, meterHistMax, meterHistSignificantFigures, meterResolution, meterBuckets, memmetrics.RollingClock(clock))
+	if err != nil {
+		return nil, err
+	}
+	c, err := memmetrics.NewCounter(meterBuckets, meterResolution, memmetrics.CounterClock(clock))
+	if err != nil {
+		return nil, err
+	}
+	return &LatencyMeter{quantile: quantile, clock: clock, histogram: h, counter: c}, nil
+}
+
+// Rating returns the rating computed by the last RatePeers call
+func (m *LatencyMeter) Rating() float64 {
+	return m.rating
+}
+
+// Record records the latency of the request
+func (m *LatencyMeter) Record(code int, d time.Duration) {
+	m.histogram.RecordLatencies(d, 1)
+	m.counter.Inc(1)
+	m.cached = false
+}
+
+// IsReady returns true once the meter has collected the metrics for the whole window
+func (m *LatencyMeter) IsReady() bool {
+	return m.counter.CountedBuckets() >= m.counter.Buckets()
+}
+
+// RatePeers rates the server comparing its latency with the latencies of the peers
+func (m *LatencyMeter) RatePeers(peers []Meter) {
+	m.rating = 0
+	own, ok := m.latency()
+	if !ok {
+		return
+	}
+	var latencies []time.Duration
+	for _, p := range peers {
+		if r, ok := p.(latencyReporter); ok {
+			if l, ok := r.latency(); ok {
+				latencies = append(latencies, l)
+			}
+		}
+	}
+	if len(latencies) < 2 {
+		return
+	}
+	if _, bad := memmetrics.SplitLatencies(latencies, time.Millisecond); bad[own] {
+		m.rating = 1
+	}
+}
+
+// latency returns the latency at the quantile, false if there are no requests in the window
+func (m *LatencyMeter) latency() (time.Duration, bool) {
+	if m.counter.Count() == 0 {
+		return 0, false
+	}
+	now := m.clock.UtcNow()
+	if m.cached && now.Sub(m.cachedAt) < meterResolution {
+		return m.cachedVal, true
+	}
+	h, err := m.histogram.Merged()
+	if err != nil {
+		return 0, false
+	}
+	m.cached, m.cachedAt, m.cachedVal = true, now, h.LatencyAtQuantile(m.quantile)
+	return m.cachedVal, true
+}
+
+// latencyReporter is implemented by the meters that measure latency, so the latency meters can compare to them
+type latencyReporter interface {
+	latency() (time.Duration, bool)
+}
+
+// CompositeMeter combines the ratings of the error and the latency meters,
+// the rating is errorWeight * error rating + latencyWeight * latency rating
+type CompositeMeter struct {
+	errorMeter    Meter
+	latencyMeter  *LatencyMeter
+	errorWeight   float64
+	latencyWeight float64
+}
+
+// NewCompositeMeter returns the meter that combines the ratings of the meters with the weights
+func NewCompositeMeter(errorWeight float64, errors Meter, latencyWeight float64, latency *LatencyMeter) (*CompositeMeter, error) {
+	if errors == nil || latency == nil {
+		return nil, fmt.Errorf("meters can not be nil")
+	}
+	if errorWeight < 0 || latencyWeight < 0 || errorWeight+latencyWeight == 0 {
+		return nil, fmt.Errorf("weights should be >= 0 and not both 0, got %v and %v", errorWeight, latencyWeight)
+	}
+	return &CompositeMeter{
+		errorMeter:    errors,
+		latencyMeter:  latency,
+		errorWeight:   errorWeight,
+		latencyWeight: latencyWeight,
+	}, nil
+}
+
+// Rating returns the weighted rating of the meters
+func (m *CompositeMeter) Rating() float64 {
+	return m.errorWeight*m.errorMeter.Rating() + m.latencyWeight*m.latencyMeter.Rating()
+}
+
+// Record records the request in both meters
+func (m *CompositeMeter) Record(code int, d time.Duration) {
+	m.errorMeter.Record(code, d)
+	m.latencyMeter.Record(code, d)
+}
+
+// IsReady returns true if both meters are ready
+func (m *CompositeMeter) IsReady() bool {
+	return m.errorMeter.IsReady() && m.latencyMeter.IsReady()
+}
+
+// RatePeers passes the peers to the meters that rate the server relative to them
+func (m *CompositeMeter) RatePeers(peers []Meter) {
+	m.latencyMeter.RatePeers(peers)
+	if p, ok := m.errorMeter.(PeerMeter); ok {
+		p.RatePeers(peers)
+	}
+}
+
+func (m *CompositeMeter) latency() (time.Duration, bool) {
+	return m.latencyMeter.latency()
+}
+
+const (
+	// meters collect metrics for 10 seconds
+	meterBuckets    = 10
+	meterResolution = time.Second
+
+	// latencies are recorded in microseconds from 1 microsecond to 1 hour
+	meterHistMin                = 1
+	meterHistMax                = 3600000000
+	meterHistSignificantFigures = 2
+)
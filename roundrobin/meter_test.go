@@ -0,0 +1,142 @@
+package roundrobin
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type MeterSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&MeterSuite{})
+
+func (s *MeterSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *MeterSuite) TestLatencyMeter(c *C) {
+	latencies := []time.Duration{10 * time.Millisecond, 12 * time.Millisecond, 500 * time.Millisecond}
+	meters := make([]Meter, len(latencies))
+	for i := range meters {
+		m, err := NewLatencyMeter(99, s.clock)
+		c.Assert(err, IsNil)
+		meters[i] = m
+	}
+
+	for i := 0; i < 10; i++ {
+		for j, m := range meters {
+			c.Assert(m.IsReady(), Equals, false)
+			m.Record(http.StatusOK, latencies[j])
+		}
+		s.clock.CurrentTime = s.clock.CurrentTime.Add(time.Second)
+	}
+
+	for _, m := range meters {
+		c.Assert(m.IsReady(), Equals, true)
+		m.(PeerMeter).RatePeers(meters)
+	}
+	c.Assert(meters[0].Rating(), Equals, 0.0)
+	c.Assert(meters[1].Rating(), Equals, 0.0)
+	c.Assert(meters[2].Rating(), Equals, 1.0)
+}
+
+func (s *MeterSuite) TestLatencyMeterAlone(c *C) {
+	m, err := NewLatencyMeter(50, s.clock)
+	c.Assert(err, IsNil)
+
+	m.Record(http.StatusOK, time.Second)
+	m.RatePeers([]Meter{m})
+	c.Assert(m.Rating(), Equals, 0.0)
+}
+
+func (s *MeterSuite) TestCompositeMeter(c *C) {
+	newMeter := func() *CompositeMeter {
+		errors, err := NewErrorRatioMeter(s.clock)
+		c.Assert(err, IsNil)
+		latency, err := NewLatencyMeter(50, s.clock)
+		c.Assert(err, IsNil)
+		m, err := NewCompositeMeter(1, errors, 0.5, latency)
+		c.Assert(err, IsNil)
+		return m
+	}
+	a, b, d := newMeter(), newMeter(), newMeter()
+
+	for i := 0; i < 10; i++ {
+		// a fails half of the requests, b is slow
+		a.Record(http.StatusOK, time.Millisecond)
+		a.Record(http.StatusInternalServerError, time.Millisecond)
+		b.Record(http.StatusOK, time.Second)
+		b.Record(http.StatusOK, time.Second)
+		d.Record(http.StatusOK, time.Millisecond)
+		d.Record(http.StatusOK, time.Millisecond)
+		s.clock.CurrentTime = s.clock.CurrentTime.Add(time.Second)
+	}
+
+	peers := []Meter{a, b, d}
+	for _, m := range peers {
+		c.Assert(m.IsReady(), Equals, true)
+		m.(PeerMeter).RatePeers(peers)
+	}
+	c.Assert(a.Rating(), Equals, 0.5)
+	c.Assert(b.Rating(), Equals, 0.5)
+	c.Assert(d.Rating(), Equals, 0.0)
+}
+
+func (s *MeterSuite) TestRebalancerLatency(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	newMeter := func() (Meter, error) {
+		return NewLatencyMeter(50, s.clock)
+	}
+	rb, err := NewRebalancer(lb, RebalancerMeter(newMeter), RebalancerClock(s.clock))
+	c.Assert(err, IsNil)
+
+	a, b := testutils.ParseURI("http://localhost:5000"), testutils.ParseURI("http://localhost:5001")
+	c.Assert(rb.UpsertServer(a), IsNil)
+	c.Assert(rb.UpsertServer(b), IsNil)
+
+	for i := 0; i < 10; i++ {
+		rb.recordMetrics(a, http.StatusOK, 5*time.Millisecond)
+		rb.recordMetrics(b, http.StatusOK, 300*time.Millisecond)
+		s.clock.CurrentTime = s.clock.CurrentTime.Add(time.Second)
+	}
+	rb.adjustWeights()
+
+	// fast server gets more traffic
+	weight, _ := lb.ServerWeight(a)
+	c.Assert(weight, Equals, FSMGrowFactor)
+	weight, _ = lb.ServerWeight(b)
+	c.Assert(weight, Equals, 1)
+}
+
+func (s *MeterSuite) TestBadOptions(c *C) {
+	_, err := NewLatencyMeter(0, nil)
+	c.Assert(err, NotNil)
+
+	_, err = NewLatencyMeter(101, nil)
+	c.Assert(err, NotNil)
+
+	latency, err := NewLatencyMeter(50, nil)
+	c.Assert(err, IsNil)
+
+	_, err = NewCompositeMeter(1, nil, 1, latency)
+	c.Assert(err, NotNil)
+
+	errors, err := NewErrorRatioMeter(s.clock)
+	c.Assert(err, IsNil)
+
+	_, err = NewCompositeMeter(-1, errors, 1, latency)
+	c.Assert(err, NotNil)
+
+	_, err = NewCompositeMeter(0, errors, 0, latency)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,143 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// EventType is the type of the change of the load balancer servers
+type EventType int
+
+const (
+	// ServerAdded is sent when the new server is added to the load balancer
+	ServerAdded EventType = iota
+	// ServerUpdated is sent when the options of the server other than weight change
+	ServerUpdated
+	// ServerRemoved is sent when the server is removed from the load balancer
+	ServerRemoved
+	// WeightChanged is sent when the weight of the server changes
+	WeightChanged
+	// HealthChanged is sent when the server goes out of rotation or gets back to it
+	HealthChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case ServerAdded:
+		return "added"
+	case ServerUpdated:
+		return "updated"
+	case ServerRemoved:
+		return "removed"
+	case WeightChanged:
+		return "weight changed"
+	case HealthChanged:
+		return "health changed"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// EventReason explains why the change has happened
+type EventReason string
+
+const (
+	// ReasonUpdate is the change made by the user of the load balancer
+	ReasonUpdate EventReason = "update"
+	// ReasonRatingSplit is the weight change made by the Rebalancer to give more traffic to the better servers
+	ReasonRatingSplit EventReason = "rating split"
+	// ReasonConverge is the weight change made by the Rebalancer to restore the original weights
+	ReasonConverge EventReason = "converge"
+	// ReasonReset is the weight change made by the Rebalancer when the servers change
+	ReasonReset EventReason = "reset"
+	// ReasonHealthCheck is the health change reported by SetServerHealth
+	ReasonHealthCheck EventReason = "health check"
+	// ReasonOutlier is the health change made by the outlier detector
+	ReasonOutlier EventReason = "outlier"
+	// ReasonDrain is the removal of the drained server
+	ReasonDrain EventReason = "drain"
+)
+
+// BalancerEvent describes the change of the load balancer servers
+type BalancerEvent struct {
+	Type   EventType
+	Reason EventReason
+	URL    *url.URL
+	// Weight of the server after the change and OldWeight before the change
+	Weight    int
+	OldWeight int
+	// Healthy is set if the server is in rotation after the health change
+	Healthy bool
+}
+
+func (e BalancerEvent) String() string {
+	switch e.Type {
+	case WeightChanged:
+		return fmt.Sprintf("%v weight changed from %d to %d (%v)", e.URL, e.OldWeight, e.Weight, e.Reason)
+	case HealthChanged:
+		return fmt.Sprintf("%v healthy: %t (%v)", e.URL, e.Healthy, e.Reason)
+	}
+	return fmt.Sprintf("%v %v", e.URL, e.Type)
+}
+
+// Observer is notified about the changes of the load balancer servers. Events are delivered
+// after the load balancer releases its lock, so observers can call the load balancer back.
+type Observer interface {
+	ObserveEvent(e BalancerEvent)
+}
+
+// ObserverFunc adapts the function to the Observer interface
+type ObserverFunc func(e BalancerEvent)
+
+// ObserveEvent calls f(e)
+func (f ObserverFunc) ObserveEvent(e BalancerEvent) {
+	f(e)
+}
+
+// RoundRobinObserver sets the observer notified about the changes of the servers
+func RoundRobinObserver(o Observer) LBOption {
+	return func(s *RoundRobin) error {
+		s.observer = o
+		return nil
+	}
+}
+
+// RebalancerObserver sets the observer notified about the changes of the servers and the weights set
+// by the Rebalancer, servers ejected by the outlier detector are reported by the RoundRobin observer
+func RebalancerObserver(o Observer) RebalancerOption {
+	return func(r *Rebalancer) error {
+		r.observer = o
+		return nil
+	}
+}
+
+// emit queues the event to be sent once the lock is released, should be called with the lock held
+func (rr *RoundRobin) emit(e BalancerEvent) {
+	if rr.observer != nil {
+		rr.events = append(rr.events, e)
+	}
+}
+
+// unlock releases the lock and sends the queued events to the observer
+func (rr *RoundRobin) unlock() {
+	events := rr.events
+	rr.events = nil
+	rr.mutex.Unlock()
+	for _, e := range events {
+		rr.observer.ObserveEvent(e)
+	}
+}
+
+func (rb *Rebalancer) emit(e BalancerEvent) {
+	if rb.observer != nil {
+		rb.events = append(rb.events, e)
+	}
+}
+
+func (rb *Rebalancer) unlock() {
+	events := rb.events
+	rb.events = nil
+	rb.mtx.Unlock()
+	for _, e := range events {
+		rb.observer.ObserveEvent(e)
+	}
+}
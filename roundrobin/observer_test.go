@@ -0,0 +1,107 @@
+package roundrobin
+
+import (
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type ObserverSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&ObserverSuite{})
+
+func (s *ObserverSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *ObserverSuite) TestRoundRobinEvents(c *C) {
+	var events []BalancerEvent
+	lb, err := New(nil, RoundRobinObserver(ObserverFunc(func(e BalancerEvent) { events = append(events, e) })))
+	c.Assert(err, IsNil)
+
+	u := testutils.ParseURI("http://localhost:5000")
+	c.Assert(lb.UpsertServer(u), IsNil)
+	c.Assert(lb.UpsertServer(u, Weight(3)), IsNil)
+	c.Assert(lb.UpsertServer(u, Labels(map[string]string{"version": "2"})), IsNil)
+	// nothing changes, nothing is reported
+	c.Assert(lb.UpsertServer(u, Weight(3)), IsNil)
+	c.Assert(lb.SetServerHealth(u, false), IsNil)
+	c.Assert(lb.SetServerHealth(u, false), IsNil)
+	c.Assert(lb.SetServerHealth(u, true), IsNil)
+	c.Assert(lb.RemoveServer(u), IsNil)
+
+	c.Assert(eventStrings(events), DeepEquals, []string{
+		"http://localhost:5000 added",
+		"http://localhost:5000 weight changed from 1 to 3 (update)",
+		"http://localhost:5000 updated",
+		"http://localhost:5000 healthy: false (health check)",
+		"http://localhost:5000 healthy: true (health check)",
+		"http://localhost:5000 removed",
+	})
+}
+
+func (s *ObserverSuite) TestObserverCallsBack(c *C) {
+	var lb *RoundRobin
+	var servers int
+	lb, err := New(nil, RoundRobinObserver(ObserverFunc(func(e BalancerEvent) { servers = len(lb.Servers()) })))
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000")), IsNil)
+	c.Assert(servers, Equals, 1)
+}
+
+func (s *ObserverSuite) TestRebalancerEvents(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	var events []BalancerEvent
+	newMeter := func() (Meter, error) {
+		return &testMeter{}, nil
+	}
+	rb, err := NewRebalancer(lb,
+		RebalancerMeter(newMeter),
+		RebalancerClock(s.clock),
+		RebalancerObserver(ObserverFunc(func(e BalancerEvent) { events = append(events, e) })))
+	c.Assert(err, IsNil)
+
+	a, b := testutils.ParseURI("http://localhost:5000"), testutils.ParseURI("http://localhost:5001")
+	c.Assert(rb.UpsertServer(a), IsNil)
+	c.Assert(rb.UpsertServer(b), IsNil)
+	// nothing has changed, nothing is reported
+	c.Assert(rb.UpsertServer(b), IsNil)
+	c.Assert(len(rb.servers), Equals, 2)
+
+	rb.servers[0].meter.(*testMeter).rating = 0.3
+	rb.adjustWeights()
+
+	rb.servers[0].meter.(*testMeter).rating = 0
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(rb.backoffDuration + time.Second)
+	rb.adjustWeights()
+
+	c.Assert(rb.SetServerHealth(a, false), IsNil)
+	c.Assert(rb.RemoveServer(a), IsNil)
+
+	c.Assert(eventStrings(events), DeepEquals, []string{
+		"http://localhost:5000 added",
+		"http://localhost:5001 added",
+		"http://localhost:5001 weight changed from 1 to 4 (rating split)",
+		"http://localhost:5001 weight changed from 4 to 1 (converge)",
+		"http://localhost:5000 healthy: false (health check)",
+		"http://localhost:5000 removed",
+	})
+}
+
+func eventStrings(events []BalancerEvent) []string {
+	out := make([]string, len(events))
+	for i, e := range events {
+		out[i] = e.String()
+	}
+	return out
+}
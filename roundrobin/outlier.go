@@ -0,0 +1,461 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/memmetrics"
+	"github.com/vulcand/oxy/utils"
+)
+
+// OutlierEvent is emitted when the server is ejected from rotation or restored back
+type OutlierEvent struct {
+	URL *url.URL
+	// Ejected is true if the server has been ejected and false if it has been restored
+	Ejected bool
+	// Reason explains why the server has been ejected
+	Reason string
+	// Until is the time the server stays ejected
+	Until time.Time
+	// Ejections is the amount of recent ejections of the server, the ejection time grows exponentially with it
+	Ejections int
+}
+
+// OutlierListener is called on every ejection and restoration
+type OutlierListener func(OutlierEvent)
+
+// OutlierOption provides options for the outlier detector
+type OutlierOption func(*OutlierDetector) error
+
+// OutlierClock sets the clock, intended for tests
+func OutlierClock(clock timetools.TimeProvider) OutlierOption {
+	return func(o *OutlierDetector) error {
+		o.clock = clock
+		return nil
+	}
+}
+
+// OutlierConsecutiveErrors ejects the server after n consecutive 5xx responses, 0 disables the check
+func OutlierConsecutiveErrors(n int) OutlierOption {
+	return func(o *OutlierDetector) error {
+		if n < 0 {
+			return fmt.Errorf("consecutive errors should be >= 0, got %d", n)
+		}
+		o.consecutiveErrors = n
+		return nil
+	}
+}
+
+// OutlierConsecutiveGatewayErrors ejects the server after n consecutive 502, 503 or 504 responses, 0 disables the check
+func OutlierConsecutiveGatewayErrors(n int) OutlierOption {
+	return func(o *OutlierDetector) error {
+		if n < 0 {
+			return fmt.Errorf("consecutive gateway errors should be >= 0, got %d", n)
+		}
+		o.consecutiveGatewayErrors = n
+		return nil
+	}
+}
+
+// OutlierDetectErrorRatio ejects the servers that have much higher ratio of 5xx responses than the others,
+// see memmetrics.SplitRatios
+func OutlierDetectErrorRatio() OutlierOption {
+	return func(o *OutlierDetector) error {
+		o.errorRatio = true
+		return nil
+	}
+}
+
+// OutlierDetectLatency ejects the servers that have much higher latency at quantile than the others,
+// see memmetrics.SplitLatencies
+func OutlierDetectLatency(quantile float64) OutlierOption {
+	return func(o *OutlierDetector) error {
+		if quantile <= 0 || quantile > 100 {
+			return fmt.Errorf("quantile should be in (0, 100], got %v", quantile)
+		}
+		o.latencyQuantile = quantile
+		return nil
+	}
+}
+
+// OutlierAnalysis sets how often the error ratios and latencies of the servers are compared, and the minimum
+// amount of requests the server should get within the metrics window to take part in comparison
+func OutlierAnalysis(interval time.Duration, minRequests int64) OutlierOption {
+	return func(o *OutlierDetector) error {
+		if interval <= 0 {
+			return fmt.Errorf("analysis interval should be > 0, got %v", interval)
+		}
+		o.analysisInterval = interval
+		o.minRequests = minRequests
+		return nil
+	}
+}
+
+// OutlierEjectionTime sets the time the server is ejected for the first time, every next ejection doubles it
+// up to the max
+func OutlierEjectionTime(base, max time.Duration) OutlierOption {
+	return func(o *OutlierDetector) error {
+		if base <= 0 || max < base {
+			return fmt.Errorf("ejection time should be > 0 and <= max, got %v, max %v", base, max)
+		}
+		o.baseEjectionTime = base
+		o.maxEjectionTime = max
+		return nil
+	}
+}
+
+// OutlierMaxEjectionPercent caps the percent of servers that can be ejected at the same time,
+// one server can always be ejected as long as it's not the last one in rotation
+func OutlierMaxEjectionPercent(percent int) OutlierOption {
+	return func(o *OutlierDetector) error {
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("max ejection percent should be in [0, 100], got %d", percent)
+		}
+		o.maxEjectionPercent = percent
+		return nil
+	}
+}
+
+// OnOutlier sets the listener called when servers are ejected and restored
+func OnOutlier(l OutlierListener) OutlierOption {
+	return func(o *OutlierDetector) error {
+		o.listener = l
+		return nil
+	}
+}
+
+// OutlierDetector watches responses of the servers passively and ejects outliers from
+// rotation of the load balancer, see EnableOutlierDetection.
+type OutlierDetector struct {
+	mtx   *sync.Mutex
+	clock timetools.TimeProvider
+
+	lb   *RoundRobin
+	next http.Handler
+
+	consecutiveErrors        int
+	consecutiveGatewayErrors int
+	errorRatio               bool
+	latencyQuantile          float64
+	analysisInterval         time.Duration
+	minRequests              int64
+	baseEjectionTime         time.Duration
+	maxEjectionTime          time.Duration
+	maxEjectionPercent       int
+
+	listener OutlierListener
+
+	servers      map[string]*outlierServer
+	nextAnalysis time.Time
+	// the earliest time one of the ejected servers should be restored, zero if none are ejected
+	nextRestore time.Time
+}
+
+type outlierServer struct {
+	url     *url.URL
+	metrics *memmetrics.RTMetrics
+
+	consecutiveErrors        int
+	consecutiveGatewayErrors int
+
+	ejected    bool
+	until      time.Time
+	ejections  int
+	restoredAt time.Time
+}
+
+// NewOutlierDetector returns outlier detector, it starts working once passed to the load balancer with EnableOutlierDetection
+func NewOutlierDetector(opts ...OutlierOption) (*OutlierDetector, error) {
+	o := &OutlierDetector{
+		mtx:                &sync.Mutex{},
+		consecutiveErrors:  defaultOutlierConsecutiveErrors,
+		analysisInterval:   defaultOutlierAnalysisInterval,
+		minRequests:        defaultOutlierMinRequests,
+		baseEjectionTime:   defaultOutlierBaseEjectionTime,
+		maxEjectionTime:    defaultOutlierMaxEjectionTime,
+		maxEjectionPercent: defaultOutlierMaxEjectionPercent,
+		servers:            make(map[string]*outlierServer),
+	}
+	for _, s := range opts {
+		if err := s(o); err != nil {
+			return nil, err
+		}
+	}
+	if o.clock == nil {
+		o.clock = &timetools.RealTime{}
+	}
+	o.nextAnalysis = o.clock.UtcNow().Add(o.analysisInterval)
+	return o, nil
+}
+
+func (o *OutlierDetector) attach(lb *RoundRobin, next http.Handler) error {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	if o.lb != nil {
+		return fmt.Errorf("outlier detector is already used by another load balancer")
+	}
+	o.lb = lb
+	o.next = next
+	return nil
+}
+
+// IsEjected tells whether the server is currently ejected from rotation
+func (o *OutlierDetector) IsEjected(u *url.URL) bool {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	if s, ok := o.servers[serverKey(u)]; ok {
+		return s.ejected
+	}
+	return false
+}
+
+func (o *OutlierDetector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	o.restoreExpired()
+
+	// request URL has been rewritten by the load balancer and points to the server now
+	u := utils.CopyURL(req.URL)
+	pw := &utils.ProxyWriter{W: w}
+	start := o.clock.UtcNow()
+
+	o.next.ServeHTTP(pw, req)
+
+	o.record(u, pw.StatusCode(), o.clock.UtcNow().Sub(start))
+}
+
+func (o *OutlierDetector) record(u *url.URL, code int, latency time.Duration) {
+	o.mtx.Lock()
+	events := o.recordLocked(u, code, latency)
+	o.mtx.Unlock()
+
+	o.emit(events)
+}
+
+func (o *OutlierDetector) recordLocked(u *url.URL, code int, latency time.Duration) []OutlierEvent {
+	s, err := o.getServer(u)
+	if err != nil {
+		log.Errorf("vulcand/oxy/roundrobin/outlier: failed to create metrics for %v: %v", u, err)
+		return nil
+	}
+	s.metrics.Record(code, latency)
+
+	if code >= http.StatusInternalServerError {
+		s.consecutiveErrors++
+	} else {
+		s.consecutiveErrors = 0
+	}
+	if code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout {
+		s.consecutiveGatewayErrors++
+	} else {
+		s.consecutiveGatewayErrors = 0
+	}
+
+	var events []OutlierEvent
+	if !s.ejected {
+		if o.consecutiveGatewayErrors > 0 && s.consecutiveGatewayErrors >= o.consecutiveGatewayErrors {
+			events = o.eject(s, fmt.Sprintf("%d consecutive gateway errors", s.consecutiveGatewayErrors), events)
+		} else if o.consecutiveErrors > 0 && s.consecutiveErrors >= o.consecutiveErrors {
+			events = o.eject(s, fmt.Sprintf("%d consecutive errors", s.consecutiveErrors), events)
+		}
+	}
+
+	if o.clock.UtcNow().After(o.nextAnalysis) {
+		o.nextAnalysis = o.clock.UtcNow().Add(o.analysisInterval)
+		events = o.analyze(events)
+	}
+	return events
+}
+
+// analyze compares error ratios and latencies of the servers in rotation and ejects the outliers
+func (o *OutlierDetector) analyze(events []OutlierEvent) []OutlierEvent {
+	o.forgetRemoved()
+
+	if !o.errorRatio && o.latencyQuantile == 0 {
+		return events
+	}
+
+	var candidates []*outlierServer
+	for _, s := range o.servers {
+		if !s.ejected && s.metrics.TotalCount() >= o.minRequests {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) < 2 {
+		return events
+	}
+
+	if o.errorRatio {
+		ratios := make([]float64, len(candidates))
+		for i, s := range candidates {
+			ratios[i] = s.metrics.ResponseCodeRatio(http.StatusInternalServerError, 600, 0, 600)
+		}
+		_, bad := memmetrics.SplitRatios(ratios)
+		for i, s := range candidates {
+			if bad[ratios[i]] && !s.ejected {
+				events = o.eject(s, fmt.Sprintf("error ratio %v is an outlier among %v", ratios[i], ratios), events)
+			}
+		}
+	}
+
+	if o.latencyQuantile != 0 {
+		latencies := make([]time.Duration, len(candidates))
+		for i, s := range candidates {
+			h, err := s.metrics.LatencyHistogram()
+			if err != nil {
+				log.Errorf("vulcand/oxy/roundrobin/outlier: failed to get latency histogram of %v: %v", s.url, err)
+				return events
+			}
+			latencies[i] = h.LatencyAtQuantile(o.latencyQuantile)
+		}
+		_, bad := memmetrics.SplitLatencies(latencies, time.Millisecond)
+		for i, s := range candidates {
+			if bad[latencies[i]] && !s.ejected {
+				events = o.eject(s, fmt.Sprintf("latency %v is an outlier among %v", latencies[i], latencies), events)
+			}
+		}
+	}
+	return events
+}
+
+func (o *OutlierDetector) eject(s *outlierServer, reason string, events []OutlierEvent) []OutlierEvent {
+	total := len(o.lb.Servers())
+	ejected := 0
+	for _, srv := range o.servers {
+		if srv.ejected {
+			ejected++
+		}
+	}
+	max := total * o.maxEjectionPercent / 100
+	if max < 1 {
+		max = 1
+	}
+	if ejected+1 > max || ejected+1 >= total {
+		log.Infof("vulcand/oxy/roundrobin/outlier: not ejecting %v (%v), %d of %d servers are already ejected", s.url, reason, ejected, total)
+		return events
+	}
+
+	now := o.clock.UtcNow()
+	// server behaved for long enough since the last time it was ejected, start over
+	if !s.restoredAt.IsZero() && now.Sub(s.restoredAt) >= o.maxEjectionTime {
+		s.ejections = 0
+	}
+	s.ejections++
+
+	duration := o.baseEjectionTime
+	for i := 1; i < s.ejections && duration < o.maxEjectionTime; i++ {
+		duration *= 2
+	}
+	if duration > o.maxEjectionTime {
+		duration = o.maxEjectionTime
+	}
+
+	log.Warningf("vulcand/oxy/roundrobin/outlier: ejecting %v for %v: %v", s.url, duration, reason)
+
+	s.ejected = true
+	s.until = now.Add(duration)
+	if o.nextRestore.IsZero() || s.until.Before(o.nextRestore) {
+		o.nextRestore = s.until
+	}
+	s.consecutiveErrors = 0
+	s.consecutiveGatewayErrors = 0
+	s.metrics.Reset()
+
+	return append(events, OutlierEvent{
+		URL:       utils.CopyURL(s.url),
+		Ejected:   true,
+		Reason:    reason,
+		Until:     s.until,
+		Ejections: s.ejections,
+	})
+}
+
+func (o *OutlierDetector) restoreExpired() {
+	o.mtx.Lock()
+	now := o.clock.UtcNow()
+	if o.nextRestore.IsZero() || now.Before(o.nextRestore) {
+		o.mtx.Unlock()
+		return
+	}
+
+	var events []OutlierEvent
+	o.nextRestore = time.Time{}
+	for _, s := range o.servers {
+		if !s.ejected {
+			continue
+		}
+		if now.Before(s.until) {
+			if o.nextRestore.IsZero() || s.until.Before(o.nextRestore) {
+				o.nextRestore = s.until
+			}
+			continue
+		}
+		log.Infof("vulcand/oxy/roundrobin/outlier: restoring %v", s.url)
+		s.ejected = false
+		s.restoredAt = now
+		events = append(events, OutlierEvent{
+			URL:       utils.CopyURL(s.url),
+			Ejections: s.ejections,
+		})
+	}
+	o.mtx.Unlock()
+
+	o.emit(events)
+}
+
+// forgetRemoved drops the state of the servers that have been removed from the load balancer
+func (o *OutlierDetector) forgetRemoved() {
+	present := make(map[string]bool)
+	for _, u := range o.lb.Servers() {
+		present[serverKey(u)] = true
+	}
+	for key := range o.servers {
+		if !present[key] {
+			delete(o.servers, key)
+		}
+	}
+}
+
+func (o *OutlierDetector) getServer(u *url.URL) (*outlierServer, error) {
+	key := serverKey(u)
+	if s, ok := o.servers[key]; ok {
+		return s, nil
+	}
+	metrics, err := memmetrics.NewRTMetrics(memmetrics.RTClock(o.clock))
+	if err != nil {
+		return nil, err
+	}
+	s := &outlierServer{url: utils.CopyURL(u), metrics: metrics}
+	o.servers[key] = s
+	return s, nil
+}
+
+// emit ejects and restores the servers and notifies the listener, it is called after unlocking,
+// as the load balancer notifies its observers that can call back the detector
+func (o *OutlierDetector) emit(events []OutlierEvent) {
+	for _, e := range events {
+		if err := o.lb.setServerEjected(e.URL, e.Ejected); err != nil {
+			log.Errorf("vulcand/oxy/roundrobin/outlier: failed to set ejected of %v to %v: %v", e.URL, e.Ejected, err)
+		}
+	}
+	if o.listener == nil {
+		return
+	}
+	for _, e := range events {
+		o.listener(e)
+	}
+}
+
+const (
+	defaultOutlierConsecutiveErrors  = 5
+	defaultOutlierAnalysisInterval   = 10 * time.Second
+	defaultOutlierMinRequests        = 5
+	defaultOutlierBaseEjectionTime   = 30 * time.Second
+	defaultOutlierMaxEjectionTime    = 300 * time.Second
+	defaultOutlierMaxEjectionPercent = 10
+)
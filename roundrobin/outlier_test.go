@@ -0,0 +1,267 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type OutlierSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&OutlierSuite{})
+
+func (s *OutlierSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *OutlierSuite) TestConsecutiveErrors(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("b"))
+	})
+	defer b.Close()
+
+	var events []OutlierEvent
+	od, err := NewOutlierDetector(
+		OutlierClock(s.clock),
+		OutlierConsecutiveErrors(2),
+		OutlierEjectionTime(10*time.Second, time.Minute),
+		OutlierMaxEjectionPercent(50),
+		OnOutlier(func(e OutlierEvent) { events = append(events, e) }),
+	)
+	c.Assert(err, IsNil)
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, EnableOutlierDetection(od))
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(b.URL)), IsNil)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	c.Assert(seq(c, proxy.URL, 4), DeepEquals, []string{"a", "b", "a", "b"})
+	c.Assert(od.IsEjected(testutils.ParseURI(b.URL)), Equals, true)
+	c.Assert(seq(c, proxy.URL, 3), DeepEquals, []string{"a", "a", "a"})
+
+	c.Assert(len(events), Equals, 1)
+	c.Assert(events[0].URL.String(), Equals, b.URL)
+	c.Assert(events[0].Ejected, Equals, true)
+	c.Assert(events[0].Until, Equals, s.clock.CurrentTime.Add(10*time.Second))
+
+	// ejection time is over, server is back in rotation
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(11 * time.Second)
+	c.Assert(seq(c, proxy.URL, 1), DeepEquals, []string{"a"})
+	c.Assert(od.IsEjected(testutils.ParseURI(b.URL)), Equals, false)
+	c.Assert(len(events), Equals, 2)
+	c.Assert(events[1].Ejected, Equals, false)
+
+	// still failing, the next ejection lasts twice as long
+	c.Assert(seq(c, proxy.URL, 4), DeepEquals, []string{"a", "b", "a", "b"})
+	c.Assert(len(events), Equals, 3)
+	c.Assert(events[2].Ejections, Equals, 2)
+	c.Assert(events[2].Until, Equals, s.clock.CurrentTime.Add(20*time.Second))
+}
+
+func (s *OutlierSuite) TestMaxEjectionPercent(c *C) {
+	od, err := NewOutlierDetector(OutlierClock(s.clock), OutlierConsecutiveErrors(1), OutlierMaxEjectionPercent(50))
+	c.Assert(err, IsNil)
+
+	lb, err := New(nil, EnableOutlierDetection(od))
+	c.Assert(err, IsNil)
+
+	urls := []string{"http://localhost:5000", "http://localhost:5001", "http://localhost:5002", "http://localhost:5003"}
+	for _, u := range urls {
+		c.Assert(lb.UpsertServer(testutils.ParseURI(u)), IsNil)
+	}
+	for _, u := range urls {
+		od.record(testutils.ParseURI(u), http.StatusBadGateway, time.Millisecond)
+	}
+
+	ejected := 0
+	for _, u := range urls {
+		if od.IsEjected(testutils.ParseURI(u)) {
+			ejected++
+		}
+	}
+	c.Assert(ejected, Equals, 2)
+}
+
+func (s *OutlierSuite) TestLastServerIsNotEjected(c *C) {
+	od, err := NewOutlierDetector(OutlierClock(s.clock), OutlierConsecutiveErrors(1), OutlierMaxEjectionPercent(100))
+	c.Assert(err, IsNil)
+
+	lb, err := New(nil, EnableOutlierDetection(od))
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000")), IsNil)
+	od.record(testutils.ParseURI("http://localhost:5000"), http.StatusInternalServerError, time.Millisecond)
+
+	c.Assert(od.IsEjected(testutils.ParseURI("http://localhost:5000")), Equals, false)
+	_, err = lb.NextServer()
+	c.Assert(err, IsNil)
+}
+
+// The observers are notified after the detector has released its lock, so they can call it back
+func (s *OutlierSuite) TestObserverCallsBack(c *C) {
+	od, err := NewOutlierDetector(OutlierClock(s.clock), OutlierConsecutiveErrors(1), OutlierEjectionTime(10*time.Second, time.Minute), OutlierMaxEjectionPercent(50))
+	c.Assert(err, IsNil)
+
+	var observed []bool
+	lb, err := New(nil, EnableOutlierDetection(od), RoundRobinObserver(ObserverFunc(func(e BalancerEvent) {
+		if e.Reason == ReasonOutlier {
+			observed = append(observed, od.IsEjected(e.URL))
+		}
+	})))
+	c.Assert(err, IsNil)
+
+	a, b := testutils.ParseURI("http://localhost:5000"), testutils.ParseURI("http://localhost:5001")
+	c.Assert(lb.UpsertServer(a), IsNil)
+	c.Assert(lb.UpsertServer(b), IsNil)
+
+	done := make(chan bool)
+	go func() {
+		od.record(b, http.StatusInternalServerError, time.Millisecond)
+		s.clock.CurrentTime = s.clock.CurrentTime.Add(11 * time.Second)
+		od.restoreExpired()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("outlier detector has deadlocked notifying the observer")
+	}
+	c.Assert(observed, DeepEquals, []bool{true, false})
+}
+
+func (s *OutlierSuite) TestGatewayErrors(c *C) {
+	od, err := NewOutlierDetector(OutlierClock(s.clock), OutlierConsecutiveErrors(0), OutlierConsecutiveGatewayErrors(2))
+	c.Assert(err, IsNil)
+
+	lb, err := New(nil, EnableOutlierDetection(od))
+	c.Assert(err, IsNil)
+
+	a, b := testutils.ParseURI("http://localhost:5000"), testutils.ParseURI("http://localhost:5001")
+	c.Assert(lb.UpsertServer(a), IsNil)
+	c.Assert(lb.UpsertServer(b), IsNil)
+
+	for i := 0; i < 5; i++ {
+		od.record(a, http.StatusInternalServerError, time.Millisecond)
+	}
+	c.Assert(od.IsEjected(a), Equals, false)
+
+	od.record(a, http.StatusServiceUnavailable, time.Millisecond)
+	od.record(a, http.StatusGatewayTimeout, time.Millisecond)
+	c.Assert(od.IsEjected(a), Equals, true)
+
+	for i := 0; i < 3; i++ {
+		u, err := lb.NextServer()
+		c.Assert(err, IsNil)
+		c.Assert(u.String(), Equals, b.String())
+	}
+}
+
+func (s *OutlierSuite) TestErrorRatioOutlier(c *C) {
+	od, err := NewOutlierDetector(
+		OutlierClock(s.clock),
+		OutlierConsecutiveErrors(0),
+		OutlierDetectErrorRatio(),
+		OutlierAnalysis(time.Second, 10),
+		OutlierMaxEjectionPercent(50))
+	c.Assert(err, IsNil)
+
+	lb, err := New(nil, EnableOutlierDetection(od))
+	c.Assert(err, IsNil)
+
+	urls := []string{"http://localhost:5000", "http://localhost:5001", "http://localhost:5002"}
+	for _, u := range urls {
+		c.Assert(lb.UpsertServer(testutils.ParseURI(u)), IsNil)
+	}
+	for i := 0; i < 20; i++ {
+		od.record(testutils.ParseURI(urls[0]), http.StatusOK, time.Millisecond)
+		od.record(testutils.ParseURI(urls[1]), http.StatusOK, time.Millisecond)
+		code := http.StatusOK
+		if i%2 == 0 {
+			code = http.StatusInternalServerError
+		}
+		od.record(testutils.ParseURI(urls[2]), code, time.Millisecond)
+	}
+	c.Assert(od.IsEjected(testutils.ParseURI(urls[2])), Equals, false)
+
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(2 * time.Second)
+	od.record(testutils.ParseURI(urls[0]), http.StatusOK, time.Millisecond)
+
+	c.Assert(od.IsEjected(testutils.ParseURI(urls[0])), Equals, false)
+	c.Assert(od.IsEjected(testutils.ParseURI(urls[1])), Equals, false)
+	c.Assert(od.IsEjected(testutils.ParseURI(urls[2])), Equals, true)
+}
+
+func (s *OutlierSuite) TestLatencyOutlier(c *C) {
+	od, err := NewOutlierDetector(
+		OutlierClock(s.clock),
+		OutlierDetectLatency(50),
+		OutlierAnalysis(time.Second, 10),
+		OutlierMaxEjectionPercent(50))
+	c.Assert(err, IsNil)
+
+	lb, err := New(nil, EnableOutlierDetection(od))
+	c.Assert(err, IsNil)
+
+	urls := []string{"http://localhost:5000", "http://localhost:5001", "http://localhost:5002"}
+	for _, u := range urls {
+		c.Assert(lb.UpsertServer(testutils.ParseURI(u)), IsNil)
+	}
+	for i := 0; i < 20; i++ {
+		od.record(testutils.ParseURI(urls[0]), http.StatusOK, 10*time.Millisecond)
+		od.record(testutils.ParseURI(urls[1]), http.StatusOK, 12*time.Millisecond)
+		od.record(testutils.ParseURI(urls[2]), http.StatusOK, 500*time.Millisecond)
+	}
+
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(2 * time.Second)
+	od.record(testutils.ParseURI(urls[0]), http.StatusOK, 10*time.Millisecond)
+
+	c.Assert(od.IsEjected(testutils.ParseURI(urls[0])), Equals, false)
+	c.Assert(od.IsEjected(testutils.ParseURI(urls[1])), Equals, false)
+	c.Assert(od.IsEjected(testutils.ParseURI(urls[2])), Equals, true)
+}
+
+func (s *OutlierSuite) TestAttachTwice(c *C) {
+	od, err := NewOutlierDetector()
+	c.Assert(err, IsNil)
+
+	_, err = New(nil, EnableOutlierDetection(od))
+	c.Assert(err, IsNil)
+
+	_, err = New(nil, EnableOutlierDetection(od))
+	c.Assert(err, NotNil)
+}
+
+func (s *OutlierSuite) TestBadOptions(c *C) {
+	_, err := NewOutlierDetector(OutlierConsecutiveErrors(-1))
+	c.Assert(err, NotNil)
+
+	_, err = NewOutlierDetector(OutlierDetectLatency(0))
+	c.Assert(err, NotNil)
+
+	_, err = NewOutlierDetector(OutlierEjectionTime(time.Minute, time.Second))
+	c.Assert(err, NotNil)
+
+	_, err = NewOutlierDetector(OutlierMaxEjectionPercent(101))
+	c.Assert(err, NotNil)
+}
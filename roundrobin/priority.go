@@ -0,0 +1,113 @@
+package roundrobin
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Priority is an optional functional argument that puts the server into the priority tier, 0 is the highest priority.
+// Servers of the lower tiers receive traffic only when the healthy capacity of the higher tiers is not enough.
+func Priority(p int) ServerOption {
+	return func(s *server) error {
+		if p < 0 {
+			return fmt.Errorf("priority should be >= 0, got %d", p)
+		}
+		s.priority = p
+		return nil
+	}
+}
+
+// PriorityThreshold sets the share of healthy capacity, in percent of the tier weight, the tier needs to handle
+// all the traffic on its own, it applies to both priority and locality tiers. Below the threshold the tier
+// gets the proportional share of the traffic and the rest spills over to the next tiers, e.g. with the default
+// threshold of 70 the tier that has 35% of its capacity healthy gets half of the traffic.
+func PriorityThreshold(percent int) LBOption {
+	return func(s *RoundRobin) error {
+		if percent <= 0 || percent > 100 {
+			return fmt.Errorf("priority threshold should be in (0, 100], got %d", percent)
+		}
+		s.priorityThreshold = float64(percent) / 100
+		return nil
+	}
+}
+
+// priorityTier accumulates the capacity of the servers with the same priority and locality
+type priorityTier struct {
+	rank int
+	// configured weights of all and of enabled servers
+	total   int
+	healthy int
+	// sum of the current weights of enabled servers
+	current int
+	// share of the traffic the tier receives
+	load float64
+}
+
+// applyPriorities distributes the traffic between the priority tiers by scaling the weights of their servers,
+// the servers of the tiers that get no traffic are taken out of rotation. Within the priority the servers
+// are split into tiers by locality, if the load balancer prefers its own locality.
+func (rr *RoundRobin) applyPriorities(weights []int) {
+	tiers := map[int]*priorityTier{}
+	for i, s := range rr.servers {
+		rank := rr.tierRank(s)
+		t, ok := tiers[rank]
+		if !ok {
+			t = &priorityTier{rank: rank}
+			tiers[rank] = t
+		}
+		t.total += s.weight
+		if weights[i] >= 0 {
+			t.healthy += s.weight
+			t.current += weights[i]
+		}
+	}
+	if len(tiers) < 2 {
+		return
+	}
+
+	ordered := make([]*priorityTier, 0, len(tiers))
+	for _, t := range tiers {
+		ordered = append(ordered, t)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].rank < ordered[j].rank })
+
+	remaining, assigned := 1.0, 0.0
+	for _, t := range ordered {
+		if t.total == 0 || t.current == 0 {
+			continue
+		}
+		health := float64(t.healthy) / float64(t.total) / rr.priorityThreshold
+		if health > remaining {
+			health = remaining
+		}
+		t.load = health
+		remaining -= health
+		assigned += health
+	}
+	// the scale keeps the weights unchanged when a single tier gets all the traffic
+	scale := 0
+	for _, t := range ordered {
+		if t.load > 0 {
+			t.load = t.load / assigned
+			scale += t.current
+		}
+	}
+
+	for i, s := range rr.servers {
+		if weights[i] <= 0 {
+			continue
+		}
+		t := tiers[rr.tierRank(s)]
+		if t.load == 0 {
+			weights[i] = -1
+			continue
+		}
+		w := int(float64(weights[i]) * t.load * float64(scale) / float64(t.current))
+		if w < 1 {
+			w = 1
+		}
+		weights[i] = w
+	}
+}
+
+const defaultPriorityThreshold = 0.7
@@ -0,0 +1,91 @@
+package roundrobin
+
+import (
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type PrioritySuite struct{}
+
+var _ = Suite(&PrioritySuite{})
+
+func (s *PrioritySuite) TestBackupIsIdle(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5001"), Weight(2)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:6000"), Priority(1)), IsNil)
+
+	c.Assert(countServers(c, lb, 9), DeepEquals, map[string]int{
+		"http://localhost:5000": 3,
+		"http://localhost:5001": 6,
+	})
+}
+
+func (s *PrioritySuite) TestProportionalSpillOver(c *C) {
+	lb, err := New(nil, PriorityThreshold(100))
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5001")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:6000"), Priority(1)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:6001"), Priority(1)), IsNil)
+
+	c.Assert(lb.SetServerHealth(testutils.ParseURI("http://localhost:5001"), false), IsNil)
+
+	c.Assert(countServers(c, lb, 100), DeepEquals, map[string]int{
+		"http://localhost:5000": 50,
+		"http://localhost:6000": 25,
+		"http://localhost:6001": 25,
+	})
+}
+
+func (s *PrioritySuite) TestThreshold(c *C) {
+	lb, err := New(nil, PriorityThreshold(50))
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5001")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:6000"), Priority(1)), IsNil)
+
+	// half of the capacity is enough for the primary tier to take all the traffic
+	c.Assert(lb.SetServerHealth(testutils.ParseURI("http://localhost:5001"), false), IsNil)
+	c.Assert(countServers(c, lb, 10), DeepEquals, map[string]int{"http://localhost:5000": 10})
+}
+
+func (s *PrioritySuite) TestFailover(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:6000"), Priority(1)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:7000"), Priority(2)), IsNil)
+
+	c.Assert(lb.SetServerHealth(testutils.ParseURI("http://localhost:5000"), false), IsNil)
+	c.Assert(countServers(c, lb, 4), DeepEquals, map[string]int{"http://localhost:6000": 4})
+
+	c.Assert(lb.SetServerHealth(testutils.ParseURI("http://localhost:6000"), false), IsNil)
+	c.Assert(countServers(c, lb, 4), DeepEquals, map[string]int{"http://localhost:7000": 4})
+
+	c.Assert(lb.SetServerHealth(testutils.ParseURI("http://localhost:7000"), false), IsNil)
+	_, err = lb.NextServer()
+	c.Assert(err, NotNil)
+
+	// primary tier is back, traffic fails back
+	c.Assert(lb.SetServerHealth(testutils.ParseURI("http://localhost:5000"), true), IsNil)
+	c.Assert(countServers(c, lb, 4), DeepEquals, map[string]int{"http://localhost:5000": 4})
+}
+
+func (s *PrioritySuite) TestBadOptions(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000"), Priority(-1)), NotNil)
+
+	_, err = New(nil, PriorityThreshold(0))
+	c.Assert(err, NotNil)
+
+	_, err = New(nil, PriorityThreshold(101))
+	c.Assert(err, NotNil)
+}
@@ -49,6 +49,12 @@ type Rebalancer struct {
 	newMeter NewMeterFn
 
 	requestRewriteListener RequestRewriteListener
+
+	stickySession *StickySession
+
+	// observer is notified about the changes of the servers, events are queued while the lock is held
+	observer Observer
+	events   []BalancerEvent
 }
 
 func RebalancerClock(clock timetools.TimeProvider) RebalancerOption {
@@ -88,6 +94,14 @@ func RebalancerRequestRewriteListener(rrl RequestRewriteListener) RebalancerOpti
 	}
 }
 
+// RebalancerStickySession enables sticky sessions, the requests of the same client are sent to the same server
+func RebalancerStickySession(ss *StickySession) RebalancerOption {
+	return func(r *Rebalancer) error {
+		r.stickySession = ss
+		return nil
+	}
+}
+
 func NewRebalancer(handler balancerHandler, opts ...RebalancerOption) (*Rebalancer, error) {
 	rb := &Rebalancer{
 		mtx:  &sync.Mutex{},
@@ -106,15 +120,7 @@ func NewRebalancer(handler balancerHandler, opts ...RebalancerOption) (*Rebalanc
 	}
 	if rb.newMeter == nil {
 		rb.newMeter = func() (Meter, error) {
-			rc, err := memmetrics.NewRatioCounter(10, time.Second, memmetrics.RatioClock(rb.clock))
-			if err != nil {
-				return nil, err
-			}
-			return &codeMeter{
-				r:     rc,
-				codeS: http.StatusInternalServerError,
-				codeE: http.StatusGatewayTimeout + 1,
-			}, nil
+			return NewErrorRatioMeter(rb.clock)
 		}
 	}
 	if rb.errHandler == nil {
@@ -130,6 +136,35 @@ func (rb *Rebalancer) Servers() []*url.URL {
 	return rb.next.Servers()
 }
 
+// Snapshot returns the state of the servers, Weight is the weight the server has been configured with
+// and Rating is the rating reported by its meter
+func (rb *Rebalancer) Snapshot() []ServerSnapshot {
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+
+	out := rb.next.Snapshot()
+	for i := range out {
+		srv, index := rb.findServer(out[i].URL)
+		if index == -1 {
+			continue
+		}
+		out[i].Weight = srv.origWeight
+		if srv.meter.IsReady() {
+			out[i].Rating = srv.meter.Rating()
+		}
+	}
+	return out
+}
+
+// forward returns the handler the requests are forwarded to, the round robin keeps track
+// of the requests in flight there so its servers can be drained
+func (rb *Rebalancer) forward() http.Handler {
+	if t, ok := rb.next.(interface{ tracked() http.Handler }); ok {
+		return t.tracked()
+	}
+	return rb.next.Next()
+}
+
 func (rb *Rebalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if log.GetLevel() >= log.DebugLevel {
 		logEntry := log.WithField("Request", utils.DumpHttpRequest(req))
@@ -139,29 +174,63 @@ func (rb *Rebalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	pw := &utils.ProxyWriter{W: w}
 	start := rb.clock.UtcNow()
-	url, err := rb.next.NextServer()
-	if err != nil {
-		rb.errHandler.ServeHTTP(w, req, err)
-		return
+
+	// make shallow copy of request before changing anything to avoid side effects
+	newReq := *req
+	// retries are sent to the servers that have not been tried yet
+	attempts := utils.AttemptsFromRequest(req)
+	var tried []*url.URL
+	if attempts != nil {
+		tried = attempts.Servers()
+	}
+
+	stuck := false
+	if rb.stickySession != nil {
+		cookieURL, present, err := rb.stickySession.GetBackend(&newReq, rb.stickyServers())
+		if err != nil {
+			log.Warningf("vulcand/oxy/roundrobin/rebalancer: error using server from cookie: %v", err)
+		}
+		if present && !containsURL(tried, cookieURL) && rb.allowedURL(cookieURL) {
+			newReq.URL = utils.CopyURL(cookieURL)
+			stuck = true
+		}
+	}
+
+	if !stuck {
+		url, err := rb.next.NextServerExcept(tried)
+		if err == errAllServersTripped {
+			// the load balancer serves the circuit breakers fallback
+			rb.next.ServeHTTP(w, req)
+			return
+		}
+		if err != nil {
+			rb.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+
+		if rb.stickySession != nil {
+			rb.stickySession.StickBackend(url, w)
+		}
+		newReq.URL = url
 	}
 
 	if log.GetLevel() >= log.DebugLevel {
 		//log which backend URL we're sending this request to
-		log.WithFields(log.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": url}).Debugf("vulcand/oxy/roundrobin/rebalancer: Forwarding this request to URL")
+		log.WithFields(log.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": newReq.URL}).Debugf("vulcand/oxy/roundrobin/rebalancer: Forwarding this request to URL")
 	}
 
-	// make shallow copy of request before changing anything to avoid side effects
-	newReq := *req
-	newReq.URL = url
+	if attempts != nil {
+		attempts.AddServer(newReq.URL)
+	}
 
 	//Emit event to a listener if one exists
 	if rb.requestRewriteListener != nil {
 		rb.requestRewriteListener(req, &newReq)
 	}
 
-	rb.next.Next().ServeHTTP(pw, &newReq)
+	rb.forward().ServeHTTP(pw, &newReq)
 
-	rb.recordMetrics(url, pw.Code, rb.clock.UtcNow().Sub(start))
+	rb.recordMetrics(newReq.URL, pw.Code, rb.clock.UtcNow().Sub(start))
 	rb.adjustWeights()
 }
 
@@ -173,10 +242,34 @@ func (rb *Rebalancer) recordMetrics(u *url.URL, code int, latency time.Duration)
 	}
 }
 
+// stickyServers returns the servers the sticky session can send requests to, the same ones the load balancer
+// has in rotation: healthy, not ejected and not draining
+func (rb *Rebalancer) stickyServers() []*url.URL {
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+
+	snapshot := rb.next.Snapshot()
+	out := make([]*url.URL, 0, len(snapshot))
+	for _, s := range snapshot {
+		if !s.Healthy || s.Ejected || s.Draining {
+			continue
+		}
+		if srv, i := rb.findServer(s.URL); i != -1 && !srv.draining && !srv.unhealthy {
+			out = append(out, s.URL)
+		}
+	}
+	return out
+}
+
 func (rb *Rebalancer) reset() {
 	for _, s := range rb.servers {
+		if s.curWeight != s.origWeight {
+			rb.emit(BalancerEvent{Type: WeightChanged, Reason: ReasonReset, URL: utils.CopyURL(s.url), Weight: s.origWeight, OldWeight: s.curWeight})
+		}
 		s.curWeight = s.origWeight
-		rb.next.UpsertServer(s.url, Weight(s.origWeight))
+		if !s.draining {
+			rb.next.UpsertServer(s.url, Weight(s.origWeight))
+		}
 	}
 	rb.timer = rb.clock.UtcNow().Add(-1 * time.Second)
 	rb.ratings = make([]float64, len(rb.servers))
@@ -192,7 +285,7 @@ func (rb *Rebalancer) Wrap(next balancerHandler) error {
 
 func (rb *Rebalancer) UpsertServer(u *url.URL, options ...ServerOption) error {
 	rb.mtx.Lock()
-	defer rb.mtx.Unlock()
+	defer rb.unlock()
 
 	if err := rb.next.UpsertServer(u, options...); err != nil {
 		return err
@@ -208,11 +301,70 @@ func (rb *Rebalancer) UpsertServer(u *url.URL, options ...ServerOption) error {
 
 func (rb *Rebalancer) RemoveServer(u *url.URL) error {
 	rb.mtx.Lock()
-	defer rb.mtx.Unlock()
+	defer rb.unlock()
 
 	return rb.removeServer(u)
 }
 
+// ServerHealth tells whether the server is marked as healthy, see SetServerHealth
+func (rb *Rebalancer) ServerHealth(u *url.URL) (bool, bool) {
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+
+	if srv, i := rb.findServer(u); i != -1 {
+		return !srv.unhealthy, true
+	}
+	return false, false
+}
+
+// SetServerHealth takes the unhealthy server out of rotation of the underlying load balancer
+// keeping its original weight
+func (rb *Rebalancer) SetServerHealth(u *url.URL, healthy bool) error {
+	rb.mtx.Lock()
+	defer rb.unlock()
+
+	if err := rb.next.SetServerHealth(u, healthy); err != nil {
+		return err
+	}
+	if srv, i := rb.findServer(u); i != -1 && srv.unhealthy == healthy {
+		srv.unhealthy = !healthy
+		rb.emit(BalancerEvent{Type: HealthChanged, Reason: ReasonHealthCheck, URL: utils.CopyURL(srv.url), Weight: srv.origWeight, Healthy: healthy})
+	}
+	return nil
+}
+
+// Drain takes the server out of rotation, waits until the requests in flight complete or the timeout expires
+// and removes the server, see RoundRobin.Drain
+func (rb *Rebalancer) Drain(u *url.URL, timeout time.Duration, listener DrainListener) error {
+	rb.mtx.Lock()
+	srv, i := rb.findServer(u)
+	if i == -1 {
+		rb.mtx.Unlock()
+		return fmt.Errorf("%v not found", u)
+	}
+	if srv.draining {
+		rb.mtx.Unlock()
+		return fmt.Errorf("%v is already draining", u)
+	}
+	srv.draining = true
+	rb.mtx.Unlock()
+
+	// the lock is not held while waiting, so the requests keep flowing to the other servers
+	err := rb.next.Drain(u, timeout, listener)
+
+	rb.mtx.Lock()
+	defer rb.unlock()
+	for i, s := range rb.servers {
+		if s == srv {
+			rb.servers = append(rb.servers[:i], rb.servers[i+1:]...)
+			rb.emit(BalancerEvent{Type: ServerRemoved, Reason: ReasonDrain, URL: utils.CopyURL(s.url), Weight: s.origWeight})
+			rb.reset()
+			break
+		}
+	}
+	return err
+}
+
 func (rb *Rebalancer) removeServer(u *url.URL) error {
 	_, i := rb.findServer(u)
 	if i == -1 {
@@ -221,14 +373,21 @@ func (rb *Rebalancer) removeServer(u *url.URL) error {
 	if err := rb.next.RemoveServer(u); err != nil {
 		return err
 	}
+	srv := rb.servers[i]
 	rb.servers = append(rb.servers[:i], rb.servers[i+1:]...)
+	rb.emit(BalancerEvent{Type: ServerRemoved, Reason: ReasonUpdate, URL: utils.CopyURL(srv.url), Weight: srv.origWeight})
 	rb.reset()
 	return nil
 }
 
 func (rb *Rebalancer) upsertServer(u *url.URL, weight int) error {
 	if s, i := rb.findServer(u); i != -1 {
+		if s.curWeight != weight {
+			rb.emit(BalancerEvent{Type: WeightChanged, Reason: ReasonUpdate, URL: utils.CopyURL(s.url), Weight: weight, OldWeight: s.curWeight})
+		}
 		s.origWeight = weight
+		s.curWeight = weight
+		return nil
 	}
 	meter, err := rb.newMeter()
 	if err != nil {
@@ -241,6 +400,7 @@ func (rb *Rebalancer) upsertServer(u *url.URL, weight int) error {
 		meter:      meter,
 	}
 	rb.servers = append(rb.servers, rbSrv)
+	rb.emit(BalancerEvent{Type: ServerAdded, Reason: ReasonUpdate, URL: utils.CopyURL(u), Weight: weight})
 	return nil
 }
 
@@ -260,7 +420,7 @@ func (r *Rebalancer) findServer(u *url.URL) (*rbServer, int) {
 // on every call, can adjust weights if needed.
 func (rb *Rebalancer) adjustWeights() {
 	rb.mtx.Lock()
-	defer rb.mtx.Unlock()
+	defer rb.unlock()
 
 	// In this case adjusting weights would have no effect, so do nothing
 	if len(rb.servers) < 2 {
@@ -284,14 +444,36 @@ func (rb *Rebalancer) adjustWeights() {
 	}
 }
 
+// currentWeights returns the weights of the servers before adjusting them
+func (rb *Rebalancer) currentWeights() []int {
+	weights := make([]int, len(rb.servers))
+	for i, srv := range rb.servers {
+		weights[i] = srv.curWeight
+	}
+	return weights
+}
+
+// reportWeights reports the servers that have weights different from the old ones
+func (rb *Rebalancer) reportWeights(old []int, reason EventReason) {
+	for i, srv := range rb.servers {
+		if srv.curWeight != old[i] {
+			rb.emit(BalancerEvent{Type: WeightChanged, Reason: reason, URL: utils.CopyURL(srv.url), Weight: srv.curWeight, OldWeight: old[i]})
+		}
+	}
+}
+
 func (rb *Rebalancer) applyWeights() {
 	for _, srv := range rb.servers {
+		if srv.draining {
+			continue
+		}
 		log.Infof("upsert server %v, weight %v", srv.url, srv.curWeight)
 		rb.next.UpsertServer(srv.url, Weight(srv.curWeight))
 	}
 }
 
 func (rb *Rebalancer) setMarkedWeights() bool {
+	old := rb.currentWeights()
 	changed := false
 	// Increase weights on servers marked as good
 	for _, srv := range rb.servers {
@@ -307,6 +489,7 @@ func (rb *Rebalancer) setMarkedWeights() bool {
 	if changed {
 		rb.normalizeWeights()
 		rb.applyWeights()
+		rb.reportWeights(old, ReasonRatingSplit)
 		return true
 	}
 	return false
@@ -333,6 +516,7 @@ func (rb *Rebalancer) metricsReady() bool {
 // It does compare relative performances of the servers though, so if all servers have approximately the same error rate
 // this function returns the result as if all servers are equally good.
 func (rb *Rebalancer) markServers() bool {
+	rb.ratePeers()
 	for i, srv := range rb.servers {
 		rb.ratings[i] = srv.meter.Rating()
 	}
@@ -350,8 +534,22 @@ func (rb *Rebalancer) markServers() bool {
 	return len(g) != 0 && len(b) != 0
 }
 
+// ratePeers lets the meters that rate the servers relative to each other compare with the peers
+func (rb *Rebalancer) ratePeers() {
+	meters := make([]Meter, len(rb.servers))
+	for i, srv := range rb.servers {
+		meters[i] = srv.meter
+	}
+	for _, m := range meters {
+		if p, ok := m.(PeerMeter); ok {
+			p.RatePeers(meters)
+		}
+	}
+}
+
 func (rb *Rebalancer) convergeWeights() bool {
 	// If we have previoulsy changed servers try to restore weights to the original state
+	old := rb.currentWeights()
 	changed := false
 	for _, s := range rb.servers {
 		if s.origWeight == s.curWeight {
@@ -367,6 +565,7 @@ func (rb *Rebalancer) convergeWeights() bool {
 	}
 	rb.normalizeWeights()
 	rb.applyWeights()
+	rb.reportWeights(old, ReasonConverge)
 	return true
 }
 
@@ -412,6 +611,10 @@ type rbServer struct {
 	curWeight  int // current weight
 	good       bool
 	meter      Meter
+	// draining servers are not upserted back to the underlying load balancer
+	draining bool
+	// health of the server reported by SetServerHealth
+	unhealthy bool
 }
 
 const (
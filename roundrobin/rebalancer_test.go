@@ -89,6 +89,30 @@ func (s *RBSuite) TestRebalancerRemoveServer(c *C) {
 	c.Assert(seq(c, proxy.URL, 3), DeepEquals, []string{"b", "b", "b"})
 }
 
+// Upserting the existing server updates its weight instead of adding a duplicate
+func (s *RBSuite) TestRebalancerUpsertExisting(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+
+	rb, err := NewRebalancer(lb)
+	c.Assert(err, IsNil)
+
+	c.Assert(rb.UpsertServer(testutils.ParseURI(a.URL)), IsNil)
+	c.Assert(rb.UpsertServer(testutils.ParseURI(a.URL), Weight(3)), IsNil)
+	c.Assert(len(rb.servers), Equals, 1)
+	c.Assert(rb.servers[0].origWeight, Equals, 3)
+	c.Assert(rb.servers[0].curWeight, Equals, 3)
+
+	c.Assert(rb.RemoveServer(testutils.ParseURI(a.URL)), IsNil)
+	c.Assert(len(rb.servers), Equals, 0)
+}
+
 // Test scenario when one server goes down after what it recovers
 func (s *RBSuite) TestRebalancerRecovery(c *C) {
 	a, b := testutils.NewResponder("a"), testutils.NewResponder("b")
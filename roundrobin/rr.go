@@ -3,11 +3,18 @@ package roundrobin
 
 import (
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
+	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/mailgun/timetools"
 	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/cbreaker"
+	"github.com/vulcand/oxy/memmetrics"
 	"github.com/vulcand/oxy/utils"
 )
 
@@ -22,6 +29,46 @@ func Weight(w int) ServerOption {
 	}
 }
 
+// SlowStart is an optional functional argument that makes the newly added server receive only a fraction
+// of its weight, growing to the full weight during the window, so the server has time to warm up.
+// The ramp up starts over when the server gets back to rotation after being unhealthy or ejected.
+func SlowStart(window time.Duration) ServerOption {
+	return func(s *server) error {
+		if window < 0 {
+			return fmt.Errorf("slow start window should be >= 0")
+		}
+		s.slowStart = window
+		return nil
+	}
+}
+
+// SlowStartCurve sets the shape of the slow start ramp up, the effective weight of the server is
+//
+//    weight * max(minPercent/100, (timeSinceStart/window)^(1/aggression))
+//
+// aggression 1 ramps up linearly, larger values give more traffic to the server early in the window.
+func SlowStartCurve(aggression float64, minPercent int) LBOption {
+	return func(s *RoundRobin) error {
+		if aggression <= 0 {
+			return fmt.Errorf("aggression should be > 0, got %v", aggression)
+		}
+		if minPercent < 0 || minPercent > 100 {
+			return fmt.Errorf("min percent should be in [0, 100], got %d", minPercent)
+		}
+		s.slowStartAggression = aggression
+		s.slowStartMin = float64(minPercent) / 100
+		return nil
+	}
+}
+
+// RoundRobinClock sets the clock used by the slow start, intended for tests
+func RoundRobinClock(clock timetools.TimeProvider) LBOption {
+	return func(s *RoundRobin) error {
+		s.clock = clock
+		return nil
+	}
+}
+
 // ErrorHandler is a functional argument that sets error handler of the server
 func ErrorHandler(h utils.ErrorHandler) LBOption {
 	return func(s *RoundRobin) error {
@@ -38,23 +85,63 @@ func RoundRobinRequestRewriteListener(rrl RequestRewriteListener) LBOption {
 	}
 }
 
+// EnableStickySession enables sticky sessions, the requests of the same client are sent to the same server
+func EnableStickySession(ss *StickySession) LBOption {
+	return func(s *RoundRobin) error {
+		s.stickySession = ss
+		return nil
+	}
+}
+
+// EnableOutlierDetection ejects the servers that keep failing or are way slower than the others from rotation
+func EnableOutlierDetection(od *OutlierDetector) LBOption {
+	return func(s *RoundRobin) error {
+		s.outlierDetector = od
+		return nil
+	}
+}
+
 type RoundRobin struct {
 	mutex      *sync.Mutex
 	next       http.Handler
 	errHandler utils.ErrorHandler
-	// Current index (starts from -1)
-	index                  int
+	// servers in the order they have been added
 	servers                []*server
-	currentWeight          int
 	requestRewriteListener RequestRewriteListener
+	stickySession          *StickySession
+	outlierDetector        *OutlierDetector
+	// priorityThreshold is the share of healthy capacity below which the priority tier spills over to the next one
+	priorityThreshold float64
+	// locality of the load balancer, servers in the same zone are preferred
+	region string
+	zone   string
+	// serverMetrics enables collecting round trip metrics per server
+	serverMetrics bool
+	// observer is notified about the changes of the servers, events are queued while the lock is held
+	observer Observer
+	events   []BalancerEvent
+	// tracker counts requests in flight per server
+	tracker *inflightHandler
+	// schedule is the *schedule the servers are selected from, nil if it has to be rebuilt
+	schedule atomic.Value
+	// newBreaker creates circuit breakers of the servers, nil if the servers have no breakers
+	newBreaker       func() (*cbreaker.CircuitBreaker, error)
+	breakersFallback http.Handler
+
+	clock               timetools.TimeProvider
+	slowStartAggression float64
+	slowStartMin        float64
 }
 
 func New(next http.Handler, opts ...LBOption) (*RoundRobin, error) {
 	rr := &RoundRobin{
 		next:    next,
-		index:   -1,
 		mutex:   &sync.Mutex{},
 		servers: []*server{},
+
+		slowStartAggression: defaultSlowStartAggression,
+		slowStartMin:        defaultSlowStartMin,
+		priorityThreshold:   defaultPriorityThreshold,
 	}
 	for _, o := range opts {
 		if err := o(rr); err != nil {
@@ -64,6 +151,18 @@ func New(next http.Handler, opts ...LBOption) (*RoundRobin, error) {
 	if rr.errHandler == nil {
 		rr.errHandler = utils.DefaultHandler
 	}
+	if rr.clock == nil {
+		rr.clock = &timetools.RealTime{}
+	}
+	rr.schedule.Store((*schedule)(nil))
+	if rr.outlierDetector != nil {
+		// outlier detector sits between the load balancer and the next handler to observe responses of the servers
+		if err := rr.outlierDetector.attach(rr, rr.next); err != nil {
+			return nil, err
+		}
+		rr.next = rr.outlierDetector
+	}
+	rr.tracker = &inflightHandler{lb: rr}
 	return rr, nil
 }
 
@@ -71,6 +170,12 @@ func (r *RoundRobin) Next() http.Handler {
 	return r.next
 }
 
+// tracked returns the handler that forwards the requests to next keeping track of the requests in flight,
+// so the servers can be drained
+func (r *RoundRobin) tracked() http.Handler {
+	return r.tracker
+}
+
 func (r *RoundRobin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if log.GetLevel() >= log.DebugLevel {
 		logEntry := log.WithField("Request", utils.DumpHttpRequest(req))
@@ -78,75 +183,82 @@ func (r *RoundRobin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		defer logEntry.Debug("vulcand/oxy/roundrobin/rr: competed ServeHttp on request")
 	}
 
-	url, err := r.NextServer()
-	if err != nil {
-		r.errHandler.ServeHTTP(w, req, err)
-		return
+	// make shallow copy of request before chaning anything to avoid side effects
+	newReq := *req
+	// retries are sent to the servers that have not been tried yet
+	attempts := utils.AttemptsFromRequest(req)
+	var tried []*url.URL
+	if attempts != nil {
+		tried = attempts.Servers()
+	}
+
+	stuck := false
+	if r.stickySession != nil {
+		cookieURL, present, err := r.stickySession.GetBackend(&newReq, r.enabledServers())
+		if err != nil {
+			log.Warningf("vulcand/oxy/roundrobin/rr: error using server from cookie: %v", err)
+		}
+		if present && !containsURL(tried, cookieURL) && r.allowedURL(cookieURL) {
+			newReq.URL = utils.CopyURL(cookieURL)
+			stuck = true
+		}
+	}
+
+	if !stuck {
+		url, err := r.NextServerExcept(tried)
+		if err == errAllServersTripped {
+			r.serveAllTripped(w, req)
+			return
+		}
+		if err != nil {
+			r.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+
+		if r.stickySession != nil {
+			r.stickySession.StickBackend(url, w)
+		}
+		newReq.URL = url
 	}
 
 	if log.GetLevel() >= log.DebugLevel {
 		//log which backend URL we're sending this request to
-		log.WithFields(log.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": url}).Debugf("vulcand/oxy/roundrobin/rr: Forwarding this request to URL")
+		log.WithFields(log.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": newReq.URL}).Debugf("vulcand/oxy/roundrobin/rr: Forwarding this request to URL")
 	}
 
-	// make shallow copy of request before chaning anything to avoid side effects
-	newReq := *req
-	newReq.URL = url
+	if attempts != nil {
+		attempts.AddServer(newReq.URL)
+	}
 
 	//Emit event to a listener if one exists
 	if r.requestRewriteListener != nil {
 		r.requestRewriteListener(req, &newReq)
 	}
 
-	r.next.ServeHTTP(w, &newReq)
+	r.tracker.ServeHTTP(w, &newReq)
 }
 
 func (r *RoundRobin) NextServer() (*url.URL, error) {
-	srv, err := r.nextServer()
+	return r.NextServerExcept(nil)
+}
+
+// NextServerExcept returns the next server skipping the excluded ones, e.g. the servers the request
+// has already failed on. If all servers in rotation are excluded, it returns the next server as NextServer does.
+func (r *RoundRobin) NextServerExcept(exclude []*url.URL) (*url.URL, error) {
+	srv, err := r.nextServer(exclude)
 	if err != nil {
 		return nil, err
 	}
 	return utils.CopyURL(srv.url), nil
 }
 
-func (r *RoundRobin) nextServer() (*server, error) {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
-
-	if len(r.servers) == 0 {
-		return nil, fmt.Errorf("no servers in the pool")
-	}
-
-	// The algo below may look messy, but is actually very simple
-	// it calculates the GCD  and subtracts it on every iteration, what interleaves servers
-	// and allows us not to build an iterator every time we readjust weights
-
-	// GCD across all enabled servers
-	gcd := r.weightGcd()
-	// Maximum weight across all enabled servers
-	max := r.maxWeight()
-
-	for {
-		r.index = (r.index + 1) % len(r.servers)
-		if r.index == 0 {
-			r.currentWeight = r.currentWeight - gcd
-			if r.currentWeight <= 0 {
-				r.currentWeight = max
-				if r.currentWeight == 0 {
-					return nil, fmt.Errorf("all servers have 0 weight")
-				}
-			}
-		}
-		srv := r.servers[r.index]
-		if srv.weight >= r.currentWeight {
-			return srv, nil
-		}
-	}
+func (r *RoundRobin) nextServer(exclude []*url.URL) (*server, error) {
+	return r.currentSchedule().pick(exclude)
 }
 
 func (r *RoundRobin) RemoveServer(u *url.URL) error {
 	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	defer r.unlock()
 
 	e, index := r.findServerByURL(u)
 	if e == nil {
@@ -154,9 +266,154 @@ func (r *RoundRobin) RemoveServer(u *url.URL) error {
 	}
 	r.servers = append(r.servers[:index], r.servers[index+1:]...)
 	r.resetState()
+	r.emit(BalancerEvent{Type: ServerRemoved, Reason: ReasonUpdate, URL: utils.CopyURL(e.url), Weight: e.weight})
+	return nil
+}
+
+// SetServerHealth takes the unhealthy server out of rotation, the server keeps its weight and
+// gets back to rotation once it is marked as healthy again
+func (rr *RoundRobin) SetServerHealth(u *url.URL, healthy bool) error {
+	rr.mutex.Lock()
+	defer rr.unlock()
+
+	s, _ := rr.findServerByURL(u)
+	if s == nil {
+		return fmt.Errorf("server not found")
+	}
+	if s.unhealthy == !healthy {
+		return nil
+	}
+	s.unhealthy = !healthy
+	if healthy {
+		s.rampStart = rr.clock.UtcNow()
+	}
+	rr.resetState()
+	rr.emit(BalancerEvent{Type: HealthChanged, Reason: ReasonHealthCheck, URL: utils.CopyURL(s.url), Weight: s.weight, Healthy: healthy})
 	return nil
 }
 
+func (rr *RoundRobin) setServerEjected(u *url.URL, ejected bool) error {
+	rr.mutex.Lock()
+	defer rr.unlock()
+
+	s, _ := rr.findServerByURL(u)
+	if s == nil {
+		return fmt.Errorf("server not found")
+	}
+	if s.ejected == ejected {
+		return nil
+	}
+	s.ejected = ejected
+	if !ejected {
+		s.rampStart = rr.clock.UtcNow()
+	}
+	rr.resetState()
+	rr.emit(BalancerEvent{Type: HealthChanged, Reason: ReasonOutlier, URL: utils.CopyURL(s.url), Weight: s.weight, Healthy: !ejected})
+	return nil
+}
+
+// Drain takes the server out of rotation, waits until the requests in flight complete or the timeout expires
+// and removes the server from the load balancer. Timeout 0 waits for the requests as long as it takes.
+// The listener, if not nil, is notified about the progress.
+func (rr *RoundRobin) Drain(u *url.URL, timeout time.Duration, listener DrainListener) error {
+	srv, err := rr.startDrain(u)
+	if err != nil {
+		return err
+	}
+	inflight := drainWait(rr.clock, u, timeout, func() int64 { return rr.inflight(srv) }, srv.released, listener)
+	rr.removeDrained(srv)
+	if listener != nil {
+		listener(DrainStatus{URL: utils.CopyURL(u), InFlight: inflight, Done: true, TimedOut: inflight != 0})
+	}
+	return nil
+}
+
+func (rr *RoundRobin) startDrain(u *url.URL) (*server, error) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	s, _ := rr.findServerByURL(u)
+	if s == nil {
+		return nil, fmt.Errorf("server not found")
+	}
+	if s.draining {
+		return nil, fmt.Errorf("server %v is already draining", u)
+	}
+	s.draining = true
+	s.released = make(chan struct{}, 1)
+	rr.resetState()
+	return s, nil
+}
+
+// removeDrained removes the drained server unless it has been removed already
+func (rr *RoundRobin) removeDrained(s *server) {
+	rr.mutex.Lock()
+	defer rr.unlock()
+
+	for i, srv := range rr.servers {
+		if srv == s {
+			rr.servers = append(rr.servers[:i], rr.servers[i+1:]...)
+			rr.resetState()
+			rr.emit(BalancerEvent{Type: ServerRemoved, Reason: ReasonDrain, URL: utils.CopyURL(s.url), Weight: s.weight})
+			return
+		}
+	}
+}
+
+func (rr *RoundRobin) acquire(u *url.URL) *server {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	s, _ := rr.findServerByURL(u)
+	if s != nil {
+		s.inflight++
+	}
+	return s
+}
+
+func (rr *RoundRobin) release(s *server, code int, latency time.Duration) {
+	// the breaker guards its state with its own lock and the metrics are safe for concurrent use,
+	// the breaker is not touched by the load balancer after the server is added
+	if s.breaker != nil {
+		s.breaker.Record(code, latency)
+	}
+
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	s.inflight--
+	if s.metrics != nil {
+		s.metrics.Record(code, latency)
+	}
+	if s.released != nil {
+		select {
+		case s.released <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (rr *RoundRobin) inflight(s *server) int64 {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	return s.inflight
+}
+
+// enabledServers returns the servers that can receive new requests
+func (rr *RoundRobin) enabledServers() []*url.URL {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	out := make([]*url.URL, 0, len(rr.servers))
+	for _, srv := range rr.servers {
+		if srv.enabled() {
+			out = append(out, srv.url)
+		}
+	}
+	return out
+}
+
 func (rr *RoundRobin) Servers() []*url.URL {
 	rr.mutex.Lock()
 	defer rr.mutex.Unlock()
@@ -178,22 +435,40 @@ func (rr *RoundRobin) ServerWeight(u *url.URL) (int, bool) {
 	return -1, false
 }
 
+// ServerHealth tells whether the server is marked as healthy, see SetServerHealth
+func (rr *RoundRobin) ServerHealth(u *url.URL) (bool, bool) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	if s, _ := rr.findServerByURL(u); s != nil {
+		return !s.unhealthy, true
+	}
+	return false, false
+}
+
 // In case if server is already present in the load balancer, returns error
 func (rr *RoundRobin) UpsertServer(u *url.URL, options ...ServerOption) error {
 	rr.mutex.Lock()
-	defer rr.mutex.Unlock()
+	defer rr.unlock()
 
 	if u == nil {
 		return fmt.Errorf("server URL can't be nil")
 	}
 
 	if s, _ := rr.findServerByURL(u); s != nil {
+		before := *s
 		for _, o := range options {
 			if err := o(s); err != nil {
 				return err
 			}
 		}
 		rr.resetState()
+		if s.weight != before.weight {
+			rr.emit(BalancerEvent{Type: WeightChanged, Reason: ReasonUpdate, URL: utils.CopyURL(s.url), Weight: s.weight, OldWeight: before.weight})
+		}
+		if optionsChanged(&before, s) {
+			rr.emit(BalancerEvent{Type: ServerUpdated, Reason: ReasonUpdate, URL: utils.CopyURL(s.url), Weight: s.weight})
+		}
 		return nil
 	}
 
@@ -207,19 +482,37 @@ func (rr *RoundRobin) UpsertServer(u *url.URL, options ...ServerOption) error {
 	if srv.weight == 0 {
 		srv.weight = defaultWeight
 	}
+	if rr.newBreaker != nil {
+		breaker, err := rr.newBreaker()
+		if err != nil {
+			return err
+		}
+		srv.breaker = breaker
+	}
+	if rr.serverMetrics {
+		metrics, err := memmetrics.NewRTMetrics(memmetrics.RTClock(rr.clock))
+		if err != nil {
+			return err
+		}
+		srv.metrics = metrics
+	}
+	srv.rampStart = rr.clock.UtcNow()
 
 	rr.servers = append(rr.servers, srv)
 	rr.resetState()
+	rr.emit(BalancerEvent{Type: ServerAdded, Reason: ReasonUpdate, URL: utils.CopyURL(srv.url), Weight: srv.weight})
 	return nil
 }
 
-func (r *RoundRobin) resetIterator() {
-	r.index = -1
-	r.currentWeight = 0
+// optionsChanged tells whether the server options other than weight are different
+func optionsChanged(a, b *server) bool {
+	return a.priority != b.priority || a.region != b.region || a.zone != b.zone ||
+		a.slowStart != b.slowStart || !reflect.DeepEqual(a.labels, b.labels)
 }
 
+// resetState makes the next request rebuild the schedule, should be called with the lock held
 func (r *RoundRobin) resetState() {
-	r.resetIterator()
+	r.schedule.Store((*schedule)(nil))
 }
 
 func (r *RoundRobin) findServerByURL(u *url.URL) (*server, int) {
@@ -234,23 +527,73 @@ func (r *RoundRobin) findServerByURL(u *url.URL) (*server, int) {
 	return nil, -1
 }
 
-func (rr *RoundRobin) maxWeight() int {
+// effectiveWeight returns the weight of the server scaled by slowStartScale and reduced if the server is warming up
+func (rr *RoundRobin) effectiveWeight(s *server, now time.Time) int {
+	weight := s.weight * slowStartScale
+	if s.slowStart == 0 || weight == 0 {
+		return weight
+	}
+	elapsed := now.Sub(s.rampStart)
+	if elapsed >= s.slowStart {
+		return weight
+	}
+	factor := 0.0
+	if elapsed > 0 {
+		factor = math.Pow(float64(elapsed)/float64(s.slowStart), 1/rr.slowStartAggression)
+	}
+	if factor < rr.slowStartMin {
+		factor = rr.slowStartMin
+	}
+	weight = int(float64(weight) * factor)
+	if weight < 1 {
+		return 1
+	}
+	return weight
+}
+
+// serverWeights returns the current weights of the servers, -1 for the servers out of rotation
+func (rr *RoundRobin) serverWeights(now time.Time) []int {
+	weights := make([]int, len(rr.servers))
+	for i, s := range rr.servers {
+		if !s.enabled() {
+			weights[i] = -1
+			continue
+		}
+		weights[i] = rr.effectiveWeight(s, now)
+	}
+	rr.applyPriorities(weights)
+	return weights
+}
+
+func containsURL(urls []*url.URL, u *url.URL) bool {
+	for _, c := range urls {
+		if sameURL(c, u) {
+			return true
+		}
+	}
+	return false
+}
+
+func maxWeight(weights []int) int {
 	max := -1
-	for _, s := range rr.servers {
-		if s.weight > max {
-			max = s.weight
+	for _, w := range weights {
+		if w > max {
+			max = w
 		}
 	}
 	return max
 }
 
-func (rr *RoundRobin) weightGcd() int {
+func weightGcd(weights []int) int {
 	divisor := -1
-	for _, s := range rr.servers {
+	for _, w := range weights {
+		if w < 0 {
+			continue
+		}
 		if divisor == -1 {
-			divisor = s.weight
+			divisor = w
 		} else {
-			divisor = gcd(divisor, s.weight)
+			divisor = gcd(divisor, w)
 		}
 	}
 	return divisor
@@ -274,10 +617,47 @@ type server struct {
 	url *url.URL
 	// Relative weight for the enpoint to other enpoints in the load balancer
 	weight int
+	// unhealthy servers are kept out of rotation
+	unhealthy bool
+	// ejected servers are kept out of rotation by the outlier detector
+	ejected bool
+	// slow start window and the time the server has started to warm up
+	slowStart time.Duration
+	rampStart time.Time
+	// draining servers get no new requests and are removed once the requests in flight complete
+	draining bool
+	// inflight is the amount of requests the server is processing, released is notified on every
+	// completed request while the server is draining
+	inflight int64
+	released chan struct{}
+	// priority tier of the server, 0 is the highest
+	priority int
+	// locality of the server
+	region string
+	zone   string
+	// arbitrary metadata of the server
+	labels map[string]string
+	// round trip metrics, collected if the load balancer has server metrics enabled
+	metrics *memmetrics.RTMetrics
+	// circuit breaker of the server, set if the load balancer has server circuit breakers
+	breaker *cbreaker.CircuitBreaker
+}
+
+// enabled returns true if the server can receive new requests
+func (s *server) enabled() bool {
+	return !s.unhealthy && !s.ejected && !s.draining
 }
 
 const defaultWeight = 1
 
+const (
+	// Weights are scaled to let the slow start give fractions of the weight to the servers,
+	// the scale does not affect the order of the servers as GCD of the weights is scaled too
+	slowStartScale             = 100
+	defaultSlowStartAggression = 1
+	defaultSlowStartMin        = 0.1
+)
+
 func sameURL(a, b *url.URL) bool {
 	return a.Path == b.Path && a.Host == b.Host && a.Scheme == b.Scheme
 }
@@ -288,6 +668,10 @@ type balancerHandler interface {
 	ServerWeight(u *url.URL) (int, bool)
 	RemoveServer(u *url.URL) error
 	UpsertServer(u *url.URL, options ...ServerOption) error
+	SetServerHealth(u *url.URL, healthy bool) error
+	Drain(u *url.URL, timeout time.Duration, listener DrainListener) error
+	Snapshot() []ServerSnapshot
 	NextServer() (*url.URL, error)
+	NextServerExcept(exclude []*url.URL) (*url.URL, error)
 	Next() http.Handler
 }
@@ -1,10 +1,15 @@
 package roundrobin
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/mailgun/timetools"
 	"github.com/vulcand/oxy/forward"
 	"github.com/vulcand/oxy/testutils"
 	"github.com/vulcand/oxy/utils"
@@ -223,6 +228,186 @@ func (s *RRSuite) TestRequestRewriteListener(c *C) {
 	c.Assert(lb.requestRewriteListener, NotNil)
 }
 
+func (s *RRSuite) TestSlowStart(c *C) {
+	clock := &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+
+	lb, err := New(nil, RoundRobinClock(clock))
+	c.Assert(err, IsNil)
+
+	a, b := testutils.ParseURI("http://localhost:5000"), testutils.ParseURI("http://localhost:5001")
+	c.Assert(lb.UpsertServer(a), IsNil)
+	c.Assert(lb.UpsertServer(b, SlowStart(10*time.Second)), IsNil)
+
+	// server starts with 10% of its weight
+	c.Assert(countServers(c, lb, 110)[b.String()], Equals, 10)
+
+	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+	c.Assert(countServers(c, lb, 150)[b.String()], Equals, 50)
+
+	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+	c.Assert(countServers(c, lb, 200)[b.String()], Equals, 100)
+
+	// configured weight is reported all the time
+	w, ok := lb.ServerWeight(b)
+	c.Assert(ok, Equals, true)
+	c.Assert(w, Equals, 1)
+}
+
+func (s *RRSuite) TestScheduleLength(c *C) {
+	clock := &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+
+	lb, err := New(nil, RoundRobinClock(clock))
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 20; i++ {
+		c.Assert(lb.UpsertServer(testutils.ParseURI(fmt.Sprintf("http://localhost:%d", 5000+i)), Weight(1000)), IsNil)
+	}
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:6000"), Weight(1000), SlowStart(time.Minute)), IsNil)
+
+	// the weights scaled for slow start are not laid out as is
+	sched := lb.currentSchedule()
+	c.Assert(sched.err, IsNil)
+	c.Assert(len(sched.servers) <= maxScheduleLength, Equals, true)
+	c.Assert(containsServer(sched.servers, lb.servers[20]), Equals, true)
+
+	// the servers with the same weight get one slot each once the slow start is over
+	clock.CurrentTime = clock.CurrentTime.Add(time.Minute)
+	c.Assert(len(lb.currentSchedule().servers), Equals, 21)
+
+	c.Assert(layoutWeights([]int{-1, 0, 300, 600}), DeepEquals, []int{-1, 0, 1, 2})
+	c.Assert(layoutWeights([]int{1, 1000000}), DeepEquals, []int{1, 999})
+}
+
+func (s *RRSuite) TestSlowStartCurve(c *C) {
+	clock := &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+
+	lb, err := New(nil, RoundRobinClock(clock), SlowStartCurve(2, 0))
+	c.Assert(err, IsNil)
+
+	a, b := testutils.ParseURI("http://localhost:5000"), testutils.ParseURI("http://localhost:5001")
+	c.Assert(lb.UpsertServer(a), IsNil)
+	c.Assert(lb.UpsertServer(b, SlowStart(100*time.Second)), IsNil)
+
+	// (25/100)^(1/2) = 0.5
+	clock.CurrentTime = clock.CurrentTime.Add(25 * time.Second)
+	c.Assert(countServers(c, lb, 150)[b.String()], Equals, 50)
+
+	_, err = New(nil, SlowStartCurve(0, 10))
+	c.Assert(err, NotNil)
+
+	_, err = New(nil, SlowStartCurve(1, 101))
+	c.Assert(err, NotNil)
+}
+
+func (s *RRSuite) TestSlowStartAfterRecovery(c *C) {
+	clock := &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+
+	lb, err := New(nil, RoundRobinClock(clock))
+	c.Assert(err, IsNil)
+
+	a, b := testutils.ParseURI("http://localhost:5000"), testutils.ParseURI("http://localhost:5001")
+	c.Assert(lb.UpsertServer(a), IsNil)
+	c.Assert(lb.UpsertServer(b, SlowStart(10*time.Second)), IsNil)
+
+	clock.CurrentTime = clock.CurrentTime.Add(time.Minute)
+	c.Assert(countServers(c, lb, 200)[b.String()], Equals, 100)
+
+	c.Assert(lb.SetServerHealth(b, false), IsNil)
+	c.Assert(lb.SetServerHealth(b, true), IsNil)
+	c.Assert(countServers(c, lb, 110)[b.String()], Equals, 10)
+}
+
+func (s *RRSuite) TestSlowStartRebalancer(c *C) {
+	clock := &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+
+	lb, err := New(nil, RoundRobinClock(clock))
+	c.Assert(err, IsNil)
+
+	rb, err := NewRebalancer(lb, RebalancerClock(clock))
+	c.Assert(err, IsNil)
+
+	a, b := testutils.ParseURI("http://localhost:5000"), testutils.ParseURI("http://localhost:5001")
+	c.Assert(rb.UpsertServer(a), IsNil)
+	c.Assert(rb.UpsertServer(b, SlowStart(10*time.Second)), IsNil)
+
+	// weights set by the rebalancer are ramped up as well
+	rb.servers[1].curWeight = 4
+	rb.applyWeights()
+	c.Assert(countServers(c, lb, 140)[b.String()], Equals, 40)
+
+	clock.CurrentTime = clock.CurrentTime.Add(10 * time.Second)
+	c.Assert(countServers(c, lb, 500)[b.String()], Equals, 400)
+}
+
+func (s *RRSuite) TestNextServerExcept(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	a, b, d := testutils.ParseURI("http://localhost:5000"), testutils.ParseURI("http://localhost:5001"), testutils.ParseURI("http://localhost:5002")
+	c.Assert(lb.UpsertServer(a), IsNil)
+	c.Assert(lb.UpsertServer(b), IsNil)
+	c.Assert(lb.UpsertServer(d), IsNil)
+
+	for i := 0; i < 3; i++ {
+		u, err := lb.NextServerExcept([]*url.URL{a, b})
+		c.Assert(err, IsNil)
+		c.Assert(u.String(), Equals, d.String())
+	}
+
+	// all servers are excluded, any server is fine
+	u, err := lb.NextServerExcept([]*url.URL{a, b, d})
+	c.Assert(err, IsNil)
+	c.Assert(u, NotNil)
+}
+
+func (s *RRSuite) TestAttemptsAreTracked(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(b.URL)), IsNil)
+
+	attempts := utils.NewAttempts()
+	for i := 0; i < 2; i++ {
+		attempts.Next()
+		req := utils.WithAttempts(httptest.NewRequest(http.MethodGet, "/", nil), attempts)
+		lb.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	servers := attempts.Servers()
+	c.Assert(len(servers), Equals, 2)
+	c.Assert(servers[0].String(), Equals, a.URL)
+	c.Assert(servers[1].String(), Equals, b.URL)
+}
+
+func countServers(c *C, lb *RoundRobin, repeat int) map[string]int {
+	out := map[string]int{}
+	for i := 0; i < repeat; i++ {
+		u, err := lb.NextServer()
+		c.Assert(err, IsNil)
+		out[u.String()]++
+	}
+	return out
+}
+
 func seq(c *C, url string, repeat int) []string {
 	out := []string{}
 	for i := 0; i < repeat; i++ {
@@ -232,3 +417,89 @@ func seq(c *C, url string, repeat int) []string {
 	}
 	return out
 }
+
+func (s *RRSuite) TestConcurrentNextServer(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	for i := 1; i <= 3; i++ {
+		c.Assert(lb.UpsertServer(testutils.ParseURI(fmt.Sprintf("http://localhost:%d", 5000+i)), Weight(i)), IsNil)
+	}
+
+	// the servers are selected from the schedule, so concurrent requests keep the exact proportions
+	// gocheck asserts can not be used in other goroutines, so the errors are sent back to the test goroutine
+	counts := make(chan string, 600)
+	errs := make(chan error, 600)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				u, err := lb.NextServer()
+				if err != nil {
+					errs <- err
+					continue
+				}
+				counts <- u.String()
+			}
+		}()
+	}
+	wg.Wait()
+	close(counts)
+	close(errs)
+
+	for err := range errs {
+		c.Assert(err, IsNil)
+	}
+	out := make(map[string]int)
+	for u := range counts {
+		out[u]++
+	}
+	c.Assert(out, DeepEquals, map[string]int{
+		"http://localhost:5001": 100,
+		"http://localhost:5002": 200,
+		"http://localhost:5003": 300,
+	})
+}
+
+func newBenchmarkLB(b *testing.B, servers int) *RoundRobin {
+	lb, err := New(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < servers; i++ {
+		u := testutils.ParseURI(fmt.Sprintf("http://localhost:%d", 5000+i))
+		if err := lb.UpsertServer(u, Weight(1+i%3)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return lb
+}
+
+func benchmarkNextServer(b *testing.B, servers int) {
+	lb := newBenchmarkLB(b, servers)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := lb.NextServer(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkNextServerParallel(b *testing.B, servers int) {
+	lb := newBenchmarkLB(b, servers)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := lb.NextServer(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkNextServer10(b *testing.B)          { benchmarkNextServer(b, 10) }
+func BenchmarkNextServer100(b *testing.B)         { benchmarkNextServer(b, 100) }
+func BenchmarkNextServerParallel10(b *testing.B)  { benchmarkNextServerParallel(b, 10) }
+func BenchmarkNextServerParallel100(b *testing.B) { benchmarkNextServerParallel(b, 100) }
@@ -0,0 +1,173 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/timetools"
+)
+
+// schedule is one full round of the interleaved weighted round robin, laid out in advance so the servers
+// are selected with an atomic counter instead of recomputing the weights under the lock on every request.
+// The schedule is rebuilt when the servers change, and periodically while some servers are in slow start.
+type schedule struct {
+	// next is the position of the next server, accessed atomically, kept first for 64-bit alignment
+	next    uint64
+	servers []*server
+	// err is returned instead of the server if the schedule can not be built, e.g. there are no servers
+	err error
+	// breakers is set if the servers have circuit breakers to check before selecting them
+	breakers bool
+	// ramping schedules expire as the weights of the servers in slow start grow
+	ramping bool
+	expires time.Time
+}
+
+// pick returns the next server of the schedule skipping the excluded servers and the servers with tripped
+// circuit breakers. If all servers left are excluded, it returns the next excluded server that is not tripped.
+func (s *schedule) pick(exclude []*url.URL) (*server, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	n := atomic.AddUint64(&s.next, 1) - 1
+	size := uint64(len(s.servers))
+	if len(exclude) == 0 && !s.breakers {
+		return s.servers[n%size], nil
+	}
+
+	// servers repeat in the schedule, every breaker is asked once as the breakers count the denied requests
+	var denied []*server
+	for _, excluded := range []bool{false, true} {
+		for i := uint64(0); i < size; i++ {
+			srv := s.servers[(n+i)%size]
+			if containsURL(exclude, srv.url) != excluded || containsServer(denied, srv) {
+				continue
+			}
+			if srv.allowed() {
+				return srv, nil
+			}
+			denied = append(denied, srv)
+		}
+		if len(exclude) == 0 {
+			break
+		}
+	}
+	return nil, errAllServersTripped
+}
+
+func containsServer(servers []*server, s *server) bool {
+	for _, srv := range servers {
+		if srv == s {
+			return true
+		}
+	}
+	return false
+}
+
+// currentSchedule returns the schedule, rebuilding it if the servers have changed or the slow start has progressed
+func (rr *RoundRobin) currentSchedule() *schedule {
+	if s := rr.schedule.Load().(*schedule); s != nil && !s.expired(rr.clock) {
+		return s
+	}
+
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	// the schedule could have been rebuilt while waiting for the lock
+	s := rr.schedule.Load().(*schedule)
+	if s != nil && !s.expired(rr.clock) {
+		return s
+	}
+	next := rr.buildSchedule(rr.clock.UtcNow())
+	if s != nil {
+		// the schedule has expired as slow start has progressed, the rotation continues where it was
+		next.next = atomic.LoadUint64(&s.next)
+	}
+	rr.schedule.Store(next)
+	return next
+}
+
+func (s *schedule) expired(clock timetools.TimeProvider) bool {
+	return s.ramping && !clock.UtcNow().Before(s.expires)
+}
+
+// buildSchedule lays out the servers in the order the interleaved weighted round robin selects them:
+// on every pass over the servers the current weight is decreased by GCD of the weights,
+// and the servers with the weight not less than the current weight are selected.
+// Should be called with the lock held.
+func (rr *RoundRobin) buildSchedule(now time.Time) *schedule {
+	if len(rr.servers) == 0 {
+		return &schedule{err: fmt.Errorf("no servers in the pool")}
+	}
+
+	weights := rr.serverWeights(now)
+	// Maximum weight across all enabled servers
+	max := maxWeight(weights)
+	if max == -1 {
+		return &schedule{err: fmt.Errorf("no healthy servers in the pool")}
+	}
+	if max == 0 {
+		return &schedule{err: fmt.Errorf("all servers have 0 weight")}
+	}
+	weights = layoutWeights(weights)
+	max = maxWeight(weights)
+	// GCD across all enabled servers
+	gcd := weightGcd(weights)
+
+	s := &schedule{}
+	for current := max; current > 0; current -= gcd {
+		for i, w := range weights {
+			if w >= current {
+				s.servers = append(s.servers, rr.servers[i])
+			}
+		}
+	}
+	s.breakers = rr.newBreaker != nil
+	for _, srv := range rr.servers {
+		if srv.enabled() && srv.slowStart != 0 && now.Sub(srv.rampStart) < srv.slowStart {
+			s.ramping = true
+			s.expires = now.Add(scheduleRefresh)
+			break
+		}
+	}
+	return s
+}
+
+// layoutWeights returns the numbers of the slots of the servers in the schedule: the weights are divided by their GCD
+// and, if the schedule would be longer than maxScheduleLength, scaled down proportionally keeping at least one slot
+// for every server with non-zero weight. Otherwise the weights scaled for slow start would make the schedule huge.
+func layoutWeights(weights []int) []int {
+	gcd := weightGcd(weights)
+	out := make([]int, len(weights))
+	total := 0
+	for i, w := range weights {
+		if w <= 0 {
+			out[i] = w
+			continue
+		}
+		out[i] = w / gcd
+		total += out[i]
+	}
+	if total <= maxScheduleLength {
+		return out
+	}
+	for i, w := range out {
+		if w <= 0 {
+			continue
+		}
+		out[i] = int(int64(w) * maxScheduleLength / int64(total))
+		if out[i] == 0 {
+			out[i] = 1
+		}
+	}
+	return out
+}
+
+// maxScheduleLength limits the number of the slots in the schedule, so the proportions of the servers are kept
+// with the precision of 0.1%
+const maxScheduleLength = 1000
+
+// scheduleRefresh is how often the schedule is rebuilt while servers are in slow start
+const scheduleRefresh = 100 * time.Millisecond
@@ -0,0 +1,105 @@
+package roundrobin
+
+import (
+	"net/url"
+
+	"github.com/vulcand/oxy/memmetrics"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Labels is an optional functional argument that attaches arbitrary metadata to the server,
+// the labels replace the labels the server had before
+func Labels(labels map[string]string) ServerOption {
+	return func(s *server) error {
+		s.labels = copyLabels(labels)
+		return nil
+	}
+}
+
+// EnableServerMetrics makes the load balancer collect round trip metrics of every server,
+// the metrics are reported by Snapshot
+func EnableServerMetrics() LBOption {
+	return func(s *RoundRobin) error {
+		s.serverMetrics = true
+		return nil
+	}
+}
+
+// ServerSnapshot describes the state of the server at the time of the snapshot
+type ServerSnapshot struct {
+	URL    *url.URL
+	Labels map[string]string
+
+	// Weight is the weight the server has been configured with
+	Weight int
+	// EffectiveWeight is the weight the server has in rotation after slow start, priority and locality
+	// are taken into account, 0 if the server is out of rotation
+	EffectiveWeight float64
+	// Rating is the rating of the server reported by the Rebalancer meter, 0 if the meter is not ready
+	Rating float64
+
+	Priority int
+	Region   string
+	Zone     string
+
+	Healthy  bool
+	Ejected  bool
+	Draining bool
+	InFlight int64
+
+	// Metrics are the recent round trip metrics of the server, nil unless enabled with EnableServerMetrics
+	Metrics *memmetrics.RTMetrics
+}
+
+// Snapshot returns the state of all servers of the load balancer
+func (rr *RoundRobin) Snapshot() []ServerSnapshot {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	weights := rr.serverWeights(rr.clock.UtcNow())
+	out := make([]ServerSnapshot, len(rr.servers))
+	for i, s := range rr.servers {
+		out[i] = ServerSnapshot{
+			URL:      utils.CopyURL(s.url),
+			Labels:   copyLabels(s.labels),
+			Weight:   s.weight,
+			Priority: s.priority,
+			Region:   s.region,
+			Zone:     s.zone,
+			Healthy:  !s.unhealthy,
+			Ejected:  s.ejected,
+			Draining: s.draining,
+			InFlight: s.inflight,
+		}
+		if weights[i] > 0 {
+			out[i].EffectiveWeight = float64(weights[i]) / slowStartScale
+		}
+		if s.metrics != nil {
+			out[i].Metrics = rr.copyMetrics(s.metrics)
+		}
+	}
+	return out
+}
+
+// copyMetrics returns a copy of the metrics the caller can read without holding the lock
+func (rr *RoundRobin) copyMetrics(m *memmetrics.RTMetrics) *memmetrics.RTMetrics {
+	out, err := memmetrics.NewRTMetrics(memmetrics.RTClock(rr.clock))
+	if err != nil {
+		return nil
+	}
+	if err := out.Append(m); err != nil {
+		return nil
+	}
+	return out
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,81 @@
+package roundrobin
+
+import (
+	"net/http/httptest"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type SnapshotSuite struct{}
+
+var _ = Suite(&SnapshotSuite{})
+
+func (s *SnapshotSuite) TestSnapshot(c *C) {
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	lb, err := New(nil, RoundRobinClock(clock))
+	c.Assert(err, IsNil)
+
+	labels := map[string]string{"version": "1.2"}
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000"), Weight(2), Labels(labels), Locality("us-east", "us-east-1a")), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5001"), SlowStart(10*time.Second)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5002"), Priority(1)), IsNil)
+	c.Assert(lb.SetServerHealth(testutils.ParseURI("http://localhost:5002"), false), IsNil)
+
+	// labels are copied
+	labels["version"] = "1.3"
+
+	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+	out := lb.Snapshot()
+	c.Assert(len(out), Equals, 3)
+
+	c.Assert(out[0].URL.String(), Equals, "http://localhost:5000")
+	c.Assert(out[0].Labels, DeepEquals, map[string]string{"version": "1.2"})
+	c.Assert(out[0].Weight, Equals, 2)
+	c.Assert(out[0].EffectiveWeight, Equals, 2.0)
+	c.Assert(out[0].Zone, Equals, "us-east-1a")
+	c.Assert(out[0].Healthy, Equals, true)
+	c.Assert(out[0].Metrics, IsNil)
+
+	c.Assert(out[1].Weight, Equals, 1)
+	c.Assert(out[1].EffectiveWeight, Equals, 0.5)
+
+	c.Assert(out[2].Priority, Equals, 1)
+	c.Assert(out[2].Healthy, Equals, false)
+	c.Assert(out[2].EffectiveWeight, Equals, 0.0)
+
+	// snapshot is a copy
+	out[0].Labels["version"] = "2.0"
+	c.Assert(lb.Snapshot()[0].Labels["version"], Equals, "1.2")
+}
+
+func (s *SnapshotSuite) TestMetrics(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, EnableServerMetrics())
+	c.Assert(err, IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL)), IsNil)
+
+	rb, err := NewRebalancer(lb)
+	c.Assert(err, IsNil)
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	seq(c, proxy.URL, 3)
+
+	out := rb.Snapshot()
+	c.Assert(len(out), Equals, 1)
+	c.Assert(out[0].InFlight, Equals, int64(0))
+	c.Assert(out[0].Metrics, NotNil)
+	c.Assert(out[0].Metrics.TotalCount(), Equals, int64(3))
+	c.Assert(out[0].Metrics.StatusCodesCounts(), DeepEquals, map[int]int64{200: 3})
+}
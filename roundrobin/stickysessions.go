@@ -0,0 +1,90 @@
+package roundrobin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+)
+
+// CookieOptions defines the attributes of the cookie set by the sticky session
+type CookieOptions struct {
+	// Path of the cookie, defaults to "/"
+	Path string
+	// HTTPOnly hides the cookie from the client side scripts
+	HTTPOnly bool
+	// Secure makes the client send the cookie over HTTPS only
+	Secure bool
+	// SameSite restricts sending the cookie along with the cross-site requests
+	SameSite http.SameSite
+	// MaxAge is the cookie lifetime in seconds, 0 means the cookie lasts until the browser session ends
+	MaxAge int
+	// Hashed stores the hash of the server URL in the cookie instead of the URL, so internal
+	// addresses of the servers are not exposed to the clients
+	Hashed bool
+}
+
+// StickySession makes the load balancer send all requests of the same client to the same server,
+// server is remembered in the cookie set on the first response
+type StickySession struct {
+	cookieName string
+	options    CookieOptions
+}
+
+// NewStickySession returns sticky session with the session cookie of the given name
+func NewStickySession(cookieName string) *StickySession {
+	return &StickySession{cookieName: cookieName}
+}
+
+// NewStickySessionWithOptions returns sticky session with the cookie of the given name and attributes
+func NewStickySessionWithOptions(cookieName string, options CookieOptions) *StickySession {
+	return &StickySession{cookieName: cookieName, options: options}
+}
+
+// GetBackend returns the server the request is stuck to, the second return value is false if the request
+// has no cookie or the server from the cookie is not in the servers list anymore
+func (s *StickySession) GetBackend(req *http.Request, servers []*url.URL) (*url.URL, bool, error) {
+	cookie, err := req.Cookie(s.cookieName)
+	switch err {
+	case nil:
+	case http.ErrNoCookie:
+		return nil, false, nil
+	default:
+		return nil, false, err
+	}
+
+	for _, u := range servers {
+		if s.cookieValue(u) == cookie.Value {
+			return u, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// StickBackend sets the cookie that sticks the following requests of the client to the backend
+func (s *StickySession) StickBackend(backend *url.URL, w http.ResponseWriter) {
+	path := s.options.Path
+	if path == "" {
+		path = "/"
+	}
+	cookie := &http.Cookie{
+		Name:     s.cookieName,
+		Value:    s.cookieValue(backend),
+		Path:     path,
+		HttpOnly: s.options.HTTPOnly,
+		Secure:   s.options.Secure,
+		SameSite: s.options.SameSite,
+		MaxAge:   s.options.MaxAge,
+	}
+	http.SetCookie(w, cookie)
+}
+
+func (s *StickySession) cookieValue(u *url.URL) string {
+	// scheme, host and path is what identifies the server, see sameURL
+	value := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+	if !s.options.Hashed {
+		return value
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,235 @@
+package roundrobin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type StickySessionSuite struct{}
+
+var _ = Suite(&StickySessionSuite{})
+
+func (s *StickySessionSuite) TestBasic(c *C) {
+	a, b := testutils.NewResponder("a"), testutils.NewResponder("b")
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, EnableStickySession(NewStickySession("test")))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	cookie := &http.Cookie{Name: "test", Value: a.URL}
+	for i := 0; i < 10; i++ {
+		c.Assert(getWithCookie(c, proxy.URL, cookie), Equals, "a")
+	}
+}
+
+func (s *StickySessionSuite) TestStickBackend(c *C) {
+	a, b := testutils.NewResponder("a"), testutils.NewResponder("b")
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, EnableStickySession(NewStickySession("test")))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "a")
+
+	cookies := re.Cookies()
+	c.Assert(len(cookies), Equals, 1)
+	c.Assert(cookies[0].Name, Equals, "test")
+	c.Assert(cookies[0].Value, Equals, a.URL)
+
+	// round robin would have picked b otherwise
+	for i := 0; i < 3; i++ {
+		c.Assert(getWithCookie(c, proxy.URL, cookies[0]), Equals, "a")
+	}
+}
+
+func (s *StickySessionSuite) TestRemoveStuckServer(c *C) {
+	a, b := testutils.NewResponder("a"), testutils.NewResponder("b")
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, EnableStickySession(NewStickySession("test")))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	cookie := &http.Cookie{Name: "test", Value: a.URL}
+	c.Assert(getWithCookie(c, proxy.URL, cookie), Equals, "a")
+
+	c.Assert(lb.RemoveServer(testutils.ParseURI(a.URL)), IsNil)
+	for i := 0; i < 3; i++ {
+		c.Assert(getWithCookie(c, proxy.URL, cookie), Equals, "b")
+	}
+}
+
+func (s *StickySessionSuite) TestBadCookieValue(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, EnableStickySession(NewStickySession("test")))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	c.Assert(getWithCookie(c, proxy.URL, &http.Cookie{Name: "test", Value: "http://caramba:4000"}), Equals, "a")
+}
+
+func (s *StickySessionSuite) TestCookieOptions(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	ss := NewStickySessionWithOptions("test", CookieOptions{
+		HTTPOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   60,
+		Hashed:   true,
+	})
+	lb, err := New(fwd, EnableStickySession(ss))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+
+	header := re.Header.Get("Set-Cookie")
+	c.Assert(strings.Contains(header, "HttpOnly"), Equals, true)
+	c.Assert(strings.Contains(header, "Secure"), Equals, true)
+	c.Assert(strings.Contains(header, "SameSite=Strict"), Equals, true)
+	c.Assert(strings.Contains(header, "Max-Age=60"), Equals, true)
+
+	cookies := re.Cookies()
+	c.Assert(len(cookies), Equals, 1)
+	c.Assert(strings.Contains(cookies[0].Value, "127.0.0.1"), Equals, false)
+
+	u, ok, err := ss.GetBackend(requestWithCookie(c, proxy.URL, cookies[0]), lb.Servers())
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	c.Assert(u.String(), Equals, a.URL)
+}
+
+func (s *StickySessionSuite) TestRebalancer(c *C) {
+	a, b := testutils.NewResponder("a"), testutils.NewResponder("b")
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+
+	rb, err := NewRebalancer(lb, RebalancerStickySession(NewStickySession("test")))
+	c.Assert(err, IsNil)
+
+	rb.UpsertServer(testutils.ParseURI(a.URL))
+	rb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	cookie := &http.Cookie{Name: "test", Value: b.URL}
+	for i := 0; i < 5; i++ {
+		c.Assert(getWithCookie(c, proxy.URL, cookie), Equals, "b")
+	}
+}
+
+// The cookie pointing at the server out of rotation is ignored
+func (s *StickySessionSuite) TestRebalancerOutOfRotation(c *C) {
+	a, b, d := testutils.NewResponder("a"), testutils.NewResponder("b"), testutils.NewResponder("d")
+	defer a.Close()
+	defer b.Close()
+	defer d.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+
+	rb, err := NewRebalancer(lb, RebalancerStickySession(NewStickySession("test")))
+	c.Assert(err, IsNil)
+
+	c.Assert(rb.UpsertServer(testutils.ParseURI(a.URL)), IsNil)
+	c.Assert(rb.UpsertServer(testutils.ParseURI(b.URL)), IsNil)
+	c.Assert(rb.UpsertServer(testutils.ParseURI(d.URL)), IsNil)
+
+	c.Assert(rb.SetServerHealth(testutils.ParseURI(b.URL), false), IsNil)
+	// the outlier detector ejects the server from the wrapped load balancer
+	c.Assert(lb.setServerEjected(testutils.ParseURI(d.URL), true), IsNil)
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	for _, u := range []string{b.URL, d.URL} {
+		cookie := &http.Cookie{Name: "test", Value: u}
+		for i := 0; i < 3; i++ {
+			c.Assert(getWithCookie(c, proxy.URL, cookie), Equals, "a")
+		}
+	}
+}
+
+func requestWithCookie(c *C, url string, cookie *http.Cookie) *http.Request {
+	req, err := http.NewRequest("GET", url, nil)
+	c.Assert(err, IsNil)
+	req.AddCookie(cookie)
+	return req
+}
+
+func getWithCookie(c *C, url string, cookie *http.Cookie) string {
+	re, err := http.DefaultClient.Do(requestWithCookie(c, url, cookie))
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	return string(body)
+}
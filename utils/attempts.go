@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Attempts keeps track of the attempts to proxy the request. Middlewares that retry requests attach it
+// to the request context, so the load balancers can send the retries to the servers that have not been tried yet.
+type Attempts struct {
+	mtx     *sync.Mutex
+	number  int
+	servers []*url.URL
+	err     error
+}
+
+type attemptsKey struct{}
+
+// NewAttempts returns attempts tracker with no attempts made
+func NewAttempts() *Attempts {
+	return &Attempts{mtx: &sync.Mutex{}}
+}
+
+// WithAttempts returns a shallow copy of the request with the attempts attached to its context
+func WithAttempts(req *http.Request, a *Attempts) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), attemptsKey{}, a))
+}
+
+// AttemptsFromRequest returns the attempts attached to the request, nil if the request is not retried
+func AttemptsFromRequest(req *http.Request) *Attempts {
+	a, _ := req.Context().Value(attemptsKey{}).(*Attempts)
+	return a
+}
+
+// Next starts the next attempt and returns its number, the first attempt is 1
+func (a *Attempts) Next() int {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.number++
+	a.err = nil
+	return a.number
+}
+
+// Number returns the number of the current attempt
+func (a *Attempts) Number() int {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.number
+}
+
+// AddServer records the server the request has been sent to
+func (a *Attempts) AddServer(u *url.URL) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.servers = append(a.servers, CopyURL(u))
+}
+
+// Servers returns the servers the request has been sent to in the order of the attempts
+func (a *Attempts) Servers() []*url.URL {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	out := make([]*url.URL, len(a.servers))
+	copy(out, a.servers)
+	return out
+}
+
+// SetError records the error the current attempt has failed with
+func (a *Attempts) SetError(err error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.err = err
+}
+
+// Err returns the error the current attempt has failed with, nil if it has not failed or the error is unknown
+func (a *Attempts) Err() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.err
+}
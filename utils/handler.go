@@ -15,7 +15,14 @@ var DefaultHandler ErrorHandler = &StdHandler{}
 type StdHandler struct {
 }
 
+// ServeHTTP writes the status code matching the error and records the error to the attempts of the request,
+// so the middlewares retrying the request can tell the errors apart
 func (e *StdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	if req != nil {
+		if a := AttemptsFromRequest(req); a != nil {
+			a.SetError(err)
+		}
+	}
 	statusCode := http.StatusInternalServerError
 	if e, ok := err.(net.Error); ok {
 		if e.Timeout() {